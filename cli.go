@@ -0,0 +1,989 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+	"github.com/bhargavakumark/gmail-download/internal/atomicfile"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// Exit codes returned by the command line.
+const (
+	exitOK          = 0
+	exitFailure     = 1   // unexpected error
+	exitUsage       = 2   // bad command line
+	exitPartial     = 3   // the run completed but some messages failed
+	exitAuth        = 4   // authorisation failed or the token is unusable
+	exitConfig      = 5   // the action config could not be loaded or is invalid
+	exitLocked      = 6   // another run for the same account and config is in progress
+	exitInterrupted = 130 // stopped by SIGINT or SIGTERM, as shells report it
+)
+
+// cliError carries the process exit code for an error returned by a command.
+type cliError struct {
+	code int
+	err  error
+	// reported is set when the error was already shown to the user, as the
+	// flag package does for parse errors.
+	reported bool
+}
+
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
+
+func configError(err error) error      { return &cliError{code: exitConfig, err: err} }
+func authError(err error) error        { return &cliError{code: exitAuth, err: err} }
+func usageError(err error) error       { return &cliError{code: exitUsage, err: err} }
+func partialError(err error) error     { return &cliError{code: exitPartial, err: err} }
+func interruptedError(err error) error { return &cliError{code: exitInterrupted, err: err} }
+func lockedError(err error) error      { return &cliError{code: exitLocked, err: err} }
+
+// command is a subcommand of the CLI.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "download attachments and apply the configured actions (default)", cmdRun},
+		{"daemon", "run the configured actions on their schedules until stopped", cmdDaemon},
+		{"plan", "show what run would do without changing anything", cmdPlan},
+		{"auth", "manage the OAuth token: login, downscope, revoke, migrate", cmdAuth},
+		{"secrets", "manage the encrypted secrets file: set, delete, list", cmdSecrets},
+		{"labels", "list the Gmail labels of the account", cmdLabels},
+		{"search", "list messages matching a Gmail search query", cmdSearch},
+		{"validate-config", "check the action config without contacting Gmail", cmdValidateConfig},
+		{"status", "show the config, token and scope status", cmdStatus},
+	}
+}
+
+// runCLI runs the subcommand named by args[0] and returns the exit code.
+// Without a subcommand, run is assumed, so existing cron entries keep working.
+// SIGINT and SIGTERM cancel the context the subcommand runs with.
+func runCLI(args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return exitCode(cmd.run(ctx, args))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	return exitUsage
+}
+
+// exitCode reports err to the user and maps it to an exit code.
+func exitCode(err error) int {
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	var ce *cliError
+	if errors.As(err, &ce) {
+		if !ce.reported {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		return ce.code
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return exitFailure
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s <command> -help' for the flags of a command.\n", os.Args[0])
+	fmt.Fprintf(w, "\nExit codes: %d success, %d error, %d usage, %d partial failure, %d auth failure, %d config error, %d locked, %d interrupted\n",
+		exitOK, exitFailure, exitUsage, exitPartial, exitAuth, exitConfig, exitLocked, exitInterrupted)
+}
+
+// listFlag is a flag that can be repeated or given a comma-separated list.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// options holds the flags shared by the subcommands. Defaults come from the
+// environment variables the tool has always used, so flags override them.
+type options struct {
+	configPath  string
+	user        string
+	credentials string
+	tokenPath   string
+	logLevel    string
+	logFormat   string
+	quiet       bool
+	labels      listFlag
+	actions     listFlag
+	quotaRate   int
+	maxAttempts int
+	retryBudget int
+	batchSize   int
+	trace       string
+	envErrs     []error // malformed environment variables, reported by parse
+}
+
+// newFlagSet creates the flag set of a subcommand with the logging flags
+// that every command accepts.
+func (o *options) newFlagSet(name, usage, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n\n%s\n\nFlags:\n", os.Args[0], name, usage, description)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.logLevel, "log-level", envOr("GMAIL_LOG_LEVEL", "info"), "log level: debug, info, warn or error (env GMAIL_LOG_LEVEL)")
+	fs.StringVar(&o.logFormat, "log-format", envOr("GMAIL_LOG_FORMAT", "text"), "log format: text or json (env GMAIL_LOG_FORMAT)")
+	fs.BoolVar(&o.quiet, "quiet", false, "log errors only, e.g. when run from cron")
+	return fs
+}
+
+func (o *options) addConfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.configPath, "config", os.Getenv("GMAIL_ACTION_CONFIG"), "path to the action config (env GMAIL_ACTION_CONFIG)")
+	fs.Var(&o.labels, "label", "only process these labels (repeatable or comma-separated)")
+	fs.Var(&o.actions, "action", "only run the actions at these 0-based indexes within each label (repeatable or comma-separated)")
+}
+
+func (o *options) addAuthFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.user, "user", os.Getenv("GMAIL_USER"), "Gmail user ID, usually the email address (env GMAIL_USER)")
+	fs.StringVar(&o.credentials, "credentials", os.Getenv("GMAIL_CREDENTIALS_JSON"), "path to the OAuth client credentials.json (env GMAIL_CREDENTIALS_JSON)")
+	fs.StringVar(&o.tokenPath, "token", os.Getenv("GMAIL_TOKEN_FILE"), "path of the token file (env GMAIL_TOKEN_FILE)")
+}
+
+// addMailFlags adds the flags controlling how Gmail is called.
+func (o *options) addMailFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.quotaRate, "rate", o.envInt("GMAIL_RATE_LIMIT", download.DefaultQuotaRate), "Gmail quota units to spend per second at most, 0 for no limit (env GMAIL_RATE_LIMIT)")
+	fs.IntVar(&o.maxAttempts, "max-attempts", o.envInt("GMAIL_MAX_ATTEMPTS", download.DefaultMaxAttempts), "attempts per Gmail call on transient errors (env GMAIL_MAX_ATTEMPTS)")
+	fs.IntVar(&o.retryBudget, "retry-budget", o.envInt("GMAIL_RETRY_BUDGET", download.DefaultRetryBudget), "retries allowed across the whole run (env GMAIL_RETRY_BUDGET)")
+	fs.IntVar(&o.batchSize, "batch-size", o.envInt("GMAIL_BATCH_SIZE", download.DefaultBatchSize), fmt.Sprintf("messages fetched per batch request, at most %d; 1 disables batching (env GMAIL_BATCH_SIZE)", download.MaxBatchSize))
+	fs.StringVar(&o.trace, "trace", os.Getenv("GMAIL_TRACE"), "export spans of the run, its labels, actions, messages and Gmail calls: otlp or stdout; empty for none (env GMAIL_TRACE)")
+}
+
+// parse parses args into fs and sets up the logger the flags ask for.
+func (o *options) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &cliError{code: exitUsage, err: err, reported: true}
+	}
+	if err := errors.Join(o.envErrs...); err != nil {
+		return usageError(err)
+	}
+	logger, err := o.newLogger(os.Stderr)
+	if err != nil {
+		return usageError(err)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// loadConfig loads the action config and narrows it to the labels and
+// actions selected on the command line.
+func (o *options) loadConfig() (*download.Config, error) {
+	config, _, err := o.loadConfigFiles()
+	return config, err
+}
+
+// loadConfigFiles is loadConfig, also returning the files the config was
+// read from, for the daemon to watch.
+func (o *options) loadConfigFiles() (*download.Config, []string, error) {
+	if o.configPath == "" {
+		return nil, nil, usageError(errors.New("no action config: set -config or GMAIL_ACTION_CONFIG"))
+	}
+	config, files, err := download.LoadConfigFiles(o.configPath)
+	if err != nil {
+		var problems download.ConfigErrors
+		if errors.As(err, &problems) {
+			return nil, files, configError(fmt.Errorf("invalid config:\n%v", err))
+		}
+		return nil, files, configError(fmt.Errorf("unable to load config file: %v", err))
+	}
+	config, err = selectActions(config, o.labels, o.actions)
+	if err != nil {
+		return nil, files, configError(err)
+	}
+	return config, files, nil
+}
+
+// selectActions returns the part of config covering labels and the action
+// indexes in actions, with the rest of config. Empty selections keep
+// everything.
+func selectActions(config *download.Config, labels, actions []string) (*download.Config, error) {
+	wantLabel := make(map[string]bool)
+	for _, label := range labels {
+		wantLabel[label] = false
+	}
+	wantAction := make(map[int]bool)
+	for _, a := range actions {
+		i, err := strconv.Atoi(a)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid action index %q", a)
+		}
+		wantAction[i] = false
+	}
+
+	selected := *config
+	selected.LabelActions = nil
+	for _, labelAction := range config.LabelActions {
+		if len(wantLabel) > 0 {
+			if _, ok := wantLabel[labelAction.Label]; !ok {
+				continue
+			}
+			wantLabel[labelAction.Label] = true
+		}
+		if len(wantAction) > 0 {
+			var kept []download.Action
+			for i, action := range labelAction.Actions {
+				if _, ok := wantAction[i]; ok {
+					kept = append(kept, action)
+					wantAction[i] = true
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			labelAction.Actions = kept
+		}
+		selected.LabelActions = append(selected.LabelActions, labelAction)
+	}
+
+	for label, found := range wantLabel {
+		if !found {
+			return nil, fmt.Errorf("label %q is not in the config", label)
+		}
+	}
+	for i, found := range wantAction {
+		if !found {
+			return nil, fmt.Errorf("no label has an action with index %d", i)
+		}
+	}
+	return &selected, nil
+}
+
+// oauthConfig reads the client credentials and builds an OAuth config
+// requesting scope.
+func (o *options) oauthConfig(scope string) (*oauth2.Config, error) {
+	if o.credentials == "" {
+		return nil, usageError(errors.New("no client credentials: set -credentials or GMAIL_CREDENTIALS_JSON"))
+	}
+	config, err := loadOAuthConfig(o.credentials, scope)
+	if err != nil {
+		return nil, authError(err)
+	}
+	return config, nil
+}
+
+func (o *options) tokenStore() (TokenStore, error) {
+	store, err := newTokenStore(o.tokenPath)
+	if err != nil {
+		return nil, authError(fmt.Errorf("unable to open token store: %v", err))
+	}
+	return store, nil
+}
+
+// gmailService authorises with scope and returns a Gmail API client.
+func (o *options) gmailService(ctx context.Context, scope string) (*gmail.Service, error) {
+	_, svc, err := o.authorize(ctx, scope)
+	return svc, err
+}
+
+// authorize returns the HTTP client authorised with scope and the Gmail
+// service using it.
+func (o *options) authorize(ctx context.Context, scope string) (*http.Client, *gmail.Service, error) {
+	if o.user == "" {
+		return nil, nil, usageError(errors.New("no Gmail user: set -user or GMAIL_USER"))
+	}
+	config, err := o.oauthConfig(scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := o.tokenStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := getClient(config, store)
+	if err != nil {
+		return nil, nil, authError(err)
+	}
+	svc, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create gmail service: %v", err)
+	}
+	return client, svc, nil
+}
+
+// processor authorises with scope and returns a Processor running config
+// against the mailbox of the configured user, with the Gmail flags applied
+// over opts.
+func (o *options) processor(ctx context.Context, scope string, config *download.Config, opts download.Options) (*download.Processor, error) {
+	if o.batchSize > download.MaxBatchSize {
+		return nil, usageError(fmt.Errorf("-batch-size must be at most %d, got %d", download.MaxBatchSize, o.batchSize))
+	}
+	httpClient, svc, err := o.authorize(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	opts.User = o.user
+	opts.QuotaRate = o.quotaRate
+	opts.BatchSize = o.batchSize
+	opts.MaxAttempts = o.maxAttempts
+	opts.RetryBudget = o.retryBudget
+	return download.NewProcessor(config, download.NewGmailService(svc, httpClient, o.user), download.LocalStorage{}, opts)
+}
+
+func cmdRun(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("run", "[flags]", "Download attachments and apply the configured actions to matching messages.")
+	o.addConfigFlags(fs)
+	o.addAuthFlags(fs)
+	o.addMailFlags(fs)
+	workers := fs.Int("workers", o.envInt("GMAIL_WORKERS", download.DefaultWorkers), "number of messages processed concurrently (env GMAIL_WORKERS)")
+	checkpointPath := fs.String("checkpoint", envOr("GMAIL_CHECKPOINT_FILE", download.DefaultCheckpointFile), "file recording the progress of the run, to resume it after an interruption; empty to disable (env GMAIL_CHECKPOINT_FILE)")
+	restart := fs.Bool("restart", false, "ignore the checkpoint of an interrupted run and start from the beginning")
+	reportPath := fs.String("report", os.Getenv("GMAIL_REPORT_FILE"), "file to write the JSON report of the run to, with what was done to every message; empty for none (env GMAIL_REPORT_FILE)")
+	lockMode := fs.String("lock", envOr("GMAIL_LOCK_MODE", lockFail), "when another run for the same account and config is in progress: fail, skip, wait or none (env GMAIL_LOCK_MODE)")
+	lockPath := fs.String("lock-file", os.Getenv("GMAIL_LOCK_FILE"), "lock file preventing overlapping runs (default: per account and config in the user's cache directory, env GMAIL_LOCK_FILE)")
+	lockTimeout := fs.Duration("lock-timeout", 0, "with -lock wait, how long to wait for the other run before failing; 0 waits indefinitely")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if *workers < 1 {
+		return usageError(fmt.Errorf("-workers must be at least 1, got %d", *workers))
+	}
+	switch *lockMode {
+	case lockFail, lockSkip, lockWait, lockNone:
+	default:
+		return usageError(fmt.Errorf("-lock must be fail, skip, wait or none, got %q", *lockMode))
+	}
+	stopTracing, err := o.startTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
+	config, err := o.loadConfig()
+	if err != nil {
+		return err
+	}
+	// Fail before touching any mail rather than halfway through the run.
+	if problems := download.CheckSaveDirs(config, download.LocalStorage{}); len(problems) > 0 {
+		return configError(fmt.Errorf("invalid config:\n%v", download.ConfigErrors(problems)))
+	}
+	scope := requiredScope(config)
+	slog.Info("required scope", "scope", scope)
+
+	if *lockMode != lockNone {
+		path := *lockPath
+		if path == "" {
+			path = defaultLockPath(o.user, o.configPath)
+		}
+		lock, err := o.lock(ctx, path, *lockMode, *lockTimeout)
+		if errors.Is(err, errLocked) && *lockMode == lockSkip {
+			slog.Info("skipping this run", download.AttrError, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := lock.Release(); err != nil {
+				slog.Warn("unable to release lock", download.AttrError, err)
+			}
+		}()
+	}
+
+	if *restart && *checkpointPath != "" {
+		if err := os.Remove(*checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	notifier := download.NewNotifier(config.Notifications, o.user)
+	p, err := o.processor(ctx, scope, config, download.Options{Workers: *workers, Checkpoint: *checkpointPath, FileHook: notifier})
+	if err != nil {
+		return err
+	}
+	result, err := p.Run(ctx)
+	// An interrupted run is worth notifying of all the same.
+	nctx := context.WithoutCancel(ctx)
+	if err != nil {
+		notifier.NotifyError(nctx, err)
+		var problems download.ConfigErrors
+		if errors.As(err, &problems) {
+			return configError(fmt.Errorf("invalid config:\n%v", err))
+		}
+		return err
+	}
+
+	if result.Retries > 0 {
+		slog.Info("retried Gmail calls after transient errors", "retries", result.Retries)
+	}
+	logQuotaUsage(p)
+	logSummary(result)
+	notifier.NotifyRun(nctx, result)
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, result); err != nil {
+			return fmt.Errorf("unable to write the run report: %v", err)
+		}
+	}
+	permanent, transient := result.Failures()
+	if result.Interrupted {
+		msg := "interrupted"
+		if *checkpointPath != "" {
+			msg += fmt.Sprintf("; progress is saved in %s, run again to resume", *checkpointPath)
+		}
+		if permanent+transient > 0 {
+			msg += fmt.Sprintf(" (%d failure(s) so far, see the log for details)", permanent+transient)
+		}
+		return interruptedError(errors.New(msg))
+	}
+	if permanent+transient > 0 {
+		return partialError(fmt.Errorf("%d failure(s) while processing messages (%d permanent, %d transient that persisted after retries), see the log for details",
+			permanent+transient, permanent, transient))
+	}
+	return nil
+}
+
+// lock takes the run lock at path, waiting up to timeout for it in wait
+// mode.
+func (o *options) lock(ctx context.Context, path, mode string, timeout time.Duration) (*runLock, error) {
+	if mode == lockWait && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	lock, err := acquireLock(ctx, path, o.user, o.configPath, mode == lockWait)
+	switch {
+	case errors.Is(err, errLocked):
+		return nil, lockedError(err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, lockedError(fmt.Errorf("%w: gave up waiting for lock %s after %v", errLocked, path, timeout))
+	case errors.Is(err, context.Canceled):
+		return nil, interruptedError(errors.New("interrupted while waiting for the lock"))
+	case err != nil:
+		return nil, fmt.Errorf("unable to take lock %s: %w", path, err)
+	}
+	return lock, nil
+}
+
+func cmdPlan(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("plan", "[flags]", "List the messages each action matches and what run would do with them.\nNothing is downloaded or changed; only read access is needed.")
+	o.addConfigFlags(fs)
+	o.addAuthFlags(fs)
+	o.addMailFlags(fs)
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	stopTracing, err := o.startTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
+	config, err := o.loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := o.processor(ctx, gmail.GmailReadonlyScope, config, download.Options{})
+	if err != nil {
+		return err
+	}
+	if err := p.Plan(ctx, os.Stdout); err != nil {
+		return err
+	}
+	logQuotaUsage(p)
+	return nil
+}
+
+// logSummary logs the summary of the outcome of a run.
+func logSummary(result *download.Result) {
+	for _, line := range result.Summary() {
+		slog.Info(line)
+	}
+}
+
+// writeReport writes the outcome of a run to path as JSON, replacing the
+// report of the previous run.
+func writeReport(path string, result *download.Result) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// logQuotaUsage logs how much Gmail quota the processor spent.
+func logQuotaUsage(p *download.Processor) {
+	for _, line := range p.QuotaReport() {
+		slog.Info(line)
+	}
+}
+
+func cmdAuth(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("auth", "login|downscope|revoke|migrate [flags]", `Manage the OAuth token.
+
+  login      authorise, adding the scope to the existing grant
+  downscope  revoke the current grant and re-authorise with a narrower scope
+  revoke     revoke the grant at Google and delete the stored token
+  migrate    copy a plaintext token.json into the encrypted token store
+
+The scope defaults to the one the action config requires, or readonly when no
+config is given.`)
+	o.addAuthFlags(fs)
+	fs.StringVar(&o.configPath, "config", os.Getenv("GMAIL_ACTION_CONFIG"), "path to the action config used to derive the scope (env GMAIL_ACTION_CONFIG)")
+	scopeName := fs.String("scope", "", "scope to request: readonly, modify or full")
+	from := fs.String("from", defaultTokenFile, "migrate: plaintext token file to migrate")
+	remove := fs.Bool("remove", false, "migrate: delete the plaintext token file after a successful migration")
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if err := o.parse(fs, args); err != nil {
+			return err
+		}
+		fs.Usage()
+		return usageError(errors.New("auth needs a subcommand"))
+	}
+	sub := args[0]
+	if err := o.parse(fs, args[1:]); err != nil {
+		return err
+	}
+
+	store, err := o.tokenStore()
+	if err != nil {
+		return err
+	}
+
+	scope := gmail.GmailReadonlyScope
+	if *scopeName != "" {
+		if scope, err = parseScopeName(*scopeName); err != nil {
+			return usageError(err)
+		}
+	} else if o.configPath != "" {
+		config, err := o.loadConfig()
+		if err != nil {
+			return err
+		}
+		scope = requiredScope(config)
+	}
+
+	switch sub {
+	case "login":
+		config, err := o.oauthConfig(scope)
+		if err != nil {
+			return err
+		}
+		tok, err := authorize(config, store,
+			oauth2.SetAuthURLParam("include_granted_scopes", "true"),
+			oauth2.ApprovalForce)
+		if err != nil {
+			return authError(err)
+		}
+		slog.Info("authorised", "scopes", tok.Scopes)
+
+	case "downscope":
+		config, err := o.oauthConfig(scope)
+		if err != nil {
+			return err
+		}
+		// Google keeps previously granted scopes on incremental consent, so
+		// the old grant has to be revoked before asking for less.
+		if tok, err := store.Load(); err == nil {
+			if err := revokeToken(ctx, http.DefaultClient, tok.Token); err != nil {
+				return authError(fmt.Errorf("unable to revoke current token: %v", err))
+			}
+			slog.Info("revoked token", "scopes", tok.Scopes)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return authError(fmt.Errorf("unable to read token from %s: %v", store.Location(), err))
+		}
+		tok, err := authorize(config, store, oauth2.ApprovalForce)
+		if err != nil {
+			return authError(err)
+		}
+		slog.Info("authorised", "scopes", tok.Scopes)
+
+	case "revoke":
+		tok, err := store.Load()
+		if err != nil {
+			return authError(fmt.Errorf("unable to read token from %s: %v", store.Location(), err))
+		}
+		if err := revokeToken(ctx, http.DefaultClient, tok.Token); err != nil {
+			return authError(fmt.Errorf("unable to revoke token: %v", err))
+		}
+		if err := store.Delete(); err != nil {
+			return fmt.Errorf("token revoked but could not be deleted from %s: %v", store.Location(), err)
+		}
+		slog.Info("revoked token and removed it", download.AttrPath, store.Location())
+
+	case "migrate":
+		if _, ok := store.(*encryptedTokenStore); !ok {
+			return usageError(errors.New("destination token store is not encrypted; set GMAIL_TOKEN_PASSPHRASE or GMAIL_TOKEN_PASSPHRASE_FILE"))
+		}
+		if err := migrateToken(newFileTokenStore(*from), store, *remove); err != nil {
+			return authError(fmt.Errorf("token migration failed: %v", err))
+		}
+		slog.Info("migrated token", "from", *from, "to", store.Location())
+
+	default:
+		return usageError(fmt.Errorf("unknown auth command %q (want login, downscope, revoke or migrate)", sub))
+	}
+	return nil
+}
+
+func cmdSecrets(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("secrets", "set|delete|list [NAME] [flags]", `Manage the encrypted secrets file that secret:NAME references in the config
+are resolved from.
+
+  set NAME     store the value read from standard input under NAME
+  delete NAME  remove NAME
+  list         list the names of the stored secrets, never their values
+
+The file is encrypted with GMAIL_SECRETS_PASSPHRASE (or the file named by
+GMAIL_SECRETS_PASSPHRASE_FILE), falling back to the token passphrase.`)
+	path := fs.String("file", os.Getenv("GMAIL_SECRETS_FILE"), "path of the secrets file (env GMAIL_SECRETS_FILE, default "+download.DefaultSecretsFile+")")
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if err := o.parse(fs, args); err != nil {
+			return err
+		}
+		fs.Usage()
+		return usageError(errors.New("secrets needs a subcommand"))
+	}
+	sub, args := args[0], args[1:]
+	name := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if name == "" && fs.NArg() > 0 {
+		name = fs.Arg(0)
+	}
+	if (sub == "set" || sub == "delete") && name == "" {
+		return usageError(fmt.Errorf("secrets %s needs a NAME", sub))
+	}
+
+	f, err := download.OpenSecretsFile(*path)
+	if err != nil {
+		return usageError(err)
+	}
+	secrets, err := f.Load()
+	if err != nil {
+		return fmt.Errorf("unable to read secrets: %v", err)
+	}
+
+	switch sub {
+	case "set":
+		value, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("unable to read the secret from standard input: %v", err)
+		}
+		secrets[name] = strings.TrimRight(string(value), "\r\n")
+		if secrets[name] == "" {
+			return usageError(errors.New("empty secret on standard input"))
+		}
+		if err := f.Save(secrets); err != nil {
+			return fmt.Errorf("unable to save secrets: %v", err)
+		}
+		slog.Info("stored secret", "name", name, download.AttrPath, f.Path())
+
+	case "delete":
+		if _, ok := secrets[name]; !ok {
+			return fmt.Errorf("no secret %q in %s", name, f.Path())
+		}
+		delete(secrets, name)
+		if err := f.Save(secrets); err != nil {
+			return fmt.Errorf("unable to save secrets: %v", err)
+		}
+		slog.Info("deleted secret", "name", name, download.AttrPath, f.Path())
+
+	case "list":
+		for _, name := range secretNames(secrets) {
+			fmt.Println(name)
+		}
+
+	default:
+		return usageError(fmt.Errorf("unknown secrets command %q (want set, delete or list)", sub))
+	}
+	return nil
+}
+
+// secretNames returns the names in secrets, sorted.
+func secretNames(secrets map[string]string) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func cmdLabels(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("labels", "[flags]", "List the labels of the account, for use in the label field of the config.")
+	o.addAuthFlags(fs)
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+
+	svc, err := o.gmailService(ctx, gmail.GmailReadonlyScope)
+	if err != nil {
+		return err
+	}
+	resp, err := svc.Users.Labels.List(o.user).Do()
+	if err != nil {
+		return fmt.Errorf("unable to list labels: %v", err)
+	}
+	sort.Slice(resp.Labels, func(i, j int) bool { return resp.Labels[i].Name < resp.Labels[j].Name })
+	for _, label := range resp.Labels {
+		fmt.Printf("%-40s %-8s %s\n", label.Name, strings.ToLower(label.Type), label.Id)
+	}
+	return nil
+}
+
+func cmdSearch(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("search", "[flags] <query>", "List messages matching a Gmail search query, e.g. 'label:bank has:attachment'.")
+	o.addAuthFlags(fs)
+	max := fs.Int64("max", 50, "maximum number of messages to list")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return usageError(errors.New("search needs a query"))
+	}
+	query := strings.Join(fs.Args(), " ")
+
+	svc, err := o.gmailService(ctx, gmail.GmailReadonlyScope)
+	if err != nil {
+		return err
+	}
+	resp, err := svc.Users.Messages.List(o.user).Q(query).MaxResults(*max).Do()
+	if err != nil {
+		return fmt.Errorf("unable to search messages: %v", err)
+	}
+	for _, msg := range resp.Messages {
+		m, err := svc.Users.Messages.Get(o.user, msg.Id).Format("metadata").MetadataHeaders("Date", "From", "Subject").Do()
+		if err != nil {
+			return fmt.Errorf("unable to retrieve message %s: %v", msg.Id, err)
+		}
+		fmt.Printf("%s  %s  %-30.30s  %s\n", msg.Id, download.EmailDate(m), download.HeaderValue(m, "From"), download.HeaderValue(m, "Subject"))
+	}
+	if resp.NextPageToken != "" {
+		fmt.Printf("(more than %d results, use -max to list more)\n", *max)
+	}
+	return nil
+}
+
+func cmdValidateConfig(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("validate-config", "[flags]", `Load the action config and report every problem found, without contacting Gmail:
+unknown keys, values of the wrong type, missing or contradictory settings,
+invalid regular expressions and save_to directories that do not exist.`)
+	o.addConfigFlags(fs)
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if o.configPath == "" {
+		return usageError(errors.New("no action config: set -config or GMAIL_ACTION_CONFIG"))
+	}
+
+	var problems download.ConfigErrors
+	config, err := download.LoadConfig(o.configPath)
+	if err != nil && !errors.As(err, &problems) {
+		return configError(fmt.Errorf("unable to load config file: %v", err))
+	}
+	if config != nil {
+		problems = append(problems, download.CheckSaveDirs(config, download.LocalStorage{})...)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		return configError(fmt.Errorf("%s: %d problem(s) found", o.configPath, len(problems)))
+	}
+
+	if config, err = selectActions(config, o.labels, o.actions); err != nil {
+		return configError(err)
+	}
+	actions := 0
+	for _, labelAction := range config.LabelActions {
+		actions += len(labelAction.Actions)
+	}
+	fmt.Printf("%s: OK, %d label(s), %d action(s), requires scope %s\n",
+		o.configPath, len(config.LabelActions), actions, requiredScope(config))
+	return nil
+}
+
+func cmdStatus(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("status", "[flags]", "Show the config, credentials and token status without contacting Gmail.")
+	o.addConfigFlags(fs)
+	o.addAuthFlags(fs)
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+
+	fmt.Printf("User:          %s\n", valueOr(o.user, "(not set)"))
+	fmt.Printf("Credentials:   %s\n", valueOr(o.credentials, "(not set)"))
+
+	required := ""
+	if o.configPath == "" {
+		fmt.Printf("Config:        (not set)\n")
+	} else if config, err := o.loadConfig(); err != nil {
+		fmt.Printf("Config:        %s (invalid: %v)\n", o.configPath, err)
+	} else {
+		required = requiredScope(config)
+		fmt.Printf("Config:        %s (%d label(s), requires %s)\n", o.configPath, len(config.LabelActions), required)
+	}
+
+	store, err := o.tokenStore()
+	if err != nil {
+		return err
+	}
+	tok, err := store.Load()
+	if err != nil {
+		fmt.Printf("Token:         %s (unavailable: %v)\n", store.Location(), err)
+		return authError(errors.New("no usable token, run 'auth login'"))
+	}
+	fmt.Printf("Token:         %s\n", store.Location())
+	fmt.Printf("Refresh token: %v\n", tok.RefreshToken != "")
+	fmt.Printf("Scopes:        %s\n", valueOr(strings.Join(tok.Scopes, " "), "(not recorded)"))
+	if !tok.Expiry.IsZero() {
+		fmt.Printf("Access expiry: %s\n", tok.Expiry.Format("2006-01-02 15:04:05 MST"))
+	}
+	if required != "" && len(tok.Scopes) > 0 && !scopeSatisfies(tok.Scopes, required) {
+		return authError(fmt.Errorf("token does not grant %s required by the config, run 'auth login'", required))
+	}
+	return nil
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envInt returns the integer in the environment variable name, or fallback
+// when it is unset. A value that is not a number is reported by parse.
+func (o *options) envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		o.envErrs = append(o.envErrs, fmt.Errorf("%s must be a whole number, got %q", name, v))
+		return fallback
+	}
+	return n
+}
+
+// envDuration returns the duration in the environment variable name, or
+// fallback when it is unset. A value that is not a duration is reported by
+// parse.
+func (o *options) envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		o.envErrs = append(o.envErrs, fmt.Errorf("%s must be a duration such as 90s or 1h, got %q", name, v))
+		return fallback
+	}
+	return d
+}
+
+func valueOr(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// newLogger returns the logger the logging flags ask for, writing to w.
+// Every record carries the account, when the command has one, so that the
+// logs of several accounts can share a file or a collector.
+func (o *options) newLogger(w io.Writer) (*slog.Logger, error) {
+	level, err := parseLogLevel(o.logLevel)
+	if err != nil {
+		return nil, err
+	}
+	if o.quiet {
+		level = slog.LevelError
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(o.logFormat) {
+	case "text", "":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want text or json)", o.logFormat)
+	}
+	logger := slog.New(h)
+	if o.user != "" {
+		logger = logger.With(download.AttrAccount, o.user)
+	}
+	return logger, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+)
+
+// captureLog sends the records of the default logger, at every level, to a
+// buffer in the text format for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func testConfig() *download.Config {
+	return &download.Config{LabelActions: []download.LabelAction{
+		{Label: "INBOX", Actions: []download.Action{{SubjectFilter: "a"}, {SubjectFilter: "b"}}},
+		{Label: "Bank", Actions: []download.Action{{SubjectFilter: "c"}}},
+	}, Notifications: []download.Notification{{Type: download.NotifyWebhook}}}
+}
+
+func TestSelectActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  []string
+		actions []string
+		want    []string // label/subject pairs
+		wantErr bool
+	}{
+		{name: "no selection", want: []string{"INBOX/a", "INBOX/b", "Bank/c"}},
+		{name: "one label", labels: []string{"Bank"}, want: []string{"Bank/c"}},
+		{name: "action index", actions: []string{"1"}, want: []string{"INBOX/b"}},
+		{name: "label and action", labels: []string{"INBOX", "Bank"}, actions: []string{"0"}, want: []string{"INBOX/a", "Bank/c"}},
+		{name: "unknown label", labels: []string{"Spam"}, wantErr: true},
+		{name: "action out of range", actions: []string{"5"}, wantErr: true},
+		{name: "invalid action", actions: []string{"x"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectActions(testConfig(), tt.labels, tt.actions)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("selectActions() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectActions() error = %v", err)
+			}
+			if len(got.Notifications) != 1 {
+				t.Errorf("selectActions() notifications = %v, want those of the config", got.Notifications)
+			}
+			var pairs []string
+			for _, labelAction := range got.LabelActions {
+				for _, action := range labelAction.Actions {
+					pairs = append(pairs, labelAction.Label+"/"+action.SubjectFilter)
+				}
+			}
+			if len(pairs) != len(tt.want) {
+				t.Fatalf("selectActions() = %v, want %v", pairs, tt.want)
+			}
+			for i := range pairs {
+				if pairs[i] != tt.want[i] {
+					t.Errorf("selectActions() = %v, want %v", pairs, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	var l listFlag
+	l.Set("INBOX, Bank")
+	l.Set("Receipts")
+	if got := l.String(); got != "INBOX,Bank,Receipts" {
+		t.Errorf("listFlag = %q, want %q", got, "INBOX,Bank,Receipts")
+	}
+}
+
+func TestOptions_EnvNumbers(t *testing.T) {
+	t.Setenv("GMAIL_WORKERS", "8")
+	t.Setenv("GMAIL_BATCH_SIZE", "lots")
+	t.Setenv("GMAIL_DAEMON_INTERVAL", "90s")
+	var o options
+	if got := o.envInt("GMAIL_WORKERS", 4); got != 8 {
+		t.Errorf("envInt(GMAIL_WORKERS) = %d, want 8", got)
+	}
+	if got := o.envInt("GMAIL_RATE_LIMIT", 250); got != 250 {
+		t.Errorf("envInt(unset) = %d, want the fallback 250", got)
+	}
+	if got := o.envDuration("GMAIL_DAEMON_INTERVAL", time.Hour); got != 90*time.Second {
+		t.Errorf("envDuration(GMAIL_DAEMON_INTERVAL) = %v, want 90s", got)
+	}
+	if len(o.envErrs) != 0 {
+		t.Errorf("envErrs = %v, want none", o.envErrs)
+	}
+	o.envInt("GMAIL_BATCH_SIZE", 50)
+	if len(o.envErrs) != 1 || !strings.Contains(o.envErrs[0].Error(), "GMAIL_BATCH_SIZE") {
+		t.Errorf("envErrs = %v, want GMAIL_BATCH_SIZE named", o.envErrs)
+	}
+
+	if got := runCLI([]string{"plan"}); got != exitUsage {
+		t.Errorf("plan with GMAIL_BATCH_SIZE=lots = %d, want %d", got, exitUsage)
+	}
+	t.Setenv("GMAIL_BATCH_SIZE", "")
+	t.Setenv("GMAIL_DAEMON_INTERVAL", "hourly")
+	if got := runCLI([]string{"daemon"}); got != exitUsage {
+		t.Errorf("daemon with GMAIL_DAEMON_INTERVAL=hourly = %d, want %d", got, exitUsage)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, exitOK},
+		{"plain error", errors.New("boom"), exitFailure},
+		{"config error", configError(errors.New("bad")), exitConfig},
+		{"auth error", authError(errors.New("denied")), exitAuth},
+		{"partial failure", partialError(errors.New("some failed")), exitPartial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptions_NewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	o := options{logLevel: "warn", logFormat: "json", user: "me@example.com"}
+	logger, err := o.newLogger(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("processing label", download.AttrLabel, "INBOX")
+	logger.Error("delete failed", download.AttrMessage, "m01")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log = %q, want the error record alone as JSON: %v", buf.String(), err)
+	}
+	if record["level"] != "ERROR" || record["msg"] != "delete failed" || record[download.AttrAccount] != "me@example.com" || record[download.AttrMessage] != "m01" {
+		t.Errorf("record = %v, want the error with the account and message", record)
+	}
+
+	buf.Reset()
+	o = options{logLevel: "debug", quiet: true}
+	if logger, err = o.newLogger(&buf); err != nil {
+		t.Fatal(err)
+	}
+	logger.Warn("retrying")
+	logger.Error("giving up")
+	if got := buf.String(); strings.Contains(got, "retrying") || !strings.Contains(got, "level=ERROR msg=\"giving up\"") || strings.Contains(got, download.AttrAccount) {
+		t.Errorf("quiet log = %q, want the error alone in text, without an account", got)
+	}
+
+	for _, o := range []options{{logLevel: "verbose"}, {logFormat: "xml"}} {
+		if _, err := o.newLogger(&buf); err == nil {
+			t.Errorf("newLogger(%+v) error = nil, want error", o)
+		}
+	}
+}
+
+func TestRunCLI_ValidateConfig(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	tmpDir := t.TempDir()
+	good := filepath.Join(tmpDir, "good.json")
+	if err := os.WriteFile(good, []byte(`{"label_actions": [{"label": "INBOX", "actions": [{"mark_as_read": true}]}]}`), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	bad := filepath.Join(tmpDir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"label_actions": `), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	if got := runCLI([]string{"validate-config", "-config", good}); got != exitOK {
+		t.Errorf("validate-config of valid config = %d, want %d", got, exitOK)
+	}
+	if got := runCLI([]string{"validate-config", "-config", bad}); got != exitConfig {
+		t.Errorf("validate-config of invalid config = %d, want %d", got, exitConfig)
+	}
+	if got := runCLI([]string{"validate-config", "-config", good, "-label", "Spam"}); got != exitConfig {
+		t.Errorf("validate-config with unknown label = %d, want %d", got, exitConfig)
+	}
+	if got := runCLI([]string{"no-such-command"}); got != exitUsage {
+		t.Errorf("unknown command = %d, want %d", got, exitUsage)
+	}
+	if got := runCLI([]string{"run", "-no-such-flag"}); got != exitUsage {
+		t.Errorf("unknown flag = %d, want %d", got, exitUsage)
+	}
+}
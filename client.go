@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -12,26 +12,79 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/bhargavakumark/gmail-download/download"
 	"golang.org/x/oauth2"
 )
 
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
+// When the stored token was granted a narrower scope than config asks for,
+// the consent flow is run again to add the missing scope.
+func getClient(config *oauth2.Config, store TokenStore) (*http.Client, error) {
+	ctx := context.Background()
+	required := config.Scopes[0]
+
+	// The token store holds the user's access and refresh tokens, and is
+	// populated automatically when the authorization flow completes for the
+	// first time.
+	tok, err := store.Load()
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unable to read token from %s: %v", store.Location(), err)
+		}
+		if tok, err = authorize(config, store); err != nil {
+			return nil, err
+		}
+		return config.Client(ctx, tok.Token), nil
+	}
+
+	if len(tok.Scopes) == 0 {
+		// Tokens saved by older versions do not record their scopes.
+		fresh, err := config.TokenSource(ctx, tok.Token).Token()
+		if err == nil {
+			tok.Scopes, err = lookupScopes(ctx, http.DefaultClient, fresh.AccessToken)
+		}
+		if err != nil {
+			slog.Warn("unable to determine the scopes of the stored token, assuming they are sufficient", download.AttrError, err)
+			return config.Client(ctx, tok.Token), nil
+		}
+		tok.Token = fresh
+		if err := store.Save(tok); err != nil {
+			slog.Warn("unable to record the token scopes", download.AttrError, err)
+		}
 	}
-	return config.Client(context.Background(), tok)
+
+	if !scopeSatisfies(tok.Scopes, required) {
+		slog.Info("the stored token lacks the scope the config needs, requesting additional consent", "scopes", tok.Scopes, "required", required)
+		tok, err = authorize(config, store,
+			oauth2.SetAuthURLParam("include_granted_scopes", "true"),
+			oauth2.ApprovalForce)
+		if err != nil {
+			return nil, err
+		}
+	} else if broadest := broadestScope(tok.Scopes); scopeRank[broadest] > scopeRank[required] {
+		slog.Warn("the stored token grants a broader scope than the config needs, run 'auth downscope' to narrow it", "scope", broadest, "required", required)
+	}
+	return config.Client(ctx, tok.Token), nil
+}
+
+// authorize runs the consent flow for config.Scopes and saves the resulting
+// token together with the scopes Google granted.
+func authorize(config *oauth2.Config, store TokenStore, opts ...oauth2.AuthCodeOption) (*StoredToken, error) {
+	tok, err := getTokenFromWeb(config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	stored := &StoredToken{Token: tok, Scopes: grantedScopes(tok, config.Scopes)}
+	fmt.Printf("Saving credential file to: %s\n", store.Location())
+	if err := store.Save(stored); err != nil {
+		return nil, fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	return stored, nil
 }
 
 // Request a token from the web, then returns the retrieved token.
 // Starts a local server to automatically capture the OAuth redirect.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+func getTokenFromWeb(config *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	// Set redirect URI to localhost
 	redirectURL := "http://localhost:9901/callback"
 	config.RedirectURL = redirectURL
@@ -43,7 +96,7 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 	// Start local server to handle OAuth callback
 	listener, err := net.Listen("tcp", ":9901")
 	if err != nil {
-		log.Fatalf("Unable to start local server: %v", err)
+		return nil, fmt.Errorf("unable to start local server: %v", err)
 	}
 
 	mux := http.NewServeMux()
@@ -84,7 +137,7 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 	}()
 
 	// Generate authorization URL
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	authURL := config.AuthCodeURL("state-token", append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, opts...)...)
 	fmt.Printf("Opening browser for authorization...\n")
 	fmt.Printf("If browser doesn't open automatically, go to: %v\n", authURL)
 
@@ -101,18 +154,18 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 		server.Shutdown(ctx)
 	case err := <-errorChan:
 		server.Shutdown(context.Background())
-		log.Fatalf("Authorization error: %v", err)
+		return nil, fmt.Errorf("authorization error: %v", err)
 	case <-time.After(5 * time.Minute):
 		server.Shutdown(context.Background())
-		log.Fatalf("Authorization timeout: no response received within 5 minutes")
+		return nil, fmt.Errorf("authorization timeout: no response received within 5 minutes")
 	}
 
 	// Exchange authorization code for token
 	tok, err := config.Exchange(context.TODO(), authCode)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
 	}
-	return tok
+	return tok, nil
 }
 
 // openBrowser opens the URL in Firefox (cross-platform)
@@ -139,30 +192,6 @@ func openBrowser(url string) {
 	}
 	if err != nil {
 		// Non-fatal: user can manually open the URL
-		log.Printf("Could not automatically open Firefox: %v", err)
-		log.Printf("Please manually open: %v", url)
-	}
-}
-
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
-}
-
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		slog.Warn("could not open Firefox, please open the URL manually", "url", url, download.AttrError, err)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
 }
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+)
+
+// Defaults of the daemon command.
+const (
+	// defaultDaemonInterval is how often the actions of a label without a
+	// schedule of its own run.
+	defaultDaemonInterval = time.Hour
+	// defaultStatusAddr is where the status endpoint listens. It is bound to
+	// the loopback interface, as the status is not meant for the network.
+	defaultStatusAddr = "127.0.0.1:8484"
+	// defaultWatchInterval is how often the config files are checked for
+	// changes.
+	defaultWatchInterval = 5 * time.Second
+	// defaultPushAddr is where the Pub/Sub push endpoint listens. Pub/Sub
+	// reaches it through a reverse proxy or tunnel terminating HTTPS.
+	defaultPushAddr = "127.0.0.1:8485"
+	// pushPath is the path of the Pub/Sub push endpoint.
+	pushPath = "/gmail/push"
+)
+
+// daemon runs the label actions of a config on their schedules with one
+// processor, authorised for Gmail once, for its whole life. The config is
+// reloaded when asked to: a config that fails to load, or needs a broader
+// scope than the processor has, is reported and the current one kept.
+// Labels run one at a time, so runs never overlap.
+type daemon struct {
+	proc     *download.Processor
+	load     func() (*download.Config, []string, error)
+	scope    string        // the scope proc was authorised with
+	interval time.Duration // schedule of labels without one
+	// reportPath is where the JSON report of every run is written; "" for
+	// none.
+	reportPath string
+	// metrics, if set, counts what the runs do and is served on /metrics.
+	metrics *runMetrics
+	// notifier, if set, notifies of the runs, and of the files saved as the
+	// FileHook of proc, with the notifications of the current config.
+	notifier *download.Notifier
+
+	// lockPath is the run lock taken for every run, so that a run started
+	// by hand does not overlap with the daemon; "" for no lock.
+	lockPath         string
+	lockWait         bool
+	user, configPath string
+
+	// gmailWatch, if set, has the labels run as soon as Gmail notifies
+	// that they got new messages, besides their schedules.
+	gmailWatch *mailboxWatch
+
+	reload chan struct{}
+
+	mu        sync.Mutex
+	started   time.Time
+	loaded    time.Time // when the current config was loaded
+	reloadErr string    // why the last reload failed
+	files     map[string]fileStamp
+	jobs      []*job
+	running   *job
+}
+
+// job is a label action of the config on its schedule.
+type job struct {
+	index       int
+	labelAction download.LabelAction
+	schedule    download.Schedule
+	next        time.Time
+	runs        int
+	last        *jobRun
+}
+
+// What started a run of a job.
+const (
+	triggerSchedule = "schedule"
+	triggerPush     = "push"
+)
+
+// jobRun is the outcome of the last run of a job.
+type jobRun struct {
+	Trigger  string    `json:"trigger"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Messages int       `json:"messages"`
+	Files    int       `json:"files"`
+	Failures int       `json:"failures"`
+	// Skipped says why the run did not happen.
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// fileStamp identifies the content of a config file cheaply enough to be
+// checked every few seconds.
+type fileStamp struct {
+	modTime int64
+	size    int64
+	exists  bool
+}
+
+func stampFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime().UnixNano(), size: fi.Size(), exists: true}
+}
+
+// newDaemon returns a daemon running the config load returns, which it
+// calls again to reload it.
+func newDaemon(proc *download.Processor, load func() (*download.Config, []string, error)) *daemon {
+	return &daemon{
+		proc:     proc,
+		load:     load,
+		interval: defaultDaemonInterval,
+		reload:   make(chan struct{}, 1),
+		started:  time.Now(),
+		files:    make(map[string]fileStamp),
+	}
+}
+
+// setConfig replaces the jobs with those of config, read from files. Jobs
+// whose label and schedule are unchanged keep their next run and history;
+// the others are scheduled afresh. d.mu must be held.
+func (d *daemon) setConfig(config *download.Config, files []string, now time.Time) {
+	old := make(map[string]*job, len(d.jobs))
+	for _, j := range d.jobs {
+		old[j.key()] = j
+	}
+	d.jobs = nil
+	for i, labelAction := range config.LabelActions {
+		j := &job{index: i, labelAction: labelAction, schedule: download.Schedule{Every: download.Duration(d.interval)}}
+		if labelAction.Schedule != nil {
+			j.schedule = *labelAction.Schedule
+		}
+		if prev, ok := old[j.key()]; ok {
+			j.next, j.runs, j.last = prev.next, prev.runs, prev.last
+			delete(old, j.key()) // a repeated label is a new job
+		} else {
+			j.next = j.schedule.First(now)
+		}
+		d.jobs = append(d.jobs, j)
+	}
+	if d.notifier != nil {
+		d.notifier.SetNotifications(config.Notifications)
+	}
+	d.loaded = now
+	d.watchFiles(files)
+}
+
+func (j *job) key() string {
+	return j.labelAction.Label + "\x00" + j.schedule.String()
+}
+
+// watchFiles adds files to those checked for changes. d.mu must be held.
+func (d *daemon) watchFiles(files []string) {
+	for _, file := range files {
+		if _, ok := d.files[file]; !ok {
+			d.files[file] = stampFile(file)
+		}
+	}
+}
+
+// requestReload asks the daemon to reload its config once the run in
+// progress, if any, is over.
+func (d *daemon) requestReload() {
+	select {
+	case d.reload <- struct{}{}:
+	default: // a reload is pending already
+	}
+}
+
+// reloadConfig loads the config again and schedules its jobs.
+func (d *daemon) reloadConfig() {
+	config, files, err := d.load()
+	if err == nil {
+		if problems := download.CheckSaveDirs(config, download.LocalStorage{}); len(problems) > 0 {
+			err = fmt.Errorf("invalid config:\n%v", download.ConfigErrors(problems))
+		}
+	}
+	if err == nil {
+		if scope := requiredScope(config); !scopeSatisfies([]string{d.scope}, scope) {
+			err = fmt.Errorf("the config needs scope %s but the daemon was authorised for %s; restart it to authorise the new scope", scope, d.scope)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		// Watch the files of the broken config too, so that fixing an
+		// included file is noticed.
+		d.watchFiles(files)
+		d.reloadErr = err.Error()
+		slog.Error("keeping the current config, reloading failed", download.AttrError, err)
+		return
+	}
+	d.reloadErr = ""
+	d.files = make(map[string]fileStamp)
+	if d.configPath != "" {
+		d.watchFiles([]string{d.configPath})
+	}
+	d.setConfig(config, files, time.Now())
+	slog.Info("reloaded the config", "labels", len(d.jobs))
+	if w := d.gmailWatch; w != nil {
+		// Watch the labels of the new config.
+		w.mu.Lock()
+		w.renewAt = time.Now()
+		w.mu.Unlock()
+	}
+}
+
+// watch checks the config files every interval and asks for a reload when
+// one of them changed, until ctx is done.
+func (d *daemon) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var changed []string
+		d.mu.Lock()
+		for file, stamp := range d.files {
+			if now := stampFile(file); now != stamp {
+				d.files[file] = now
+				changed = append(changed, file)
+			}
+		}
+		d.mu.Unlock()
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			slog.Info("config file changed, reloading", download.AttrPath, changed[0])
+			d.requestReload()
+		}
+	}
+}
+
+// jobList returns the jobs of the current config.
+func (d *daemon) jobList() []*job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*job(nil), d.jobs...)
+}
+
+// nextJob returns the job to run next, or nil if there is none.
+func (d *daemon) nextJob() *job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var next *job
+	for _, j := range d.jobs {
+		if next == nil || j.next.Before(next.next) {
+			next = j
+		}
+	}
+	return next
+}
+
+// loop runs the jobs as they become due, reloads the config when asked and,
+// with a Gmail watch, processes the new messages Gmail notifies of and
+// renews the watch, until ctx is done.
+func (d *daemon) loop(ctx context.Context) {
+	for {
+		var due, renew <-chan time.Time
+		var notified <-chan struct{}
+		var timers []*time.Timer
+		after := func(t time.Time) <-chan time.Time {
+			timer := time.NewTimer(time.Until(t))
+			timers = append(timers, timer)
+			return timer.C
+		}
+		j := d.nextJob()
+		if j != nil {
+			due = after(j.next)
+		}
+		if w := d.gmailWatch; w != nil {
+			notified = w.notified
+			renew = after(w.renewTime())
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-d.reload:
+			d.reloadConfig()
+		case <-due:
+			d.runJob(ctx, j, nil, triggerSchedule)
+		case <-notified:
+			d.syncHistory(ctx)
+		case <-renew:
+			d.renewWatch(ctx)
+		}
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// runJob runs the actions of the label of j, on the messages in added only
+// if set, and returns the outcome. Runs on schedule schedule the next one.
+func (d *daemon) runJob(ctx context.Context, j *job, added *download.NewMessages, trigger string) *jobRun {
+	d.mu.Lock()
+	d.running = j
+	d.mu.Unlock()
+
+	run := &jobRun{Trigger: trigger, Started: time.Now()}
+	d.runLabel(ctx, j, added, run)
+	finished := time.Now()
+	run.Duration = finished.Sub(run.Started).Round(time.Millisecond).String()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = nil
+	j.runs++
+	j.last = run
+	if trigger == triggerSchedule {
+		j.next = j.schedule.Next(finished)
+		slog.Info("next run", download.AttrLabel, j.labelAction.Label, "at", j.next)
+	}
+	return run
+}
+
+func (d *daemon) runLabel(ctx context.Context, j *job, added *download.NewMessages, run *jobRun) {
+	label := j.labelAction.Label
+	if d.lockPath != "" {
+		lock, err := acquireLock(ctx, d.lockPath, d.user, d.configPath, d.lockWait)
+		if errors.Is(err, errLocked) {
+			slog.Info("skipping this run", download.AttrLabel, label, download.AttrError, err)
+			run.Skipped = err.Error()
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("unable to take lock", download.AttrLabel, label, download.AttrPath, d.lockPath, download.AttrError, err)
+			}
+			run.Error = err.Error()
+			return
+		}
+		defer func() {
+			if err := lock.Release(); err != nil {
+				slog.Warn("unable to release lock", download.AttrPath, d.lockPath, download.AttrError, err)
+			}
+		}()
+	}
+
+	if added != nil {
+		slog.Info("running the actions on new messages", download.AttrLabel, label)
+	} else {
+		slog.Info("running the actions", download.AttrLabel, label, "schedule", j.schedule.String())
+	}
+	result := d.proc.RunLabel(ctx, j.labelAction, added)
+	for _, l := range result.Labels {
+		run.Messages += l.Messages
+		run.Files += l.Files
+	}
+	permanent, transient := result.Failures()
+	run.Failures = permanent + transient
+	if result.Retries > 0 {
+		slog.Info("retried Gmail calls after transient errors", download.AttrLabel, label, "retries", result.Retries)
+	}
+	logSummary(result)
+	if d.metrics != nil {
+		d.metrics.observe(result)
+	}
+	if d.notifier != nil {
+		// A run cut short by the daemon stopping is notified all the same.
+		d.notifier.NotifyRun(context.WithoutCancel(ctx), result)
+	}
+	if d.reportPath != "" {
+		if err := writeReport(d.reportPath, result); err != nil {
+			slog.Error("unable to write the run report", download.AttrPath, d.reportPath, download.AttrError, err)
+		}
+	}
+	if run.Failures > 0 {
+		run.Error = fmt.Sprintf("%d failure(s) while processing messages (%d permanent, %d transient that persisted after retries)",
+			run.Failures, permanent, transient)
+		slog.Error("label run failed, see the log for details", download.AttrLabel, label, download.AttrError, run.Error)
+	}
+}
+
+// daemonStatus is what the status endpoint serves.
+type daemonStatus struct {
+	User         string        `json:"user"`
+	Config       string        `json:"config"`
+	Started      time.Time     `json:"started"`
+	ConfigLoaded time.Time     `json:"config_loaded"`
+	ReloadError  string        `json:"reload_error,omitempty"`
+	Running      string        `json:"running,omitempty"`
+	Watch        *watchStatus  `json:"watch,omitempty"`
+	Quota        quotaStatus   `json:"quota"`
+	Labels       []labelStatus `json:"labels"`
+}
+
+type quotaStatus struct {
+	Units    int `json:"units"`
+	Calls    int `json:"calls"`
+	Requests int `json:"requests"`
+	Retries  int `json:"retries"`
+}
+
+type labelStatus struct {
+	Label    string    `json:"label"`
+	Actions  int       `json:"actions"`
+	Schedule string    `json:"schedule"`
+	NextRun  time.Time `json:"next_run"`
+	Runs     int       `json:"runs"`
+	LastRun  *jobRun   `json:"last_run,omitempty"`
+}
+
+// status returns the current state of the daemon.
+func (d *daemon) status() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := daemonStatus{
+		User:         d.user,
+		Config:       d.configPath,
+		Started:      d.started,
+		ConfigLoaded: d.loaded,
+		ReloadError:  d.reloadErr,
+		Labels:       []labelStatus{},
+	}
+	if d.running != nil {
+		s.Running = d.running.labelAction.Label
+	}
+	if d.gmailWatch != nil {
+		s.Watch = d.gmailWatch.status()
+	}
+	s.Quota.Units, s.Quota.Calls, s.Quota.Requests = d.proc.QuotaUsage()
+	s.Quota.Retries = d.proc.Retries()
+	for _, j := range d.jobs {
+		s.Labels = append(s.Labels, labelStatus{
+			Label:    j.labelAction.Label,
+			Actions:  len(j.labelAction.Actions),
+			Schedule: j.schedule.String(),
+			NextRun:  j.next,
+			Runs:     j.runs,
+			LastRun:  j.last,
+		})
+	}
+	return s
+}
+
+// handler serves the status of the daemon as JSON on /status, and a
+// liveness check on /healthz.
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(d.status())
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	if d.metrics != nil {
+		mux.Handle("GET /metrics", d.metrics.handler())
+	}
+	return mux
+}
+
+// serve serves handler on ln until the returned function is called.
+func serve(ln net.Listener, handler http.Handler) (stop func()) {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}
+}
+
+func cmdDaemon(ctx context.Context, args []string) error {
+	var o options
+	fs := o.newFlagSet("daemon", "[flags]", "Run the configured actions on their schedules until stopped, reloading the config when it changes.")
+	o.addConfigFlags(fs)
+	o.addAuthFlags(fs)
+	o.addMailFlags(fs)
+	workers := fs.Int("workers", o.envInt("GMAIL_WORKERS", download.DefaultWorkers), "number of messages processed concurrently (env GMAIL_WORKERS)")
+	interval := fs.Duration("interval", o.envDuration("GMAIL_DAEMON_INTERVAL", defaultDaemonInterval), "how often to run the actions of labels without a schedule (env GMAIL_DAEMON_INTERVAL)")
+	statusAddr := fs.String("status-addr", envOr("GMAIL_STATUS_ADDR", defaultStatusAddr), "address of the status endpoint; empty to disable (env GMAIL_STATUS_ADDR)")
+	watchInterval := fs.Duration("watch", defaultWatchInterval, "how often to check the config files for changes; 0 to reload on SIGHUP only")
+	lockMode := fs.String("lock", envOr("GMAIL_LOCK_MODE", lockSkip), "when another run for the same account and config is in progress: skip, wait or none (env GMAIL_LOCK_MODE)")
+	lockPath := fs.String("lock-file", os.Getenv("GMAIL_LOCK_FILE"), "lock file preventing overlapping runs (default: per account and config in the user's cache directory, env GMAIL_LOCK_FILE)")
+	topic := fs.String("pubsub-topic", os.Getenv("GMAIL_PUBSUB_TOPIC"), "Pub/Sub topic Gmail notifies of new messages through, projects/<project>/topics/<topic>; empty to rely on schedules only (env GMAIL_PUBSUB_TOPIC)")
+	pushAddr := fs.String("push-addr", envOr("GMAIL_PUSH_ADDR", defaultPushAddr), "address of the Pub/Sub push endpoint, used with -pubsub-topic (env GMAIL_PUSH_ADDR)")
+	reportPath := fs.String("report", os.Getenv("GMAIL_REPORT_FILE"), "file to write the JSON report of each run to, replacing the previous one; empty for none (env GMAIL_REPORT_FILE)")
+	pushToken := fs.String("push-token", os.Getenv("GMAIL_PUSH_TOKEN"), "secret the push subscription must pass as the token query parameter (env GMAIL_PUSH_TOKEN)")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if *workers < 1 {
+		return usageError(fmt.Errorf("-workers must be at least 1, got %d", *workers))
+	}
+	if *interval <= 0 {
+		return usageError(fmt.Errorf("-interval must be positive, got %v", *interval))
+	}
+	switch *lockMode {
+	case lockSkip, lockWait, lockNone:
+	case lockFail:
+		// A daemon that exits when a run overlaps is of little use.
+		*lockMode = lockSkip
+	default:
+		return usageError(fmt.Errorf("-lock must be skip, wait or none, got %q", *lockMode))
+	}
+	stopTracing, err := o.startTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
+	config, files, err := o.loadConfigFiles()
+	if err != nil {
+		return err
+	}
+	if problems := download.CheckSaveDirs(config, download.LocalStorage{}); len(problems) > 0 {
+		return configError(fmt.Errorf("invalid config:\n%v", download.ConfigErrors(problems)))
+	}
+	if *topic != "" && *pushAddr == "" {
+		return usageError(errors.New("-pubsub-topic needs -push-addr to receive the notifications"))
+	}
+	scope := requiredScope(config)
+	slog.Info("required scope", "scope", scope)
+	metrics := newRunMetrics()
+	notifier := download.NewNotifier(config.Notifications, o.user)
+	proc, err := o.processor(ctx, scope, config, download.Options{Workers: *workers, CallHook: metrics, FileHook: notifier})
+	if err != nil {
+		return err
+	}
+
+	d := newDaemon(proc, o.loadConfigFiles)
+	d.scope = scope
+	d.interval = *interval
+	d.reportPath = *reportPath
+	d.metrics = metrics
+	d.notifier = notifier
+	d.user = o.user
+	d.configPath, _ = filepath.Abs(o.configPath)
+	if *lockMode != lockNone {
+		d.lockPath = valueOr(*lockPath, defaultLockPath(o.user, o.configPath))
+		d.lockWait = *lockMode == lockWait
+	}
+	d.mu.Lock()
+	d.watchFiles([]string{d.configPath})
+	d.setConfig(config, files, time.Now())
+	d.mu.Unlock()
+	slog.Info("daemon started", "labels", len(config.LabelActions))
+
+	if *topic != "" {
+		d.gmailWatch = newMailboxWatch(*topic, *pushToken)
+		if err := d.startWatch(ctx); err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", *pushAddr)
+		if err != nil {
+			return fmt.Errorf("unable to receive push notifications: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("POST "+pushPath, d.gmailWatch.handlePush(o.user))
+		stop := serve(ln, mux)
+		defer stop()
+		slog.Info("receiving Gmail push notifications", "url", "http://"+ln.Addr().String()+pushPath)
+	}
+
+	if *statusAddr != "" {
+		ln, err := net.Listen("tcp", *statusAddr)
+		if err != nil {
+			return fmt.Errorf("unable to serve the status: %v", err)
+		}
+		stop := serve(ln, d.handler())
+		defer stop()
+		slog.Info("serving the daemon status", "url", "http://"+ln.Addr().String()+"/status")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("SIGHUP received, reloading the config")
+				d.requestReload()
+			}
+		}
+	}()
+	if *watchInterval > 0 {
+		go d.watch(ctx, *watchInterval)
+	}
+
+	d.loop(ctx)
+	logQuotaUsage(d.proc)
+	slog.Info("daemon stopped")
+	return nil
+}
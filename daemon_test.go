@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+	"google.golang.org/api/gmail/v1"
+)
+
+// newTestMail returns a mailbox with n unread messages in each of labels,
+// created in that order.
+func newTestMail(n int, labels ...string) *download.FakeMail {
+	fake := download.NewFakeMail("me@example.com")
+	for _, label := range labels {
+		fake.CreateLabel(label)
+		for i := 0; i < n; i++ {
+			fake.AddMessage(download.FakeMessage{
+				Subject: fmt.Sprintf("%s %d", label, i),
+				Labels:  []string{"UNREAD", label},
+			})
+		}
+	}
+	return fake
+}
+
+// newTestDaemon returns a daemon running config against fake, and the path
+// of the file config is written to.
+func newTestDaemon(t *testing.T, fake *download.FakeMail, config string) (*daemon, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := &options{configPath: path}
+	loaded, files, err := o.loadConfigFiles()
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	proc, err := download.NewProcessor(loaded, fake, download.LocalStorage{}, download.Options{User: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon(proc, o.loadConfigFiles)
+	d.scope = gmail.GmailModifyScope
+	d.configPath = path
+	d.mu.Lock()
+	d.setConfig(loaded, files, time.Now())
+	d.mu.Unlock()
+	return d, path
+}
+
+// searchesOf returns how many list calls fake had for label.
+func searchesOf(fake *download.FakeMail, label string) int {
+	n := 0
+	for _, q := range fake.Searches() {
+		if strings.HasPrefix(q, "label:"+label+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor waits up to a few seconds for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startDaemon runs the loop of d until the test ends.
+func startDaemon(t *testing.T, d *daemon) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.loop(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func labelStatusOf(d *daemon, label string) (labelStatus, bool) {
+	for _, l := range d.status().Labels {
+		if l.Label == label {
+			return l, true
+		}
+	}
+	return labelStatus{}, false
+}
+
+func TestDaemon_Schedules(t *testing.T) {
+	fake := newTestMail(3, "Often", "Yearly")
+	captureLog(t)
+	d, _ := newTestDaemon(t, fake, `
+label_actions:
+  - label: Often
+    schedule: {every: 20ms}
+    actions: [{mark_as_read: true}]
+  - label: Yearly
+    schedule: {cron: "@yearly"}
+    actions: [{mark_as_read: true}]
+`)
+	startDaemon(t, d)
+
+	waitFor(t, "three runs of Often", func() bool {
+		l, _ := labelStatusOf(d, "Often")
+		return l.Runs >= 3
+	})
+	if n := searchesOf(fake, "Yearly"); n != 0 {
+		t.Errorf("Yearly ran %d time(s), want none before its time", n)
+	}
+	often, _ := labelStatusOf(d, "Often")
+	if often.LastRun == nil || often.LastRun.Failures != 0 || often.Schedule != "every 20ms" {
+		t.Errorf("status of Often = %+v", often)
+	}
+	yearly, _ := labelStatusOf(d, "Yearly")
+	if yearly.Runs != 0 || yearly.NextRun.Before(time.Now()) {
+		t.Errorf("status of Yearly = %+v, want it scheduled in the future", yearly)
+	}
+	if st := d.status(); st.Quota.Calls == 0 {
+		t.Errorf("status quota = %+v, want the calls made", st.Quota)
+	}
+}
+
+func TestDaemon_DefaultInterval(t *testing.T) {
+	fake := newTestMail(1, "INBOX")
+	captureLog(t)
+	d, _ := newTestDaemon(t, fake, `
+label_actions:
+  - label: INBOX
+    actions: [{mark_as_read: true}]
+`)
+	if l, _ := labelStatusOf(d, "INBOX"); l.Schedule != "every 1h0m0s" {
+		t.Errorf("schedule without one = %q, want the default interval", l.Schedule)
+	}
+	startDaemon(t, d)
+	waitFor(t, "the first run at start", func() bool { return searchesOf(fake, "INBOX") == 1 })
+}
+
+func TestDaemon_Reload(t *testing.T) {
+	fake := newTestMail(1, "Old", "New", "Added")
+	logs := captureLog(t)
+	d, path := newTestDaemon(t, fake, `
+label_actions:
+  - label: Old
+    schedule: {cron: "@yearly"}
+    actions: [{mark_as_read: true}]
+`)
+	startDaemon(t, d)
+
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		d.requestReload()
+	}
+	write(`
+label_actions:
+  - label: New
+    schedule: {every: 1h}
+    actions: [{mark_as_read: true}]
+`)
+	waitFor(t, "the new label to run", func() bool { return searchesOf(fake, "New") == 1 })
+	if _, ok := labelStatusOf(d, "Old"); ok {
+		t.Error("the removed label is still scheduled")
+	}
+
+	write(`label_actions: [`)
+	waitFor(t, "the reload to fail", func() bool { return d.status().ReloadError != "" })
+	if _, ok := labelStatusOf(d, "New"); !ok {
+		t.Error("a broken config replaced the current one")
+	}
+
+	write(`
+label_actions:
+  - label: New
+    schedule: {every: 1h}
+    actions: [{delete_email: true}]
+`)
+	waitFor(t, "the reload to fail", func() bool {
+		return strings.Contains(d.status().ReloadError, "restart it to authorise")
+	})
+	if !strings.Contains(logs.String(), `level=ERROR msg="keeping the current config, reloading failed"`) {
+		t.Errorf("log does not report the failed reload:\n%s", logs)
+	}
+
+	write(`
+label_actions:
+  - label: New
+    schedule: {every: 1h}
+    actions: [{mark_as_read: true}]
+  - label: Added
+    schedule: {every: 1h}
+    actions: [{mark_as_read: true}]
+`)
+	waitFor(t, "the added label to run", func() bool { return searchesOf(fake, "Added") == 1 })
+	if st := d.status(); st.ReloadError != "" {
+		t.Errorf("reload error = %q after a good config", st.ReloadError)
+	}
+	// New kept its schedule rather than running again at once.
+	if n := searchesOf(fake, "New"); n != 1 {
+		t.Errorf("New ran %d time(s), want 1", n)
+	}
+}
+
+func TestDaemon_Watch(t *testing.T) {
+	captureLog(t)
+	d, path := newTestDaemon(t, newTestMail(0), `
+label_actions:
+  - label: INBOX
+    schedule: {cron: "@yearly"}
+    actions: [{mark_as_read: true}]
+`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.watch(ctx, 5*time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-d.reload:
+		t.Fatal("reload requested without a change")
+	default:
+	}
+	os.WriteFile(path, []byte("label_actions: []\n"), 0644)
+	select {
+	case <-d.reload:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload requested after the config changed")
+	}
+}
+
+func TestDaemon_LockedRunSkipped(t *testing.T) {
+	fake := newTestMail(1, "INBOX")
+	captureLog(t)
+	d, path := newTestDaemon(t, fake, `
+label_actions:
+  - label: INBOX
+    actions: [{mark_as_read: true}]
+`)
+	d.user = "me"
+	d.lockPath = filepath.Join(t.TempDir(), "run.lock")
+	lock, err := acquireLock(context.Background(), d.lockPath, "me", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	d.runJob(context.Background(), d.nextJob(), nil, triggerSchedule)
+	l, _ := labelStatusOf(d, "INBOX")
+	if l.LastRun == nil || !strings.Contains(l.LastRun.Skipped, "another run is in progress") {
+		t.Errorf("last run = %+v, want it skipped", l.LastRun)
+	}
+	if n := searchesOf(fake, "INBOX"); n != 0 {
+		t.Errorf("INBOX was searched %d time(s) while locked", n)
+	}
+	if !l.NextRun.After(time.Now()) {
+		t.Errorf("next run = %v, want it rescheduled", l.NextRun)
+	}
+}
+
+func TestDaemon_Report(t *testing.T) {
+	fake := newTestMail(2, "INBOX")
+	logs := captureLog(t)
+	d, _ := newTestDaemon(t, fake, `
+label_actions:
+  - label: INBOX
+    actions: [{mark_as_read: true}]
+`)
+	d.reportPath = filepath.Join(t.TempDir(), "report.json")
+
+	run := d.runJob(context.Background(), d.nextJob(), nil, triggerSchedule)
+	if run.Messages != 2 || run.Files != 0 || run.Failures != 0 {
+		t.Errorf("run = %+v, want 2 messages handled", run)
+	}
+	data, err := os.ReadFile(d.reportPath)
+	if err != nil {
+		t.Fatalf("reading the report: %v", err)
+	}
+	var report download.Result
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("decoding the report: %v", err)
+	}
+	if len(report.Labels) != 1 || len(report.Labels[0].Actions) != 1 || len(report.Labels[0].Actions[0].Messages) != 2 {
+		t.Errorf("report = %s, want the 2 messages of INBOX", data)
+	}
+	if !strings.Contains(logs.String(), "label INBOX, action 0: 2 matched") {
+		t.Errorf("log does not have the run summary:\n%s", logs)
+	}
+}
+
+func TestDaemon_Notifications(t *testing.T) {
+	fake := newTestMail(2, "INBOX")
+	captureLog(t)
+	var mu sync.Mutex
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Event   string `json:"event"`
+			Account string `json:"account"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		events = append(events, payload.Event+" "+payload.Account)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	d, path := newTestDaemon(t, fake, `
+label_actions:
+  - label: INBOX
+    actions: [{mark_as_read: true}]
+`)
+	d.notifier = download.NewNotifier(nil, "me@example.com")
+	d.runJob(context.Background(), d.nextJob(), nil, triggerSchedule)
+
+	// Notifications come and go with the config.
+	config := fmt.Sprintf(`
+label_actions:
+  - label: INBOX
+    actions: [{mark_as_read: true}]
+notifications:
+  - type: webhook
+    url: %s
+    on: [run]
+`, srv.URL)
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d.reloadConfig()
+	d.runJob(context.Background(), d.nextJob(), nil, triggerSchedule)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0] != "run me@example.com" {
+		t.Errorf("notified events = %q, want the run after the reload", events)
+	}
+}
+
+func TestDaemon_StatusEndpoint(t *testing.T) {
+	captureLog(t)
+	d, path := newTestDaemon(t, newTestMail(0), `
+label_actions:
+  - label: INBOX
+    schedule: {cron: "0 7 * * *", jitter: 1m}
+    actions: [{mark_as_read: true}]
+`)
+	d.user = "me"
+	d.metrics = newRunMetrics()
+	srv := httptest.NewServer(d.handler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st daemonStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("decoding status: %v", err)
+	}
+	if st.User != "me" || st.Config != path || len(st.Labels) != 1 ||
+		st.Labels[0].Schedule != "cron 0 7 * * *, jitter 1m0s" || st.Labels[0].NextRun.IsZero() {
+		t.Errorf("status = %+v", st)
+	}
+
+	resp, err = srv.Client().Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != "ok" {
+		t.Errorf("/healthz = %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.Contains(string(body), "go_goroutines ") {
+		t.Errorf("/metrics = %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,667 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/gmail/v1"
+)
+
+type Action struct {
+	SubjectFilter        string `json:"subject_filter"`
+	Download             bool   `json:"download_attachment"`
+	MarkAsRead           bool   `json:"mark_as_read"`
+	Delete               bool   `json:"delete_email"`
+	SaveTo               string `json:"save_to"`
+	PdfPassword          Secret `json:"pdf_password"`
+	FilenamePattern      string `json:"filename_pattern"`
+	SaveAsPdf            bool   `json:"save_as_pdf"`
+	AttachmentNameFilter string `json:"attachment_name_filter"`
+
+	// PdfPasswords are further passwords tried, in order, when PdfPassword
+	// does not open a PDF.
+	PdfPasswords []Secret `json:"pdf_passwords"`
+	// PdfPasswordTemplates derive more candidate passwords from
+	// PdfPasswordVars, e.g. {{.name | first 4 | upper}}{{.dob | date "0201"}}.
+	PdfPasswordTemplates []string          `json:"pdf_password_templates"`
+	PdfPasswordVars      map[string]Secret `json:"pdf_password_vars"`
+
+	// EncryptPdf re-encrypts every PDF the action saves, after decryption.
+	EncryptPdf *PdfEncryption `json:"encrypt_pdf"`
+
+	// derivedPasswords are the rendered PdfPasswordTemplates, set when the
+	// config is loaded.
+	derivedPasswords []string
+}
+
+type LabelAction struct {
+	Label string `json:"label"`
+	// Defaults are inherited by the actions of this label, taking precedence
+	// over the config-wide defaults.
+	Defaults Action   `json:"defaults"`
+	Actions  []Action `json:"actions"`
+	// Schedule says when the daemon runs the actions of this label. Without
+	// one, the daemon runs them at its default interval; run ignores it.
+	Schedule *Schedule `json:"schedule"`
+}
+
+// saveEmailAsPDF saves the email content as a PDF file in saveDir and
+// returns its path and size.
+func saveEmailAsPDF(storage Storage, emailID, emailDate, subject, body, saveDir string) (string, int64, error) {
+	if err := storage.CheckDir(saveDir); err != nil {
+		return "", 0, fmt.Errorf("save directory is not usable: %v", err)
+	}
+
+	filename := emailPDFPath(saveDir, emailDate, emailID)
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetFont("Arial", "", 12)
+	pdf.AddPage()
+
+	pdf.CellFormat(0, 10, fmt.Sprintf("Email ID: %s", emailID), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 10, fmt.Sprintf("Date: %s", emailDate), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 10, fmt.Sprintf("Subject: %s", subject), "", 1, "L", false, 0, "")
+
+	// Add a line break
+	pdf.Ln(10)
+
+	pdf.MultiCell(0, 10, body, "", "L", false)
+
+	// Written like attachments, so a crash never leaves half a PDF behind.
+	var data bytes.Buffer
+	if err := pdf.Output(&data); err != nil {
+		return filename, 0, fmt.Errorf("failed to save PDF: %v", err)
+	}
+	if err := writeFile(storage, filename, data.Bytes()); err != nil {
+		return filename, 0, fmt.Errorf("failed to save PDF: %v", err)
+	}
+
+	return filename, int64(data.Len()), nil
+}
+
+// emailPDFPath returns where saveEmailAsPDF saves an email.
+func emailPDFPath(saveDir, emailDate, emailID string) string {
+	return fmt.Sprintf("%s/email_%s_%s.pdf", saveDir, emailDate, emailID)
+}
+
+// securePDF decrypts a saved PDF with the action's passwords and then
+// re-encrypts it with encrypt_pdf, as far as the action asks for either. It
+// records the outcome in file, and returns the step that failed, if any.
+func securePDF(storage Storage, l *slog.Logger, action Action, file *FileResult) (string, error) {
+	filePath := file.Path
+	if passwords := action.pdfPasswordCandidates(); len(passwords) > 0 {
+		index, encrypted, err := decryptPDF(storage, filePath, passwords)
+		switch {
+		case err != nil:
+			file.Decrypt = DecryptFailed
+			return StepDecrypt, fmt.Errorf("failed to decrypt PDF %s, keeping it as downloaded: %w", filePath, err)
+		case !encrypted:
+			file.Decrypt = DecryptNotEncrypted
+			l.Debug("PDF is not encrypted", AttrPath, filePath)
+		case index < 0:
+			file.Decrypt = DecryptOwnerRemoved
+			l.Info("removed the owner password of PDF", AttrPath, filePath)
+		default:
+			file.Decrypt = DecryptDecrypted
+			l.Info("decrypted PDF", AttrPath, filePath, "password", index+1, "passwords", len(passwords))
+		}
+	}
+
+	if action.EncryptPdf != nil {
+		if err := encryptPDF(storage, filePath, action.EncryptPdf); err != nil {
+			return StepEncrypt, fmt.Errorf("failed to encrypt PDF %s: %w", filePath, err)
+		}
+		file.Encrypted = true
+		l.Info("encrypted PDF", AttrPath, filePath)
+	}
+	return "", nil
+}
+
+func formatFilename(pattern, originalFilename, emailDate string) string {
+	// Replace placeholders in the pattern with actual values
+	formatted := strings.ReplaceAll(pattern, "{original}", originalFilename)
+	formatted = strings.ReplaceAll(formatted, "{date}", emailDate)
+	return formatted
+}
+
+func parseEmailDate(dateStr string) string {
+	// Define possible layouts for parsing email date
+	layouts := []string{
+		time.RFC1123Z,                    // Example: Mon, 02 Jan 2006 15:04:05 -0700
+		time.RFC1123,                     // Example: Mon, 02 Jan 2006 15:04:05 MST
+		"Mon, 2 Jan 2006 15:04:05 -0700", // Single-digit day
+		"2 Jan 2006 15:04:05 -0700",      // No weekday
+	}
+
+	for _, layout := range layouts {
+		if parsedTime, err := time.Parse(layout, dateStr); err == nil {
+			return parsedTime.Format("2006-01-02_15-04-05")
+		}
+	}
+
+	// Return "unknown" if parsing fails for all layouts
+	return "unknown"
+}
+
+// actionQuery builds the Gmail search query selecting the messages an action
+// applies to.
+func actionQuery(label string, action Action) string {
+	return fmt.Sprintf("label:%s subject:%s", label, action.SubjectFilter)
+}
+
+// HeaderValue returns the value of the first header of m called name, or ""
+// if there is none.
+func HeaderValue(m *gmail.Message, name string) string {
+	for _, header := range m.Payload.Headers {
+		if header.Name == name {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// EmailDate returns the Date header of m as it appears in the names of saved
+// files, or "unknown".
+func EmailDate(m *gmail.Message) string {
+	if date := HeaderValue(m, "Date"); date != "" {
+		return parseEmailDate(date)
+	}
+	return "unknown"
+}
+
+// messageFetch returns what processing with the action needs of a message:
+// the metadata with the Date and Subject headers, unless the action saves
+// attachments, which needs the parts, or the email as a PDF, which needs the
+// body too. The full format is trimmed to what is used by a fields mask.
+func (a Action) messageFetch() MessageFetch {
+	if !a.Download && !a.SaveAsPdf {
+		return MessageFetch{Format: "metadata", Headers: []string{"Date", "Subject"}, Fields: "id,payload/headers"}
+	}
+	payload := []string{"headers"}
+	if a.SaveAsPdf {
+		payload = append(payload, "body/data")
+	}
+	if a.Download {
+		payload = append(payload, "parts(filename,body/attachmentId)")
+	}
+	return MessageFetch{Format: "full", Fields: "id,payload(" + strings.Join(payload, ",") + ")"}
+}
+
+// wantAttachment reports whether part is an attachment the action downloads.
+func wantAttachment(action Action, part *gmail.MessagePart) (bool, error) {
+	if part.Filename == "" || part.Body == nil || part.Body.AttachmentId == "" {
+		return false, nil
+	}
+	if action.AttachmentNameFilter == "" {
+		return true, nil
+	}
+	return regexp.MatchString(action.AttachmentNameFilter, part.Filename)
+}
+
+// finishTimeout bounds how long an interrupted run keeps marking and deleting
+// the messages it saved.
+const finishTimeout = time.Minute
+
+// processLabel runs every action of labelAction, the label at labelIndex in
+// the config, one page of matching messages at a time (see processPage).
+// Actions run one after another, so a message matched by several actions
+// sees them in config order. Failures on individual messages are logged and
+// processing continues; they are returned in the result so the caller can
+// report a partial failure.
+//
+// Progress is saved to cp after every page, and actions the checkpoint shows
+// as done are skipped. When ctx is cancelled, processLabel saves how far it
+// got and returns; errors caused by the cancellation are not failures.
+func (p *Processor) processLabel(ctx context.Context, labelIndex int, labelAction LabelAction, cp *checkpointer) *LabelResult {
+	ctx, run := p.newLabelRun(ctx, labelAction.Label)
+	run.log.Info("processing label")
+	saveCheckpoint := func(err error) {
+		if err != nil {
+			run.log.Warn("unable to save checkpoint", AttrError, err)
+		}
+	}
+
+	for actionIndex, action := range labelAction.Actions {
+		skip, pageToken, lastMessage := cp.resumeAt(labelIndex, actionIndex)
+		if skip {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		query := actionQuery(labelAction.Label, action)
+		actx, report := run.action(ctx, actionIndex, query)
+		listed := false
+		process := func(page messagePage) bool {
+			listed = true
+			report.Scanned += len(page.ids)
+			ids, after := page.ids, lastMessage
+			if after != "" {
+				ids = idsAfter(ids, after)
+				lastMessage = ""
+			}
+			last := p.processPage(actx, run, report, action, ids)
+			if ctx.Err() != nil {
+				if last == "" {
+					last = after
+				}
+				saveCheckpoint(cp.save(labelIndex, actionIndex, page.token, last))
+				return false
+			}
+			saveCheckpoint(cp.save(labelIndex, actionIndex, page.next, ""))
+			return true
+		}
+		err := p.client.forEachPage(actx, query, pageToken, process)
+		if err != nil && pageToken != "" && !listed && ctx.Err() == nil && !retriable(err) {
+			// Page tokens do not last forever.
+			run.log.Warn("cannot resume at the saved page, starting the action over", AttrAction, actionIndex, AttrError, err)
+			err = p.client.forEachPage(actx, query, "", process)
+		}
+		if err != nil {
+			run.failAction(report, StepList, fmt.Errorf("unable to list messages for label %s: %w", labelAction.Label, err))
+		}
+		run.endAction(report)
+		if ctx.Err() != nil {
+			break
+		}
+		saveCheckpoint(cp.done(labelIndex, actionIndex))
+	}
+	return run.finish()
+}
+
+// processAdded runs every action of labelAction on the messages added only.
+func (p *Processor) processAdded(ctx context.Context, labelAction LabelAction, added *NewMessages) *LabelResult {
+	ctx, run := p.newLabelRun(ctx, labelAction.Label)
+	run.log.Info("processing new messages", "messages", len(added.IDs))
+	for actionIndex, action := range labelAction.Actions {
+		query := fmt.Sprintf("%s after:%d", actionQuery(labelAction.Label, action), added.Since.Unix())
+		actx, report := run.action(ctx, actionIndex, query)
+		err := p.client.forEachPage(actx, query, "", func(page messagePage) bool {
+			report.Scanned += len(page.ids)
+			var ids []string
+			for _, id := range page.ids {
+				if added.IDs[id] {
+					ids = append(ids, id)
+				}
+			}
+			if len(ids) > 0 {
+				p.processPage(actx, run, report, action, ids)
+			}
+			return ctx.Err() == nil
+		})
+		if err != nil {
+			run.failAction(report, StepList, fmt.Errorf("unable to list messages for label %s: %w", labelAction.Label, err))
+		}
+		run.endAction(report)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return run.finish()
+}
+
+// idsAfter returns the IDs following id in ids, or all of them if id is not
+// among them, as when the message was deleted since.
+func idsAfter(ids []string, id string) []string {
+	for i := range ids {
+		if ids[i] == id {
+			return ids[i+1:]
+		}
+	}
+	return ids
+}
+
+// processPage applies the action of report to one page of messages, adding
+// what it did to each message to report.
+// The messages are fetched in batches when the client batches, and saved by
+// up to p.opts.Workers goroutines at a time. Once they are all saved, the
+// messages that were fetched and saved in full are marked as read and then
+// deleted, in bulk where that takes less quota, so every message is saved
+// before it is marked and marked before it is deleted.
+//
+// When ctx is cancelled, no further message is started, and downloads in
+// flight are abandoned without leaving partial files behind; the messages
+// saved by then are still marked and deleted. processPage returns the last
+// message that it and every message before it were handled, "" for none.
+func (p *Processor) processPage(ctx context.Context, run *labelRun, report *ActionResult, action Action, ids []string) string {
+	label, actionIndex, client := run.result.Label, report.Index, p.client
+	l := run.log.With(AttrAction, actionIndex)
+	report.Matched += len(ids)
+	var msgs []*gmail.Message
+	var errs []error
+	if client.batching() {
+		msgs, errs = client.getMessages(ctx, ids, action.messageFetch())
+	}
+
+	fetched := make([]bool, len(ids)) // saved in full, to be marked and deleted
+	handled := make([]bool, len(ids)) // done with, successfully or not
+	events := make([]*MessageEvent, len(ids))
+	results := make([]*MessageResult, len(ids))
+	// The span of a message covers fetching and saving it. Marking as read
+	// and deleting happen for the page as a whole, in the span of the
+	// action, so their failures are recorded there.
+	spans := make([]trace.Span, len(ids))
+	fail := func(i int, step string, err error) {
+		if run.fail(l.With(AttrMessage, ids[i]), step, err) {
+			events[i].Err = errors.Join(events[i].Err, err)
+			results[i].Errors = append(results[i].Errors, newErrorResult(step, err))
+			if spans[i] != nil {
+				recordFailure(spans[i], step, err)
+			} else {
+				recordFailure(trace.SpanFromContext(ctx), step, err, messageAttrs(ids[i])...)
+			}
+		}
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(p.opts.Workers, len(ids)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				events[i] = &MessageEvent{Label: label, Action: actionIndex, ID: ids[i]}
+				results[i] = &MessageResult{ID: ids[i]}
+				func() {
+					mctx, span := p.tracer.Start(ctx, spanMessage, trace.WithAttributes(messageAttrs(ids[i])...))
+					spans[i] = span
+					defer func() {
+						spans[i] = nil
+						span.End()
+					}()
+					var m *gmail.Message
+					var err error
+					if msgs != nil {
+						m, err = msgs[i], errs[i]
+					} else {
+						m, err = client.getMessage(mctx, ids[i], action.messageFetch())
+					}
+					if err != nil {
+						fail(i, StepFetch, fmt.Errorf("unable to retrieve message %s: %w", ids[i], err))
+						handled[i] = ctx.Err() == nil
+						return
+					}
+					events[i].Subject = HeaderValue(m, "Subject")
+					results[i].Subject = events[i].Subject
+					// A message is marked and deleted only once all it asks
+					// for is saved, so a failed download is tried again. A
+					// PDF that could not be decrypted or encrypted is saved
+					// all the same, and trying again would not help.
+					unsaved := false
+					files := p.processMessage(mctx, label, actionIndex, action, m, results[i], func(step string, err error) {
+						if step == StepSave {
+							unsaved = true
+						}
+						fail(i, step, err)
+					})
+					span.SetAttributes(attribute.Int("files", files))
+					run.count(0, files)
+					handled[i] = ctx.Err() == nil
+					fetched[i] = handled[i] && !unsaved
+				}()
+			}
+		}()
+	}
+dispatch:
+	for i := range ids {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	last := ""
+	for i, ok := range handled {
+		if !ok {
+			break
+		}
+		last = ids[i]
+	}
+
+	var done []int
+	for i, ok := range fetched {
+		if ok {
+			done = append(done, i)
+		}
+	}
+	doneIDs := make([]string, len(done))
+	for j, i := range done {
+		doneIDs[j] = ids[i]
+	}
+	// Marking and deleting go ahead even when the run is interrupted, so the
+	// messages saved so far are not processed again.
+	fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finishTimeout)
+	defer cancel()
+	if action.MarkAsRead {
+		for j, err := range client.markReadAll(fctx, doneIDs) {
+			if err != nil {
+				fail(done[j], StepMarkRead, fmt.Errorf("failed to mark email %s as read: %w", doneIDs[j], err))
+			} else {
+				results[done[j]].LabelsRemoved = []string{"UNREAD"}
+			}
+		}
+	}
+	if action.Delete {
+		for _, id := range doneIDs {
+			l.Info("deleting message", AttrMessage, id)
+		}
+		for j, err := range client.deleteMessages(fctx, doneIDs) {
+			if err != nil {
+				fail(done[j], StepDelete, fmt.Errorf("failed to delete email %s: %w", doneIDs[j], err))
+			} else {
+				results[done[j]].Deleted = true
+			}
+		}
+	}
+
+	n := 0
+	for i, ok := range handled {
+		if ok {
+			n++
+			report.Messages = append(report.Messages, results[i])
+			p.messageEvent(ctx, *events[i])
+		}
+	}
+	run.count(n, 0)
+	return last
+}
+
+// processMessage saves what action asks for of the message m: its
+// attachments and the email itself as a PDF, adding the files saved to
+// result. fail is called for every step that fails. Every file is saved in
+// a span of its own. It returns the number of files saved.
+func (p *Processor) processMessage(ctx context.Context, label string, actionIndex int, action Action, m *gmail.Message, result *MessageResult, fail func(step string, err error)) int {
+	id := m.Id
+	l := p.actionLogger(label, actionIndex).With(AttrMessage, id)
+	saved := 0
+	// file reports e, the file saved in span, and ends the span.
+	file := func(span trace.Span, e FileEvent, step string) {
+		defer span.End()
+		e.Label, e.Action, e.MessageID = label, actionIndex, id
+		span.SetAttributes(fileAttrs(e.FileResult)...)
+		if e.Err != nil {
+			recordFailure(span, step, e.Err)
+			fail(step, e.Err)
+		}
+		if step != StepSave {
+			result.Files = append(result.Files, e.FileResult)
+		}
+		p.fileEvent(ctx, e)
+	}
+
+	// Parse email date/time
+	emailDate := EmailDate(m)
+	if date := HeaderValue(m, "Date"); emailDate == "unknown" && date != "" {
+		l.Warn("unable to parse the date of the message", "date", date)
+	}
+
+	if action.Download {
+		for _, part := range m.Payload.Parts {
+			want, err := wantAttachment(action, part)
+			if err != nil {
+				l.Error("invalid attachment name filter", AttrError, err)
+				continue
+			}
+			if !want {
+				continue
+			}
+
+			// save_to is checked when the config is loaded, but the
+			// directory may have gone away since.
+			dir := action.SaveTo
+			if err := p.storage.CheckDir(dir); err != nil {
+				fail(StepSave, fmt.Errorf("unable to save attachment %s of message %s: %w", part.Filename, id, err))
+				continue
+			}
+
+			// Apply filename pattern
+			filename := part.Filename
+			if action.FilenamePattern != "" {
+				filename = formatFilename(action.FilenamePattern, part.Filename, emailDate)
+			}
+
+			// Workers may save attachments with the same name at the same
+			// time; writing atomically means the last one wins intact.
+			filePath := fmt.Sprintf("%s/%s", dir, filename)
+			actx, span := p.tracer.Start(ctx, spanAttachment, trace.WithAttributes(attribute.String("name", part.Filename)))
+			e := FileEvent{FileResult: FileResult{Kind: FileAttachment, Name: part.Filename, Path: filePath}}
+			e.Size, err = p.client.saveAttachment(actx, p.storage, id, part.Body.AttachmentId, filePath)
+			if err != nil {
+				e.Err = fmt.Errorf("unable to save attachment %s of message %s to %s: %w", part.Filename, id, filePath, err)
+				file(span, e, StepSave)
+				continue
+			}
+			l.Info("saved attachment", AttrPath, filePath, AttrSize, e.Size)
+			saved++
+
+			step := ""
+			if strings.EqualFold(filepath.Ext(part.Filename), ".pdf") {
+				step, e.Err = securePDF(p.storage, l, action, &e.FileResult)
+			}
+			file(span, e, step)
+		}
+	}
+
+	if action.SaveAsPdf {
+		// Extract subject
+		subject := HeaderValue(m, "Subject")
+		if subject == "" {
+			subject = "No Subject"
+		}
+
+		// Extract body
+		body := ""
+		if m.Payload.Body != nil && m.Payload.Body.Data != "" {
+			data, err := base64.URLEncoding.DecodeString(m.Payload.Body.Data)
+			if err == nil {
+				body = string(data)
+			}
+
+			_, span := p.tracer.Start(ctx, spanEmail)
+			e := FileEvent{FileResult: FileResult{Kind: FileEmail}}
+			step := ""
+			e.Path, e.Size, err = saveEmailAsPDF(p.storage, id, emailDate, subject, body, action.SaveTo)
+			if err != nil {
+				step, e.Err = StepSave, fmt.Errorf("failed to save email %s as PDF: %w", id, err)
+			} else {
+				l.Info("saved email as PDF", AttrPath, e.Path, AttrSize, e.Size)
+				saved++
+				if action.EncryptPdf != nil {
+					if err := encryptPDF(p.storage, e.Path, action.EncryptPdf); err != nil {
+						step, e.Err = StepEncrypt, fmt.Errorf("failed to encrypt PDF %s: %w", e.Path, err)
+					} else {
+						e.Encrypted = true
+					}
+				}
+			}
+			file(span, e, step)
+		}
+	}
+	return saved
+}
+
+// planEmails writes to w what processLabel would do for labelAction,
+// without downloading or changing anything.
+func (p *Processor) planEmails(ctx context.Context, labelAction LabelAction, w io.Writer) error {
+	client := p.client
+	for i, action := range labelAction.Actions {
+		query := actionQuery(labelAction.Label, action)
+		fmt.Fprintf(w, "label %s, action %d: %s\n", labelAction.Label, i, query)
+
+		var ops []string
+		if action.Download {
+			if n := len(action.pdfPasswordCandidates()); n == 1 && action.PdfPassword.IsSet() {
+				ops = append(ops, fmt.Sprintf("decrypt PDFs with password %s", action.PdfPassword))
+			} else if n > 0 {
+				ops = append(ops, fmt.Sprintf("decrypt PDFs trying %d password(s)", n))
+			}
+		}
+		if action.EncryptPdf != nil && (action.Download || action.SaveAsPdf) {
+			ops = append(ops, "encrypt saved PDFs")
+		}
+		if action.SaveAsPdf {
+			ops = append(ops, "save as PDF")
+		}
+		if action.MarkAsRead {
+			ops = append(ops, "mark as read")
+		}
+		if action.Delete {
+			ops = append(ops, "delete")
+		}
+
+		count := 0
+		err := client.forEachPage(ctx, query, "", func(page messagePage) bool {
+			msgs, errs := client.getMessages(ctx, page.ids, action.messageFetch())
+			for i, m := range msgs {
+				count++
+				if errs[i] != nil {
+					fmt.Fprintf(w, "  %s: unable to retrieve message: %v\n", page.ids[i], errs[i])
+					continue
+				}
+				planMessage(action, m, ops, w)
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("unable to list messages for label %s: %w", labelAction.Label, err)
+		}
+		fmt.Fprintf(w, "  %d message(s)\n", count)
+	}
+	return nil
+}
+
+// planMessage writes to w what action would do to the message m, given the
+// operations ops applying to every message.
+func planMessage(action Action, m *gmail.Message, ops []string, w io.Writer) {
+	emailDate := EmailDate(m)
+	fmt.Fprintf(w, "  %s  %s  %s\n", m.Id, emailDate, HeaderValue(m, "Subject"))
+	if action.Download {
+		for _, part := range m.Payload.Parts {
+			if want, _ := wantAttachment(action, part); !want {
+				continue
+			}
+			filename := part.Filename
+			if action.FilenamePattern != "" {
+				filename = formatFilename(action.FilenamePattern, part.Filename, emailDate)
+			}
+			fmt.Fprintf(w, "    download %s -> %s/%s\n", part.Filename, action.SaveTo, filename)
+		}
+	}
+	if len(ops) > 0 {
+		fmt.Fprintf(w, "    %s\n", strings.Join(ops, ", "))
+	}
+}
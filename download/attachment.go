@@ -0,0 +1,188 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/api/googleapi"
+)
+
+// saveAttachment downloads an attachment of a message to path in storage.
+// The data is decoded as it arrives and written to a file that only appears
+// at path once complete: memory use does not grow with the size of the
+// attachment, and path never holds a partial file. It returns the number of
+// bytes written.
+func (c *mailClient) saveAttachment(ctx context.Context, storage Storage, messageID, attachmentID, path string) (n int64, err error) {
+	f, err := storage.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Abort()
+
+	err = c.callWith(ctx, "getting an attachment of message "+messageID, attachmentsGet, 1, messageAttrs(messageID), func() error {
+		if err := f.Reset(); err != nil {
+			return err
+		}
+		n, err = c.svc.GetAttachment(ctx, messageID, attachmentID, f)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, f.Commit()
+}
+
+// GetAttachment streams the data of the attachment, decoding it as it
+// arrives.
+func (s *gmailService) GetAttachment(ctx context.Context, messageID, attachmentID string, w io.Writer) (int64, error) {
+	root, err := url.Parse(s.svc.BasePath)
+	if err != nil {
+		return 0, err
+	}
+	u := root.JoinPath("gmail/v1/users", s.user, "messages", messageID, "attachments", attachmentID)
+	u.RawQuery = url.Values{"alt": {"json"}, "fields": {"data"}, "prettyPrint": {"false"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return 0, err
+	}
+
+	data, err := jsonStringField(resp.Body, "data")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, base64.NewDecoder(base64.RawURLEncoding, unpadded(data)))
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return n, fmt.Errorf("decoding attachment: %w", err)
+	}
+	return n, err
+}
+
+// jsonStringField returns a reader of the string value of the member name of
+// the JSON object r starts with, without reading the value into memory. The
+// value is returned as it appears in the JSON, so escape sequences are left
+// alone; it is meant for base64 data, which has none.
+func jsonStringField(r io.Reader, name string) (io.Reader, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("response is not a JSON object")
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key == name {
+			rest := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+			if err := skipTo(rest, ':'); err != nil {
+				return nil, err
+			}
+			if err := skipTo(rest, '"'); err != nil {
+				return nil, err
+			}
+			return &quotedReader{r: rest}, nil
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("response has no %q", name)
+}
+
+// skipTo reads r up to and including delim, which may only be preceded by
+// JSON whitespace.
+func skipTo(r *bufio.Reader, delim byte) error {
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		switch b {
+		case delim:
+			return nil
+		case ' ', '\t', '\r', '\n':
+		default:
+			return fmt.Errorf("unexpected %q in JSON, want %q", b, delim)
+		}
+	}
+}
+
+// quotedReader reads the rest of a JSON string up to its closing quote.
+type quotedReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (q *quotedReader) Read(p []byte) (int, error) {
+	if q.done {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		b, err := q.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		if b == '"' {
+			q.done = true
+			break
+		}
+		p[n] = b
+		n++
+		if q.r.Buffered() == 0 {
+			break // do not block for more while holding data
+		}
+	}
+	if q.done && n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// unpadded drops the padding of base64 data, so that it decodes whether or
+// not it is padded.
+func unpadded(r io.Reader) io.Reader {
+	return &paddingFilter{r: r}
+}
+
+type paddingFilter struct{ r io.Reader }
+
+func (f *paddingFilter) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		kept := 0
+		for _, b := range p[:n] {
+			if b != '=' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package download
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONStringField(t *testing.T) {
+	tests := []struct {
+		json, want, wantErr string
+	}{
+		{json: `{"data": "aGVsbG8"}`, want: "aGVsbG8"},
+		{json: `{"size":5,"meta":{"data":"x"},"data" :  "aGVsbG8="}`, want: "aGVsbG8="},
+		{json: `{"data": ""}`, want: ""},
+		{json: `{"size": 5}`, wantErr: `no "data"`},
+		{json: `{"data": null}`, wantErr: "unexpected"},
+		{json: `{"data": "aGVs`, wantErr: "unexpected EOF"},
+		{json: `[]`, wantErr: "not a JSON object"},
+	}
+	for _, tt := range tests {
+		r, err := jsonStringField(strings.NewReader(tt.json), "data")
+		var got []byte
+		if err == nil {
+			got, err = io.ReadAll(r)
+		}
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.json, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.json, got, err, tt.want)
+		}
+	}
+}
+
+// attachmentServer serves one attachment with data as its JSON body.
+func attachmentServer(body func(w http.ResponseWriter)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/attachments/a1") || r.URL.Query().Get("fields") != "data" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		body(w)
+	})
+}
+
+func TestMailClient_SaveAttachment(t *testing.T) {
+	content := make([]byte, 3<<20+1) // not a multiple of 3, so padded
+	rand.Read(content)
+	for _, enc := range []*base64.Encoding{base64.URLEncoding, base64.RawURLEncoding} {
+		client := newTestMailClient(t, attachmentServer(func(w http.ResponseWriter) {
+			fmt.Fprintf(w, `{"data": "%s"}`, enc.EncodeToString(content))
+		}))
+		dir := t.TempDir()
+		path := filepath.Join(dir, "statement.pdf")
+
+		n, err := client.saveAttachment(context.Background(), LocalStorage{}, "m1", "a1", path)
+		if err != nil {
+			t.Fatalf("saveAttachment() error = %v", err)
+		}
+		got, _ := os.ReadFile(path)
+		if n != int64(len(content)) || string(got) != string(content) {
+			t.Errorf("saved %d bytes, file has %d, want %d matching bytes", n, len(got), len(content))
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("directory holds %d files, want only the attachment", len(entries))
+		}
+	}
+}
+
+func TestMailClient_SaveAttachment_Truncated(t *testing.T) {
+	calls := 0
+	client := newTestMailClient(t, attachmentServer(func(w http.ResponseWriter) {
+		calls++
+		// Claim more than is sent, so the client sees the body cut short.
+		w.Header().Set("Content-Length", "1000")
+		fmt.Fprint(w, `{"data": "aGVsbG8gd29y`)
+	}))
+	client.retry = newRetryPolicy(2, 10)
+	client.retry.baseDelay = 0
+	captureLog(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "statement.pdf")
+	if err := os.WriteFile(path, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := client.saveAttachment(context.Background(), LocalStorage{}, "m1", "a1", path)
+	if !isTransient(err) {
+		t.Errorf("saveAttachment() error = %v, want a transient error", err)
+	}
+	if calls != 2 {
+		t.Errorf("requests = %d, want 2 attempts", calls)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "previous" {
+		t.Errorf("file = %q, want the previous content untouched", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want no temporary file left", len(entries))
+	}
+}
+
+func TestMailClient_SaveAttachment_Corrupt(t *testing.T) {
+	client := newTestMailClient(t, attachmentServer(func(w http.ResponseWriter) {
+		fmt.Fprint(w, `{"data": "not base64!"}`)
+	}))
+	path := filepath.Join(t.TempDir(), "statement.pdf")
+
+	_, err := client.saveAttachment(context.Background(), LocalStorage{}, "m1", "a1", path)
+	if err == nil || !strings.Contains(err.Error(), "decoding attachment") || isTransient(err) {
+		t.Errorf("saveAttachment() error = %v, want a permanent decoding error", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("attachment exists after a failed download: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Limits of the Gmail batch endpoint and of the bulk message methods.
+const (
+	// MaxBatchSize is the most calls Gmail accepts in one batch request.
+	MaxBatchSize = 100
+	// DefaultBatchSize follows Gmail's advice not to batch more than 50
+	// calls, as larger batches tend to be rate limited.
+	DefaultBatchSize = 50
+	// maxBulkIDs is the most messages BatchModify and BatchDelete take.
+	maxBulkIDs = 1000
+)
+
+// batching reports whether messages are fetched with batch requests.
+func (c *mailClient) batching() bool {
+	return c.batchSize > 1
+}
+
+// batchResult is the response to one call of a batch request.
+type batchResult struct {
+	body []byte
+	err  error
+}
+
+// batch sends the GET requests for paths, relative to the Gmail API root, as
+// one batch request. It returns the results in the order of paths; an error
+// is only returned when the batch request as a whole failed.
+func (s *gmailService) batch(ctx context.Context, paths []string) ([]batchResult, error) {
+	root, err := url.Parse(s.svc.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, path := range paths {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", fmt.Sprintf("<item%d>", i))
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(pw, "GET %s%s HTTP/1.1\r\n\r\n", root.Path, path)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, root.JoinPath("batch/gmail/v1").String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("batch response has content type %q, want multipart", resp.Header.Get("Content-Type"))
+	}
+
+	results := make([]batchResult, len(paths))
+	for i := range results {
+		results[i].err = fmt.Errorf("no response in the batch: %w", io.ErrUnexpectedEOF)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Responses are labelled <response-itemN> after the request.
+		id := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(id, "response-item"))
+		if err != nil || i < 0 || i >= len(results) {
+			return nil, fmt.Errorf("batch response has unexpected Content-ID %q", id)
+		}
+		results[i] = readBatchResult(part)
+	}
+}
+
+// readBatchResult parses one HTTP response of a batch response.
+func readBatchResult(r io.Reader) batchResult {
+	resp, err := http.ReadResponse(bufio.NewReader(r), nil)
+	if err != nil {
+		return batchResult{err: err}
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return batchResult{err: err}
+	}
+	body, err := io.ReadAll(resp.Body)
+	return batchResult{body: body, err: err}
+}
+
+// getMessages fetches what f selects of the messages ids, batchSize of them
+// per request. The results are in the order of ids. A call that fails in the
+// batch with a transient error is repeated on its own, with retries.
+func (c *mailClient) getMessages(ctx context.Context, ids []string, f MessageFetch) ([]*gmail.Message, []error) {
+	msgs := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	size := max(c.batchSize, 1)
+	for start := 0; start < len(ids); start += size {
+		chunk := ids[start:min(start+size, len(ids))]
+		if len(chunk) == 1 || !c.batching() {
+			for i, id := range chunk {
+				msgs[start+i], errs[start+i] = c.getMessage(ctx, id, f)
+			}
+			continue
+		}
+
+		var got []*gmail.Message
+		var results []error
+		err := c.callWith(ctx, fmt.Sprintf("fetching %d messages in a batch", len(chunk)), messagesGet, len(chunk), messagesAttrs(chunk), func() (err error) {
+			got, results, err = c.svc.GetMessages(ctx, chunk, f)
+			return err
+		})
+		for i, id := range chunk {
+			j := start + i
+			switch {
+			case err != nil:
+				errs[j] = err
+			case results[i] == nil:
+				msgs[j] = got[i]
+			case retriable(results[i]):
+				msgs[j], errs[j] = c.getMessage(ctx, id, f)
+			default:
+				errs[j] = results[i]
+			}
+		}
+	}
+	return msgs, errs
+}
+
+// markReadAll removes the UNREAD label from the messages ids. It uses
+// BatchModify when that costs less quota than modifying them one by one. The
+// errors are in the order of ids, nil for the messages that were marked.
+func (c *mailClient) markReadAll(ctx context.Context, ids []string) []error {
+	return c.bulk(ctx, ids, messagesModify, messagesBatchModify, c.markRead, func(chunk []string) error {
+		return c.callWith(ctx, fmt.Sprintf("marking %d messages as read", len(chunk)), messagesBatchModify, 1, messagesAttrs(chunk), func() error {
+			return c.svc.BatchModifyMessages(ctx, &gmail.BatchModifyMessagesRequest{
+				Ids:            chunk,
+				RemoveLabelIds: []string{"UNREAD"},
+			})
+		})
+	})
+}
+
+// deleteMessages deletes the messages ids permanently, using BatchDelete when
+// that costs less quota than deleting them one by one. The errors are in the
+// order of ids, nil for the messages that were deleted.
+func (c *mailClient) deleteMessages(ctx context.Context, ids []string) []error {
+	return c.bulk(ctx, ids, messagesDelete, messagesBatchDelete, c.deleteMessage, func(chunk []string) error {
+		attempted := false
+		return c.callWith(ctx, fmt.Sprintf("deleting %d messages", len(chunk)), messagesBatchDelete, 1, messagesAttrs(chunk), func() error {
+			err := c.svc.BatchDeleteMessages(ctx, chunk)
+			// As with deleteMessage, a retry may find the messages gone.
+			var apiErr *googleapi.Error
+			if attempted && errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+				return nil
+			}
+			attempted = true
+			return err
+		})
+	})
+}
+
+// bulk applies the same change to the messages ids, either with one call of
+// single per message, or with calls of multi taking up to maxBulkIDs messages
+// at a time, whichever uses less quota.
+func (c *mailClient) bulk(ctx context.Context, ids []string, single, multi apiMethod,
+	one func(context.Context, string) error, many func([]string) error) []error {
+	errs := make([]error, len(ids))
+	if !c.batching() || len(ids)*single.units < multi.units {
+		for i, id := range ids {
+			errs[i] = one(ctx, id)
+		}
+		return errs
+	}
+	for start := 0; start < len(ids); start += maxBulkIDs {
+		end := min(start+maxBulkIDs, len(ids))
+		if err := many(ids[start:end]); err != nil {
+			for i := start; i < end; i++ {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,134 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestMailClient_GetMessages(t *testing.T) {
+	fake, ids := newFakeInbox(7)
+	fake.Fail("messages.get", "m02", notFound(), -1)
+	fake.Fail("messages.get", "m04", &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend Error"}, 1)
+	client := newTestMailClient(t, fake)
+	client.batchSize = 3
+	captureLog(t)
+
+	msgs, errs := client.getMessages(context.Background(), ids, MessageFetch{})
+	for i, id := range ids {
+		var apiErr *googleapi.Error
+		switch {
+		case id == "m02":
+			if !errors.As(errs[i], &apiErr) || apiErr.Code != http.StatusNotFound {
+				t.Errorf("%s: error = %v, want 404", id, errs[i])
+			}
+		case errs[i] != nil:
+			t.Errorf("%s: error = %v", id, errs[i])
+		case msgs[i].Id != id || HeaderValue(msgs[i], "Date") == "":
+			t.Errorf("%s: got message %+v", id, msgs[i])
+		}
+	}
+	// Two batches of three; the last message is fetched on its own, and so
+	// is m04 again after failing in the batch.
+	if got := batchSizes(fake); !reflect.DeepEqual(got, []int{3, 3}) {
+		t.Errorf("batches = %v, want [3 3]", got)
+	}
+	if got := strings.Join(callsAbout(fake, "m04"), ","); got != "messages.get,messages.get" {
+		t.Errorf("calls for m04 = %s, want two gets", got)
+	}
+}
+
+func TestMailClient_GetMessages_NoBatching(t *testing.T) {
+	fake, ids := newFakeInbox(4)
+	client := newTestMailClient(t, fake)
+	client.batchSize = 1
+
+	_, errs := client.getMessages(context.Background(), ids, MessageFetch{})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%s: error = %v", ids[i], err)
+		}
+	}
+	if got := batchSizes(fake); len(got) != 0 {
+		t.Errorf("batches = %v, want none", got)
+	}
+}
+
+func TestMailClient_Bulk(t *testing.T) {
+	fake, ids := newFakeInbox(24)
+	client := newTestMailClient(t, fake)
+
+	// Marking 12 messages costs 60 units one by one but 50 in bulk, deleting
+	// 5 costs 50 either way; fewer are changed one by one.
+	for _, errs := range [][]error{
+		client.markReadAll(context.Background(), ids[:12]),
+		client.markReadAll(context.Background(), ids[12:15]),
+		client.deleteMessages(context.Background(), ids[15:20]),
+		client.deleteMessages(context.Background(), ids[20:]),
+	} {
+		for _, err := range errs {
+			if err != nil {
+				t.Errorf("error = %v", err)
+			}
+		}
+	}
+	if got, want := callsAbout(fake, ""), []string{"messages.batchModify", "messages.batchDelete"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bulk calls = %v, want %v", got, want)
+	}
+	for i, id := range ids {
+		want := "" // changed in bulk
+		switch {
+		case i >= 12 && i < 15:
+			want = "messages.modify"
+		case i >= 20:
+			want = "messages.delete"
+		}
+		if got := strings.Join(callsAbout(fake, id), ","); got != want {
+			t.Errorf("calls for %s = %s, want %q", id, got, want)
+		}
+		m, ok := fake.Message(id)
+		if i < 15 && (!ok || slices.Contains(m.Labels, "UNREAD")) {
+			t.Errorf("%s = %+v, %v, want it marked as read", id, m, ok)
+		}
+		if i >= 15 && ok {
+			t.Errorf("%s was not deleted", id)
+		}
+	}
+}
+
+func TestProcessEmails_Batched(t *testing.T) {
+	fake, ids := newFakeInbox(15)
+	fake.PageSize = 15
+	fake.Fail("messages.get", "m03", notFound(), -1)
+	client := newTestMailClient(t, fake)
+	captureLog(t)
+
+	labelAction := LabelAction{Label: "INBOX", Actions: []Action{{
+		Download: true, SaveTo: t.TempDir(), MarkAsRead: true, Delete: true,
+	}}}
+	err := processEmails(context.Background(), client, labelAction, 4)
+	if countErrors(err) != 1 {
+		t.Errorf("processEmails() error = %v, want one failure for m03", err)
+	}
+	if got := batchSizes(fake); !reflect.DeepEqual(got, []int{15}) {
+		t.Errorf("batches = %v, want [15]", got)
+	}
+	// The message that could not be fetched is neither marked nor deleted.
+	if got, want := callsAbout(fake, ""), []string{"messages.list", "messages.batchModify", "messages.batchDelete"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls about no message = %v, want %v", got, want)
+	}
+	if got := strings.Join(callsAbout(fake, "m03"), ","); got != "messages.get" {
+		t.Errorf("calls for m03 = %s, want messages.get", got)
+	}
+	for _, id := range ids {
+		if _, ok := fake.Message(id); ok != (id == "m03") {
+			t.Errorf("%s still there = %v, want only m03 left", id, ok)
+		}
+	}
+}
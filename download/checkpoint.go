@@ -0,0 +1,158 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/internal/atomicfile"
+)
+
+// DefaultCheckpointFile is where run keeps its checkpoint unless
+// GMAIL_CHECKPOINT_FILE or -checkpoint say otherwise.
+const DefaultCheckpointFile = "checkpoint.json"
+
+// checkpoint records how far a run got through the actions of its config:
+// everything before the action at LabelIndex and ActionIndex is done, and
+// that action resumes at the page PageToken returns, after LastMessage.
+type checkpoint struct {
+	User        string    `json:"user"`
+	LabelIndex  int       `json:"label_index"`
+	ActionIndex int       `json:"action_index"`
+	Label       string    `json:"label"`
+	Query       string    `json:"query"`
+	PageToken   string    `json:"page_token,omitempty"`
+	LastMessage string    `json:"last_message,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// checkpointer saves a checkpoint to path as a run makes progress, and holds
+// the checkpoint of an interrupted run to resume from. A nil checkpointer
+// saves nothing and resumes nothing.
+type checkpointer struct {
+	path   string
+	user   string
+	config *Config
+	resume *checkpoint
+}
+
+// newCheckpointer returns a checkpointer for a run of config for user,
+// resuming from the checkpoint at path if there is one for the same user and
+// the same actions, and logging to l why it does not resume. An empty path
+// disables checkpoints.
+func newCheckpointer(path, user string, config *Config, l *slog.Logger) (*checkpointer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	c := &checkpointer{path: path, user: user, config: config}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		l.Warn("ignoring unreadable checkpoint", AttrPath, path, AttrError, err)
+		return c, nil
+	}
+	if reason := c.mismatch(cp); reason != "" {
+		l.Warn("ignoring checkpoint, starting from the beginning", AttrPath, path, "reason", reason)
+		return c, nil
+	}
+	c.resume = &cp
+	l.Info("resuming from checkpoint", AttrPath, path, AttrLabel, cp.Label, AttrAction, cp.ActionIndex, "saved", cp.Updated)
+	return c, nil
+}
+
+// mismatch returns why cp does not apply to this run, or "".
+func (c *checkpointer) mismatch(cp checkpoint) string {
+	if cp.User != c.user {
+		return fmt.Sprintf("it is for user %s", cp.User)
+	}
+	if cp.LabelIndex < 0 || cp.LabelIndex >= len(c.config.LabelActions) {
+		return "the config has changed"
+	}
+	labelAction := c.config.LabelActions[cp.LabelIndex]
+	if cp.ActionIndex < 0 || cp.ActionIndex >= len(labelAction.Actions) ||
+		labelAction.Label != cp.Label || actionQuery(labelAction.Label, labelAction.Actions[cp.ActionIndex]) != cp.Query {
+		return "the config has changed"
+	}
+	return ""
+}
+
+// skipLabel reports whether the interrupted run got past the label at
+// labelIndex.
+func (c *checkpointer) skipLabel(labelIndex int) bool {
+	return c != nil && c.resume != nil && labelIndex < c.resume.LabelIndex
+}
+
+// resumeAt tells how to run the action at labelIndex and actionIndex: skip
+// it, as the interrupted run got past it, or start it at pageToken, after
+// the message lastMessage.
+func (c *checkpointer) resumeAt(labelIndex, actionIndex int) (skip bool, pageToken, lastMessage string) {
+	if c == nil || c.resume == nil {
+		return false, "", ""
+	}
+	cp := c.resume
+	if labelIndex < cp.LabelIndex || labelIndex == cp.LabelIndex && actionIndex < cp.ActionIndex {
+		return true, "", ""
+	}
+	c.resume = nil
+	return false, cp.PageToken, cp.LastMessage
+}
+
+// save records that the action at labelIndex and actionIndex got as far as
+// the page pageToken returns, up to and including lastMessage.
+func (c *checkpointer) save(labelIndex, actionIndex int, pageToken, lastMessage string) error {
+	if c == nil {
+		return nil
+	}
+	labelAction := c.config.LabelActions[labelIndex]
+	data, err := json.MarshalIndent(checkpoint{
+		User:        c.user,
+		LabelIndex:  labelIndex,
+		ActionIndex: actionIndex,
+		Label:       labelAction.Label,
+		Query:       actionQuery(labelAction.Label, labelAction.Actions[actionIndex]),
+		PageToken:   pageToken,
+		LastMessage: lastMessage,
+		Updated:     time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(c.path, data, 0600)
+}
+
+// done records that the action at labelIndex and actionIndex is complete,
+// by saving the start of the next action as the checkpoint.
+func (c *checkpointer) done(labelIndex, actionIndex int) error {
+	if c == nil {
+		return nil
+	}
+	if actionIndex+1 < len(c.config.LabelActions[labelIndex].Actions) {
+		return c.save(labelIndex, actionIndex+1, "", "")
+	}
+	for next := labelIndex + 1; next < len(c.config.LabelActions); next++ {
+		if len(c.config.LabelActions[next].Actions) > 0 {
+			return c.save(next, 0, "", "")
+		}
+	}
+	return c.clear() // the run is complete
+}
+
+// clear removes the checkpoint once the run is complete.
+func (c *checkpointer) clear() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
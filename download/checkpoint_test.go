@@ -0,0 +1,158 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func checkpointConfig() *Config {
+	return &Config{LabelActions: []LabelAction{
+		{Label: "INBOX", Actions: []Action{{SubjectFilter: "a"}, {SubjectFilter: "b"}}},
+		{Label: "Bank", Actions: []Action{{SubjectFilter: "statement"}}},
+	}}
+}
+
+func TestCheckpointer_SaveAndResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	config := checkpointConfig()
+	captureLog(t)
+
+	cp, err := newCheckpointer(path, "me", config, slog.Default())
+	if err != nil || cp.resume != nil {
+		t.Fatalf("newCheckpointer() without a file = %+v, %v", cp, err)
+	}
+	if err := cp.save(0, 1, "tok", "m07"); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	cp, err = newCheckpointer(path, "me", config, slog.Default())
+	if err != nil || cp.resume == nil {
+		t.Fatalf("newCheckpointer() = %+v, %v, want a checkpoint to resume from", cp, err)
+	}
+	if cp.skipLabel(0) {
+		t.Errorf("skipLabel(0) = true, want false: the label is not done")
+	}
+	if skip, _, _ := cp.resumeAt(0, 0); !skip {
+		t.Errorf("resumeAt(0, 0) does not skip the action done before the interruption")
+	}
+	if skip, token, last := cp.resumeAt(0, 1); skip || token != "tok" || last != "m07" {
+		t.Errorf("resumeAt(0, 1) = %v, %q, %q, want to resume at tok after m07", skip, token, last)
+	}
+	if skip, token, _ := cp.resumeAt(1, 0); skip || token != "" {
+		t.Errorf("resumeAt(1, 0) = %v, %q, want a fresh start", skip, token)
+	}
+
+	// Completing an action moves the checkpoint to the next one; completing
+	// the last removes it.
+	if err := cp.done(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	cp, _ = newCheckpointer(path, "me", config, slog.Default())
+	if !cp.skipLabel(0) || cp.resume.Label != "Bank" || cp.resume.PageToken != "" {
+		t.Errorf("after done(0, 1) the checkpoint is %+v, want the start of Bank", cp.resume)
+	}
+	if err := cp.done(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint still exists after the last action: %v", err)
+	}
+}
+
+func TestCheckpointer_Mismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, _ := newCheckpointer(path, "me", checkpointConfig(), slog.Default())
+	if err := cp.save(1, 0, "tok", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := checkpointConfig()
+	changed.LabelActions[1].Actions[0].SubjectFilter = "invoice"
+	for name, tt := range map[string]struct {
+		user   string
+		config *Config
+		want   string
+	}{
+		"other user":     {"other", checkpointConfig(), "for user me"},
+		"changed action": {"me", changed, "config has changed"},
+		"fewer labels":   {"me", &Config{LabelActions: checkpointConfig().LabelActions[:1]}, "config has changed"},
+	} {
+		logs := captureLog(t)
+		cp, err := newCheckpointer(path, tt.user, tt.config, slog.Default())
+		if err != nil || cp.resume != nil || !strings.Contains(logs.String(), tt.want) {
+			t.Errorf("%s: resume = %+v, %v, log:\n%s", name, cp.resume, err, logs)
+		}
+	}
+
+	if cp, err := newCheckpointer("", "me", checkpointConfig(), slog.Default()); cp != nil || err != nil {
+		t.Errorf("newCheckpointer(\"\") = %+v, %v, want checkpoints disabled", cp, err)
+	}
+}
+
+// cancelOnAttachment cancels the run, as SIGINT would, when the attachment
+// of the message id is requested.
+type cancelOnAttachment struct {
+	*FakeMail
+	id     string
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnAttachment) GetAttachment(ctx context.Context, messageID, attachmentID string, w io.Writer) (int64, error) {
+	if messageID == c.id {
+		c.cancel()
+		return 0, ctx.Err()
+	}
+	return c.FakeMail.GetAttachment(ctx, messageID, attachmentID, w)
+}
+
+func TestProcessLabel_InterruptAndResume(t *testing.T) {
+	fake, ids := newFakeInbox(12)
+	captureLog(t)
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	config := &Config{LabelActions: []LabelAction{{Label: "INBOX", Actions: []Action{{
+		Download: true, SaveTo: dir, MarkAsRead: true,
+	}}}}}
+
+	// Stop the run like SIGINT would while m07, on the second page, is
+	// being downloaded.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newMailClient(&cancelOnAttachment{FakeMail: fake, id: "m07", cancel: cancel}, "me", 0)
+	cp, _ := newCheckpointer(path, "me", config, slog.Default())
+	if err := testProcessor(client, 1).processLabel(ctx, 0, config.LabelActions[0], cp).Err(); err != nil {
+		t.Errorf("interrupted processLabel() error = %v, want no failures", err)
+	}
+	var saved checkpoint
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &saved); err != nil || saved.PageToken != "5" || saved.LastMessage != "m06" {
+		t.Fatalf("checkpoint = %s, %v, want page 5 after m06", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "m07.txt")); !os.IsNotExist(err) {
+		t.Errorf("m07.txt exists after its download was interrupted: %v", err)
+	}
+	if got := strings.Join(callsAbout(fake, "m06"), ","); got != "messages.get,messages.attachments.get,messages.modify" {
+		t.Errorf("calls for m06 = %s, want it marked as read despite the interruption", got)
+	}
+
+	cp, _ = newCheckpointer(path, "me", config, slog.Default())
+	if err := testProcessor(newFakeMailClient(fake), 1).processLabel(context.Background(), 0, config.LabelActions[0], cp).Err(); err != nil {
+		t.Fatalf("resumed processLabel() error = %v", err)
+	}
+	for _, id := range ids {
+		calls := callsAbout(fake, id)
+		modified := strings.Count(strings.Join(calls, ","), "messages.modify")
+		if _, err := os.Stat(filepath.Join(dir, id+".txt")); err != nil || modified != 1 {
+			t.Errorf("%s: saved: %v, marked as read %d times, want saved and marked once; calls %v", id, err, modified, calls)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint still exists after the run completed: %v", err)
+	}
+}
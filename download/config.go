@@ -0,0 +1,280 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type Config struct {
+	// Include lists further config files, directories or glob patterns whose
+	// label actions are added to this config. Relative paths are relative to
+	// the including file.
+	Include []string `json:"include"`
+	// Defaults are inherited by every action that does not set the key itself.
+	Defaults     Action        `json:"defaults"`
+	LabelActions []LabelAction `json:"label_actions"`
+	// Notifications are sent when runs complete or fail and when files are
+	// saved. Only those of the root file are used; included files add label
+	// actions only.
+	Notifications []Notification `json:"notifications"`
+}
+
+// LoadConfig reads and validates the action config. The format is chosen by
+// the file extension: .yaml/.yml for YAML, .toml for TOML and JSON otherwise.
+// Included files are merged in, defaults applied and ${...} references
+// expanded before validation, and secret references are resolved after it. Unknown keys, values of the wrong type and
+// semantic problems are all collected and returned together as ConfigErrors,
+// so that a bad config is rejected before any mail is touched.
+func LoadConfig(filename string) (*Config, error) {
+	config, _, err := LoadConfigFiles(filename)
+	return config, err
+}
+
+// LoadConfigFiles is LoadConfig, also returning the files the config was
+// read from: filename and every file it includes.
+func LoadConfigFiles(filename string) (*Config, []string, error) {
+	l := newConfigLoader()
+	doc, err := l.loadRoot(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]string, 0, len(l.loaded))
+	for file := range l.loaded {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var config Config
+	if err := doc.decode(&config); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return nil, files, fmt.Errorf("%s: %w", filename, err)
+		}
+		// Type mismatches were already reported when checking the files.
+	}
+
+	problems := l.problems
+	for _, p := range config.Validate() {
+		problems = append(problems, doc.locate(p))
+	}
+	secrets := newSecretResolver()
+	secrets.dir = func(path string) string {
+		return filepath.Dir(doc.locate(ConfigProblem{Path: path, File: filename}).File)
+	}
+	for _, p := range config.resolveSecrets(secrets) {
+		problems = append(problems, doc.locate(p))
+	}
+	for _, p := range config.derivePasswords() {
+		problems = append(problems, doc.locate(p))
+	}
+	if len(problems) > 0 {
+		return nil, files, ConfigErrors(problems).inFile(filename)
+	}
+	return &config, files, nil
+}
+
+// ConfigProblem is a single problem found in a config file.
+type ConfigProblem struct {
+	File   string
+	Line   int // 1-based, 0 if unknown
+	Column int // 1-based, 0 if unknown
+	// Path locates the offending value, e.g. label_actions[0].actions[1].save_to.
+	Path    string
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	var b strings.Builder
+	if p.File != "" {
+		b.WriteString(p.File)
+		b.WriteString(":")
+	}
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "%d:", p.Line)
+		if p.Column > 0 {
+			fmt.Fprintf(&b, "%d:", p.Column)
+		}
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path)
+		b.WriteString(": ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// ConfigErrors lists every problem found in a config, in file order.
+type ConfigErrors []ConfigProblem
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, p := range e {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// inFile sets the file of every problem not yet attributed to one and sorts
+// them by file and position.
+func (e ConfigErrors) inFile(file string) ConfigErrors {
+	for i := range e {
+		if e[i].File == "" {
+			e[i].File = file
+		}
+	}
+	sort.SliceStable(e, func(i, j int) bool {
+		if e[i].File != e[j].File {
+			return e[i].File == file || (e[j].File != file && e[i].File < e[j].File)
+		}
+		if e[i].Line != e[j].Line {
+			return e[i].Line < e[j].Line
+		}
+		return e[i].Column < e[j].Column
+	})
+	return e
+}
+
+// filenamePlaceholder matches {name} placeholders in filename_pattern, and the
+// {{name}} form people tend to write by mistake.
+var filenamePlaceholder = regexp.MustCompile(`\{+[^{}]*\}+`)
+
+// knownPlaceholders are the placeholders formatFilename substitutes.
+var knownPlaceholders = map[string]bool{
+	"{original}": true,
+	"{date}":     true,
+}
+
+// Validate checks the config for semantic problems: missing values, invalid
+// regular expressions and settings that only make sense together. Every
+// problem is returned, with Path set but no position.
+func (c *Config) Validate() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(c.LabelActions) == 0 {
+		add("label_actions", "no label actions configured")
+	}
+	for i, labelAction := range c.LabelActions {
+		path := fmt.Sprintf("label_actions[%d]", i)
+		if labelAction.Label == "" {
+			add(path+".label", "label must not be empty")
+		}
+		if len(labelAction.Actions) == 0 {
+			add(path+".actions", "no actions configured for label %q", labelAction.Label)
+		}
+		for j, action := range labelAction.Actions {
+			for _, p := range action.validate() {
+				p.Path = fmt.Sprintf("%s.actions[%d]%s", path, j, p.Path)
+				problems = append(problems, p)
+			}
+		}
+		if labelAction.Schedule != nil {
+			for _, p := range labelAction.Schedule.validate() {
+				p.Path = path + ".schedule" + p.Path
+				problems = append(problems, p)
+			}
+		}
+	}
+	for i, n := range c.Notifications {
+		for _, p := range n.validate() {
+			p.Path = fmt.Sprintf("notifications[%d]%s", i, p.Path)
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// validate checks a single action. Paths in the returned problems are
+// relative to the action, starting with ".".
+func (a *Action) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(key, format string, args ...interface{}) {
+		path := ""
+		if key != "" {
+			path = "." + key
+		}
+		problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if !a.Download && !a.SaveAsPdf && !a.MarkAsRead && !a.Delete {
+		add("", "action does nothing: enable at least one of download_attachment, save_as_pdf, mark_as_read, delete_email")
+	}
+	if (a.Download || a.SaveAsPdf) && a.SaveTo == "" {
+		add("save_to", "save_to must be set when download_attachment or save_as_pdf is enabled")
+	}
+	if a.AttachmentNameFilter != "" {
+		if _, err := regexp.Compile(a.AttachmentNameFilter); err != nil {
+			add("attachment_name_filter", "invalid regular expression: %v", err)
+		}
+	}
+
+	for _, key := range []struct {
+		name string
+		set  bool
+	}{
+		{"pdf_password", a.PdfPassword.IsSet()},
+		{"pdf_passwords", len(a.PdfPasswords) > 0},
+		{"pdf_password_templates", len(a.PdfPasswordTemplates) > 0},
+		{"attachment_name_filter", a.AttachmentNameFilter != ""},
+		{"filename_pattern", a.FilenamePattern != ""},
+	} {
+		if key.set && !a.Download {
+			add(key.name, "%s has no effect without download_attachment", key.name)
+		}
+	}
+
+	for _, placeholder := range filenamePlaceholder.FindAllString(a.FilenamePattern, -1) {
+		if !knownPlaceholders[placeholder] {
+			add("filename_pattern", "unknown placeholder %s (supported: {original}, {date})", placeholder)
+		}
+	}
+	if strings.ContainsAny(a.FilenamePattern, `/\`) {
+		add("filename_pattern", "filename_pattern must not contain path separators")
+	}
+	if a.EncryptPdf != nil {
+		if !a.Download && !a.SaveAsPdf {
+			add("encrypt_pdf", "encrypt_pdf has no effect without download_attachment or save_as_pdf")
+		}
+		for _, p := range a.EncryptPdf.validate() {
+			problems = append(problems, ConfigProblem{Path: ".encrypt_pdf" + p.Path, Message: p.Message})
+		}
+	}
+	for i, text := range a.PdfPasswordTemplates {
+		if _, err := parsePasswordTemplate(text); err != nil {
+			add(fmt.Sprintf("pdf_password_templates[%d]", i), "invalid template: %v", err)
+		}
+	}
+	return problems
+}
+
+// CheckSaveDirs reports every save_to directory that storage cannot save
+// to, such as one that is missing or is not a directory. It is kept separate
+// from Validate because it depends on where the config runs rather than on
+// the config itself.
+func CheckSaveDirs(c *Config, storage Storage) []ConfigProblem {
+	var problems []ConfigProblem
+	seen := make(map[string]bool)
+	for _, labelAction := range c.LabelActions {
+		for _, action := range labelAction.Actions {
+			dir := action.SaveTo
+			if dir == "" || seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			if err := storage.CheckDir(dir); err != nil {
+				problems = append(problems, ConfigProblem{Message: fmt.Sprintf("save_to directory of label %q is not usable: %v", labelAction.Label, err)})
+			}
+		}
+	}
+	return problems
+}
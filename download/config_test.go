@@ -0,0 +1,278 @@
+package download
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// configProblems loads content as a config and returns the problems found.
+func configProblems(t *testing.T, content string) ConfigErrors {
+	t.Helper()
+	_, err := LoadConfig(writeConfig(t, "config.json", content))
+	if err == nil {
+		return nil
+	}
+	var problems ConfigErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("LoadConfig() error = %v, want ConfigErrors", err)
+	}
+	return problems
+}
+
+func TestLoadConfig_UnknownKeys(t *testing.T) {
+	problems := configProblems(t, `{
+  "label_actions": [
+    {
+      "label": "INBOX",
+      "actions": [
+        {
+          "download_attachment": true,
+          "saveTo": "/tmp",
+          "email_id": "x"
+        }
+      ]
+    }
+  ]
+}`)
+
+	want := []string{
+		`8:11: label_actions[0].actions[0].saveTo: unknown key "saveTo", did you mean "save_to"?`,
+		`9:11: label_actions[0].actions[0].email_id: unknown key "email_id"`,
+	}
+	if len(problems) != 3 {
+		t.Fatalf("LoadConfig() problems = %v, want 3", problems)
+	}
+	// The missing save_to is reported at the action object itself
+	if problems[0].Line != 6 || !strings.Contains(problems[0].Message, "save_to must be set") {
+		t.Errorf("problem[0] = %v, want missing save_to at line 6", problems[0])
+	}
+	for i, p := range problems[1:] {
+		if !strings.HasSuffix(p.String(), want[i]) {
+			t.Errorf("problem[%d] = %q, want suffix %q", i+1, p.String(), want[i])
+		}
+	}
+}
+
+func TestLoadConfig_TypeErrors(t *testing.T) {
+	problems := configProblems(t, `{"label_actions": [{"label": "INBOX", "actions": [
+	{"download_attachment": "yes", "mark_as_read": true},
+	{"mark_as_read": true, "save_to": 5}
+]}]}`)
+
+	if len(problems) != 2 {
+		t.Fatalf("LoadConfig() problems = %v, want 2", problems)
+	}
+	if problems[0].Line != 2 || problems[0].Path != "label_actions[0].actions[0].download_attachment" {
+		t.Errorf("problem[0] = %v, want download_attachment on line 2", problems[0])
+	}
+	if !strings.Contains(problems[1].Message, "expected a string, got a number") {
+		t.Errorf("problem[1] = %v, want string/number mismatch", problems[1])
+	}
+}
+
+func TestLoadConfig_SyntaxErrorPosition(t *testing.T) {
+	problems := configProblems(t, "{\n  \"label_actions\": [\n    {\"label\": \"INBOX\",}\n  ]\n}")
+	if len(problems) != 1 {
+		t.Fatalf("LoadConfig() problems = %v, want 1", problems)
+	}
+	if problems[0].Line != 3 {
+		t.Errorf("syntax error line = %d, want 3 (%v)", problems[0].Line, problems[0])
+	}
+}
+
+func TestActionValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		action Action
+		want   []string
+	}{
+		{
+			name:   "valid download",
+			action: Action{Download: true, SaveTo: "/tmp", AttachmentNameFilter: `\.pdf$`, FilenamePattern: "{date}_{original}"},
+		},
+		{
+			name:   "does nothing",
+			action: Action{SubjectFilter: "x"},
+			want:   []string{"action does nothing"},
+		},
+		{
+			name:   "invalid regex",
+			action: Action{Download: true, SaveTo: "/tmp", AttachmentNameFilter: "(*.pdf"},
+			want:   []string{"invalid regular expression"},
+		},
+		{
+			name:   "password without download",
+			action: Action{MarkAsRead: true, PdfPassword: secretValue("secret")},
+			want:   []string{"pdf_password has no effect without download_attachment"},
+		},
+		{
+			name:   "unknown placeholders",
+			action: Action{Download: true, SaveTo: "/tmp", FilenamePattern: "attachment_{{date}}_{email_id}"},
+			want:   []string{"unknown placeholder {{date}}", "unknown placeholder {email_id}"},
+		},
+		{
+			name:   "save as pdf without save_to",
+			action: Action{SaveAsPdf: true},
+			want:   []string{"save_to must be set"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.action.validate()
+			if len(problems) != len(tt.want) {
+				t.Fatalf("validate() = %v, want %d problem(s)", problems, len(tt.want))
+			}
+			for i, p := range problems {
+				if !strings.Contains(p.Message, tt.want[i]) {
+					t.Errorf("validate()[%d] = %q, want it to contain %q", i, p.Message, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConfigValidate_Empty(t *testing.T) {
+	problems := (&Config{LabelActions: []LabelAction{{Label: ""}}}).Validate()
+	if len(problems) != 2 {
+		t.Fatalf("Validate() = %v, want empty label and no actions", problems)
+	}
+	if problems[0].Path != "label_actions[0].label" || problems[1].Path != "label_actions[0].actions" {
+		t.Errorf("Validate() paths = %q, %q", problems[0].Path, problems[1].Path)
+	}
+}
+
+func TestCheckSaveDirs(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	config := &Config{LabelActions: []LabelAction{{Label: "INBOX", Actions: []Action{
+		{Download: true, SaveTo: tmpDir},
+		{Download: true, SaveTo: filepath.Join(tmpDir, "missing")},
+		{Download: true, SaveTo: file},
+	}}}}
+	if problems := CheckSaveDirs(config, LocalStorage{}); len(problems) != 2 {
+		t.Errorf("CheckSaveDirs() = %v, want 2 problems", problems)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	// Create a temporary config file
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.json")
+
+	configJSON := `{
+		"label_actions": [
+			{
+				"label": "INBOX",
+				"actions": [
+					{
+						"subject_filter": "Test",
+						"download_attachment": true,
+						"mark_as_read": false,
+						"delete_email": false,
+						"save_to": "/tmp/test"
+					}
+				]
+			}
+		]
+	}`
+
+	if err := os.WriteFile(configFile, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	// Test loading config
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v, want nil", err)
+	}
+
+	if config == nil {
+		t.Fatal("LoadConfig() config = nil, want non-nil")
+	}
+
+	if len(config.LabelActions) != 1 {
+		t.Errorf("LoadConfig() LabelActions length = %d, want 1", len(config.LabelActions))
+	}
+
+	if config.LabelActions[0].Label != "INBOX" {
+		t.Errorf("LoadConfig() Label = %v, want INBOX", config.LabelActions[0].Label)
+	}
+
+	if len(config.LabelActions[0].Actions) != 1 {
+		t.Errorf("LoadConfig() Actions length = %d, want 1", len(config.LabelActions[0].Actions))
+	}
+
+	action := config.LabelActions[0].Actions[0]
+	if action.SubjectFilter != "Test" {
+		t.Errorf("LoadConfig() SubjectFilter = %v, want Test", action.SubjectFilter)
+	}
+	if !action.Download {
+		t.Errorf("LoadConfig() Download = %v, want true", action.Download)
+	}
+}
+
+func TestLoadConfig_NotFound(t *testing.T) {
+	// Test with non-existent file
+	config, err := LoadConfig("nonexistent.json")
+	if err == nil {
+		t.Error("LoadConfig() error = nil, want error")
+	}
+	if config != nil {
+		t.Errorf("LoadConfig() config = %v, want nil", config)
+	}
+}
+
+func TestLoadConfig_InvalidJSON(t *testing.T) {
+	// Create a temporary file with invalid JSON
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "invalid.json")
+
+	if err := os.WriteFile(configFile, []byte("invalid json"), 0644); err != nil {
+		t.Fatalf("Failed to write invalid config file: %v", err)
+	}
+
+	// Test loading invalid config
+	config, err := LoadConfig(configFile)
+	if err == nil {
+		t.Error("LoadConfig() error = nil, want error for invalid JSON")
+	}
+	if config != nil {
+		t.Errorf("LoadConfig() config = %v, want nil", config)
+	}
+}
+
+func TestLoadConfig_EmptyFile(t *testing.T) {
+	// Create an empty file
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "empty.json")
+
+	if err := os.WriteFile(configFile, []byte(""), 0644); err != nil {
+		t.Fatalf("Failed to write empty config file: %v", err)
+	}
+
+	// Test loading empty config
+	config, err := LoadConfig(configFile)
+	if err == nil {
+		t.Error("LoadConfig() error = nil, want error for empty file")
+	}
+	if config != nil {
+		t.Errorf("LoadConfig() config = %v, want nil", config)
+	}
+}
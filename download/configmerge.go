@@ -0,0 +1,366 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configLoader reads a config file together with everything it includes and
+// merges them into a single document. Problems in any of the files are
+// collected, each attributed to the file it was found in.
+type configLoader struct {
+	problems []ConfigProblem
+	loaded   map[string]bool // absolute paths of every file read so far
+	stack    []string        // absolute paths of the files being included
+}
+
+// configDefault is an inherited action key and where it was set.
+type configDefault struct {
+	value interface{}
+	pos   position
+	found bool
+}
+
+// labelEntry is one label action of a file, with the positions of its values
+// relative to the label action itself ("", ".label", ".actions[0]", ...).
+type labelEntry struct {
+	value     interface{}
+	positions map[string]position
+}
+
+func newConfigLoader() *configLoader {
+	return &configLoader{loaded: make(map[string]bool)}
+}
+
+// loadRoot loads filename and its includes. Errors reading or parsing the
+// root file itself are returned directly; every other problem is collected in
+// l.problems.
+func (l *configLoader) loadRoot(filename string) (*configDoc, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseConfigData(configFormat(filename), data)
+	if err != nil {
+		var problems ConfigErrors
+		if errors.As(err, &problems) {
+			return nil, problems.inFile(filename)
+		}
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	entries := l.load(filename, doc, nil)
+
+	merged := &configDoc{positions: make(map[string]position)}
+	for path, pos := range doc.positions {
+		if !strings.HasPrefix(path, "label_actions[") {
+			merged.positions[path] = pos
+		}
+	}
+	root, ok := doc.value.(map[string]interface{})
+	if !ok {
+		merged.value = doc.value
+		return merged, nil
+	}
+	value := make(map[string]interface{}, len(root)+1)
+	for k, v := range root {
+		value[k] = v
+	}
+	if _, ok := root["label_actions"]; ok || len(entries) > 0 {
+		list := make([]interface{}, len(entries))
+		for i, entry := range entries {
+			list[i] = entry.value
+			base := fmt.Sprintf("label_actions[%d]", i)
+			for rel, pos := range entry.positions {
+				merged.positions[base+rel] = pos
+			}
+		}
+		value["label_actions"] = list
+	}
+	merged.value = value
+	return merged, nil
+}
+
+// load checks and expands a parsed file, applies defaults to its actions and
+// returns its label actions followed by those of the files it includes.
+// inherited holds the defaults of the including file.
+func (l *configLoader) load(filename string, doc *configDoc, inherited map[string]configDefault) []labelEntry {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		abs = filename
+	}
+	l.loaded[abs] = true
+	l.stack = append(l.stack, abs)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	for path, pos := range doc.positions {
+		pos.file = filename
+		doc.positions[path] = pos
+	}
+	l.problems = append(l.problems, doc.check(reflect.TypeOf(Config{}))...)
+	doc.value = l.expandValue(doc, doc.value, "", filepath.Dir(filename))
+
+	root, ok := doc.value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	fileDefaults := doc.mergeDefaults(inherited, root["defaults"], "defaults")
+	var entries []labelEntry
+	labelActions, _ := root["label_actions"].([]interface{})
+	for i, la := range labelActions {
+		base := fmt.Sprintf("label_actions[%d]", i)
+		if m, ok := la.(map[string]interface{}); ok {
+			labelDefaults := doc.mergeDefaults(fileDefaults, m["defaults"], base+".defaults")
+			actions, _ := m["actions"].([]interface{})
+			for j, action := range actions {
+				doc.applyDefaults(action, fmt.Sprintf("%s.actions[%d]", base, j), labelDefaults)
+			}
+		}
+		entries = append(entries, labelEntry{value: la, positions: doc.subtree(base)})
+	}
+
+	includes, _ := root["include"].([]interface{})
+	for i, include := range includes {
+		pattern, ok := include.(string)
+		if !ok {
+			continue
+		}
+		path := fmt.Sprintf("include[%d]", i)
+		files, err := includeFiles(filepath.Dir(filename), pattern)
+		if err != nil {
+			l.problems = append(l.problems, doc.locate(ConfigProblem{Path: path, Message: err.Error()}))
+			continue
+		}
+		for _, file := range files {
+			entries = append(entries, l.include(doc, path, file, fileDefaults)...)
+		}
+	}
+	return entries
+}
+
+// include loads a single included file. Files already loaded elsewhere are
+// skipped; including a file that is still being loaded is reported as a cycle.
+func (l *configLoader) include(doc *configDoc, path, file string, defaults map[string]configDefault) []labelEntry {
+	problem := func(format string, args ...interface{}) {
+		l.problems = append(l.problems, doc.locate(ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)}))
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+	for _, open := range l.stack {
+		if open == abs {
+			problem("include cycle: %s includes itself", file)
+			return nil
+		}
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		problem("cannot include: %v", err)
+		return nil
+	}
+	included, err := parseConfigData(configFormat(file), data)
+	if err != nil {
+		var problems ConfigErrors
+		if !errors.As(err, &problems) {
+			problem("cannot include %s: %v", file, err)
+			return nil
+		}
+		for _, p := range problems {
+			p.File = file
+			l.problems = append(l.problems, p)
+		}
+		return nil
+	}
+	return l.load(file, included, defaults)
+}
+
+// includeFiles resolves an include entry relative to dir. A directory
+// includes every config file in it and a pattern every file it matches, both
+// in name order.
+func includeFiles(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern: %v", err)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot include: %v", err)
+	}
+	if !info.IsDir() {
+		return []string{pattern}, nil
+	}
+	dirEntries, err := os.ReadDir(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot include: %v", err)
+	}
+	var files []string
+	for _, e := range dirEntries {
+		switch filepath.Ext(e.Name()) {
+		case ".json", ".yaml", ".yml", ".toml":
+			if !e.IsDir() {
+				files = append(files, filepath.Join(pattern, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// mergeDefaults returns inherited overridden by the keys of the defaults
+// object at path.
+func (d *configDoc) mergeDefaults(inherited map[string]configDefault, defaults interface{}, path string) map[string]configDefault {
+	m, ok := defaults.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return inherited
+	}
+	merged := make(map[string]configDefault, len(inherited)+len(m))
+	for k, v := range inherited {
+		merged[k] = v
+	}
+	for k, v := range m {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		pos, found := d.positions[joinPath(path, k)]
+		merged[k] = configDefault{value: v, pos: pos, found: found}
+	}
+	return merged
+}
+
+// applyDefaults sets every default key the action at path does not set
+// itself. Keys set explicitly, even to false or "", are left alone. The
+// inherited values keep the position of the defaults they came from.
+func (d *configDoc) applyDefaults(action interface{}, path string, defaults map[string]configDefault) {
+	m, ok := action.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for k, def := range defaults {
+		if _, set := m[k]; set {
+			continue
+		}
+		m[k] = def.value
+		if def.found {
+			d.positions[joinPath(path, k)] = def.pos
+		}
+	}
+}
+
+// subtree returns the positions under base, keyed relative to it.
+func (d *configDoc) subtree(base string) map[string]position {
+	positions := make(map[string]position)
+	for path, pos := range d.positions {
+		if rel := strings.TrimPrefix(path, base); rel != path && (rel == "" || rel[0] == '.' || rel[0] == '[') {
+			positions[rel] = pos
+		}
+	}
+	return positions
+}
+
+// expandValue expands ${...} references in every string value of v. Problems
+// are recorded at the path of the string and the string is left unchanged.
+func (l *configLoader) expandValue(doc *configDoc, v interface{}, path, dir string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = l.expandValue(doc, item, joinPath(path, k), dir)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = l.expandValue(doc, item, fmt.Sprintf("%s[%d]", path, i), dir)
+		}
+	case string:
+		s, err := expandString(v, dir)
+		if err != nil {
+			l.problems = append(l.problems, doc.locate(ConfigProblem{Path: path, Message: err.Error()}))
+			return v
+		}
+		return s
+	}
+	return v
+}
+
+// expandString replaces ${NAME} with the environment variable NAME,
+// ${NAME:-default} with NAME or default when NAME is unset or empty, and
+// ${file:path} with the content of the file without its trailing newline.
+// Relative file paths are relative to dir. $${ stands for a literal ${.
+func expandString(s, dir string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s[i:])
+		}
+		ref := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		value, err := resolveReference(ref, dir)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+}
+
+func resolveReference(ref, dir string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		if path == "" {
+			return "", fmt.Errorf("${file:} needs a path")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("${file:...}: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	name, fallback, hasDefault := strings.Cut(ref, ":-")
+	if name == "" || strings.ContainsAny(name, " \t$") {
+		return "", fmt.Errorf("invalid reference ${%s}", ref)
+	}
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return fallback, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set (use ${%s:-default} for an optional value)", name, name)
+	}
+	return value, nil
+}
@@ -0,0 +1,207 @@
+package download
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes each name/content pair under dir, creating directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestLoadConfig_IncludesAndDefaults(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.yaml": `
+include: [conf.d, extra.toml]
+defaults:
+  save_to: /srv/mail
+  mark_as_read: true
+label_actions:
+  - label: INBOX
+    actions:
+      - download_attachment: true
+`,
+		"conf.d/10-bank.json": `{
+  "defaults": {"pdf_password": "secret"},
+  "label_actions": [{"label": "Bank", "actions": [{"download_attachment": true}]}]
+}`,
+		"conf.d/20-news.yaml": `
+label_actions:
+  - label: News
+    defaults: {delete_email: true}
+    actions:
+      - mark_as_read: false
+`,
+		"conf.d/notes.txt": `not a config`,
+		"extra.toml": `
+[[label_actions]]
+label = "Receipts"
+[[label_actions.actions]]
+save_as_pdf = true
+save_to = "/srv/receipts"
+`,
+	})
+
+	config, err := LoadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	var labels []string
+	for _, la := range config.LabelActions {
+		labels = append(labels, la.Label)
+	}
+	if got := strings.Join(labels, ","); got != "INBOX,Bank,News,Receipts" {
+		t.Fatalf("labels = %s, want INBOX,Bank,News,Receipts", got)
+	}
+
+	inbox := config.LabelActions[0].Actions[0]
+	if inbox.SaveTo != "/srv/mail" || !inbox.MarkAsRead {
+		t.Errorf("INBOX action = %+v, want the file defaults", inbox)
+	}
+	bank := config.LabelActions[1].Actions[0]
+	if bank.SaveTo != "/srv/mail" || bank.PdfPassword.Reveal() != "secret" {
+		t.Errorf("Bank action = %+v, want inherited save_to and its own file's pdf_password", bank)
+	}
+	news := config.LabelActions[2].Actions[0]
+	if news.MarkAsRead || !news.Delete {
+		t.Errorf("News action = %+v, want explicit mark_as_read false and label default delete", news)
+	}
+	receipts := config.LabelActions[3].Actions[0]
+	if receipts.SaveTo != "/srv/receipts" {
+		t.Errorf("Receipts save_to = %q, want its own value", receipts.SaveTo)
+	}
+}
+
+func TestLoadConfig_IncludeProblems(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.json": `{
+  "include": ["a.json", "missing.json"],
+  "label_actions": [{"label": "INBOX", "actions": [{"mark_as_read": true}]}]
+}`,
+		"a.json": `{
+  "include": ["config.json"],
+  "label_actions": [{"label": "A", "actions": [
+    {"download_attachment": true, "colour": "red"}
+  ]}]
+}`,
+	})
+
+	_, err := LoadConfig(filepath.Join(dir, "config.json"))
+	var problems ConfigErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("LoadConfig() error = %v, want ConfigErrors", err)
+	}
+
+	root, included := filepath.Join(dir, "config.json"), filepath.Join(dir, "a.json")
+	want := []struct {
+		file    string
+		line    int
+		message string
+	}{
+		{root, 2, "missing.json"},
+		{included, 2, "include cycle"},
+		{included, 4, "save_to must be set"},
+		{included, 4, `unknown key "colour"`},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("LoadConfig() problems =\n%v\nwant %d", problems, len(want))
+	}
+	for i, w := range want {
+		p := problems[i]
+		if p.File != w.file || p.Line != w.line || !strings.Contains(p.Message, w.message) {
+			t.Errorf("problem[%d] = %v, want %s:%d %q", i, p, w.file, w.line, w.message)
+		}
+	}
+}
+
+func TestLoadConfig_DefaultPosition(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.yaml": `
+defaults:
+  attachment_name_filter: "(unclosed"
+label_actions:
+  - label: INBOX
+    actions:
+      - download_attachment: true
+        save_to: /tmp
+`,
+	})
+
+	_, err := LoadConfig(filepath.Join(dir, "config.yaml"))
+	var problems ConfigErrors
+	if !errors.As(err, &problems) || len(problems) != 1 {
+		t.Fatalf("LoadConfig() error = %v, want one problem", err)
+	}
+	// An inherited value is reported where the default was set
+	if problems[0].Line != 3 || problems[0].Path != "label_actions[0].actions[0].attachment_name_filter" {
+		t.Errorf("problem = %v, want the default on line 3", problems[0])
+	}
+}
+
+func TestExpandString(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"password": "hunter2\n"})
+	t.Setenv("GMAIL_TEST_DIR", "/srv/mail")
+	t.Setenv("GMAIL_TEST_EMPTY", "")
+	os.Unsetenv("GMAIL_TEST_UNSET")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "plain", want: "plain"},
+		{in: "${GMAIL_TEST_DIR}/bank", want: "/srv/mail/bank"},
+		{in: "${GMAIL_TEST_UNSET:-/tmp}", want: "/tmp"},
+		{in: "${GMAIL_TEST_EMPTY:-fallback}", want: "fallback"},
+		{in: "${GMAIL_TEST_EMPTY}", want: ""},
+		{in: "${file:password}", want: "hunter2"},
+		{in: "${file:" + filepath.Join(dir, "password") + "}", want: "hunter2"},
+		{in: "$${GMAIL_TEST_DIR}", want: "${GMAIL_TEST_DIR}"},
+		{in: "${GMAIL_TEST_UNSET}", wantErr: true},
+		{in: "${file:missing}", wantErr: true},
+		{in: "${GMAIL_TEST_DIR", wantErr: true},
+		{in: "${}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := expandString(tt.in, dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandString(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("expandString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Interpolation(t *testing.T) {
+	os.Unsetenv("GMAIL_TEST_UNSET")
+	t.Setenv("GMAIL_TEST_LABEL", "Receipts")
+	problems := configProblems(t, `{"label_actions": [{"label": "${GMAIL_TEST_LABEL}", "actions": [
+	{"download_attachment": true, "save_to": "${GMAIL_TEST_UNSET}"}
+]}]}`)
+
+	if len(problems) != 1 || problems[0].Line != 2 || !strings.Contains(problems[0].Message, "GMAIL_TEST_UNSET is not set") {
+		t.Errorf("LoadConfig() problems = %v, want unset variable on line 2", problems)
+	}
+}
@@ -0,0 +1,585 @@
+package download
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported config file formats.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+// configFormat picks the format of a config file from its extension,
+// defaulting to JSON.
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	}
+	return formatJSON
+}
+
+// position is a 1-based line and column in a config file.
+type position struct {
+	file         string
+	line, column int
+}
+
+// configDoc is a parsed config file: its content as plain maps, lists and
+// scalars, independent of the file format, and the position of every value
+// by path, so problems can point back at the source.
+type configDoc struct {
+	value     interface{}
+	positions map[string]position
+}
+
+// parseConfigData parses data in the given format. Syntax errors are returned
+// as ConfigErrors carrying the line and column when the parser reports them.
+func parseConfigData(format string, data []byte) (*configDoc, error) {
+	switch format {
+	case formatYAML:
+		return parseYAMLConfig(data)
+	case formatTOML:
+		return parseTOMLConfig(data)
+	}
+	return parseJSONConfig(data)
+}
+
+// decode stores the document in v. The document goes through encoding/json so
+// that every format is decoded by the same json struct tags and Unmarshal
+// methods.
+func (d *configDoc) decode(v interface{}) error {
+	data, err := json.Marshal(d.value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// locate sets the line and column of p from its path, falling back to the
+// closest enclosing value when the path itself is absent (e.g. a required key
+// that is missing).
+func (d *configDoc) locate(p ConfigProblem) ConfigProblem {
+	path := p.Path
+	for {
+		if pos, ok := d.positions[path]; ok {
+			p.Line, p.Column = pos.line, pos.column
+			if pos.file != "" {
+				p.File = pos.file
+			}
+			return p
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return p
+		}
+		path = path[:i]
+	}
+}
+
+// check compares the document with the Go type t and reports each unknown
+// key and each value of the wrong kind. Keys starting with "x-" are ignored
+// anywhere, so they can hold YAML anchors or notes.
+func (d *configDoc) check(t reflect.Type) []ConfigProblem {
+	var problems []ConfigProblem
+	d.checkValue(d.value, "", t, &problems)
+	return problems
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func (d *configDoc) checkValue(v interface{}, path string, t reflect.Type, problems *[]ConfigProblem) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if v == nil || t == nil || t.Kind() == reflect.Interface ||
+		reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+	problem := func(got string) {
+		*problems = append(*problems, d.locate(ConfigProblem{
+			Path:    path,
+			Message: fmt.Sprintf("expected %s, got %s", kindName(t), got),
+		}))
+	}
+
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		// encoding/json only hands strings to UnmarshalText.
+		if _, ok := v.(string); !ok {
+			problem(describeValue(v))
+		}
+		return
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(t)
+			for _, key := range sortedKeys(v) {
+				if strings.HasPrefix(key, "x-") {
+					continue
+				}
+				field, ok := fields[key]
+				if !ok {
+					*problems = append(*problems, d.locate(ConfigProblem{
+						Path:    joinPath(path, key),
+						Message: fmt.Sprintf("unknown key %q%s", key, suggestKey(key, fields)),
+					}))
+					continue
+				}
+				d.checkValue(v[key], joinPath(path, key), field, problems)
+			}
+		case reflect.Map:
+			for _, key := range sortedKeys(v) {
+				d.checkValue(v[key], joinPath(path, key), t.Elem(), problems)
+			}
+		default:
+			problem("an object")
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			problem("a list")
+			return
+		}
+		for i, item := range v {
+			d.checkValue(item, fmt.Sprintf("%s[%d]", path, i), t.Elem(), problems)
+		}
+	case string:
+		if t.Kind() != reflect.String {
+			problem("a string")
+		}
+	case bool:
+		if t.Kind() != reflect.Bool {
+			problem("a boolean")
+		}
+	case json.Number, int, int64, uint64, float64:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			problem("a number")
+		}
+	default:
+		problem(fmt.Sprintf("a %T", v))
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonFields maps the JSON keys of struct t to the field types, following
+// embedded structs the way encoding/json does.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for k, v := range jsonFields(ft) {
+					fields[k] = v
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// suggestKey returns a hint naming a known key that differs from key only in
+// case or separators, as in "saveTo" for "save_to".
+func suggestKey(key string, fields map[string]reflect.Type) string {
+	norm := func(s string) string {
+		return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(s))
+	}
+	for known := range fields {
+		if norm(known) == norm(key) {
+			return fmt.Sprintf(", did you mean %q?", known)
+		}
+	}
+	return ""
+}
+
+func kindName(t reflect.Type) string {
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return "a string"
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	}
+	return "a number"
+}
+
+// describeValue names the kind of a parsed value, for messages.
+func describeValue(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number, int, int64, uint64, float64:
+		return "a number"
+	}
+	return fmt.Sprintf("a %T", v)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// lineColumn converts a byte offset in data to a 1-based line and column.
+func lineColumn(data []byte, offset int64) position {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	return position{
+		line:   bytes.Count(before, []byte("\n")) + 1,
+		column: int(offset) - bytes.LastIndexByte(before, '\n'),
+	}
+}
+
+func syntaxError(pos position, format string, args ...interface{}) error {
+	return ConfigErrors{{Line: pos.line, Column: pos.column, Message: fmt.Sprintf(format, args...)}}
+}
+
+// parseJSONConfig decodes JSON, recording the offset of every value by
+// walking the token stream.
+func parseJSONConfig(data []byte) (*configDoc, error) {
+	doc := &configDoc{positions: make(map[string]position)}
+	w := &jsonWalker{dec: json.NewDecoder(bytes.NewReader(data)), data: data, doc: doc}
+	w.dec.UseNumber()
+
+	err := w.walk("")
+	if err == nil {
+		if _, err = w.dec.Token(); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("unexpected data after the end of the config")
+		}
+	}
+	if err != nil {
+		var synErr *json.SyntaxError
+		switch {
+		case errors.As(err, &synErr):
+			return nil, syntaxError(lineColumn(data, synErr.Offset), "%v", err)
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			return nil, syntaxError(lineColumn(data, int64(len(data))), "unexpected end of file")
+		}
+		return nil, syntaxError(lineColumn(data, w.dec.InputOffset()), "%v", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc.value); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+type jsonWalker struct {
+	dec  *json.Decoder
+	data []byte
+	doc  *configDoc
+}
+
+// next returns the next token and where it starts.
+func (w *jsonWalker) next() (json.Token, position, error) {
+	// InputOffset is the end of the previous token; skip the separators to
+	// find the start of this one.
+	off := w.dec.InputOffset()
+	for off < int64(len(w.data)) && strings.IndexByte(" \t\r\n,:", w.data[off]) >= 0 {
+		off++
+	}
+	tok, err := w.dec.Token()
+	return tok, lineColumn(w.data, off), err
+}
+
+// walk consumes one JSON value and records where it starts. Object members
+// are recorded at their key, like the other formats do.
+func (w *jsonWalker) walk(path string) error {
+	tok, pos, err := w.next()
+	if err != nil {
+		return err
+	}
+	if _, ok := w.doc.positions[path]; !ok {
+		w.doc.positions[path] = pos
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for w.dec.More() {
+			key, pos, err := w.next()
+			if err != nil {
+				return err
+			}
+			child := joinPath(path, key.(string))
+			w.doc.positions[child] = pos
+			if err := w.walk(child); err != nil {
+				return err
+			}
+		}
+		_, err = w.dec.Token()
+	case json.Delim('['):
+		for i := 0; w.dec.More(); i++ {
+			if err := w.walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		_, err = w.dec.Token()
+	}
+	return err
+}
+
+// yamlLine extracts the line number from yaml.v3 error messages, which look
+// like "yaml: line 3: mapping values are not allowed in this context".
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// parseYAMLConfig decodes YAML, including anchors, aliases and "<<" merge
+// keys, taking positions from the node tree.
+func parseYAMLConfig(data []byte) (*configDoc, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, syntaxError(position{line: line}, "%s", m[2])
+		}
+		return nil, syntaxError(position{}, "%v", err)
+	}
+	if len(root.Content) == 0 {
+		return nil, syntaxError(position{}, "empty config")
+	}
+
+	doc := &configDoc{positions: make(map[string]position)}
+	yamlPositions(root.Content[0], "", doc.positions)
+
+	var value interface{}
+	if err := root.Decode(&value); err != nil {
+		return nil, syntaxError(position{}, "%v", err)
+	}
+	var err error
+	if doc.value, err = normalizeYAML(value, ""); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// yamlPositions records the position of n and everything below it. Keys
+// brought in by a merge only get the position of the anchor they came from
+// when the mapping does not set them itself.
+func yamlPositions(n *yaml.Node, path string, positions map[string]position) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if _, ok := positions[path]; !ok {
+		positions[path] = position{line: n.Line, column: n.Column}
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		var merges []*yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Value == "<<" && key.Tag == "!!merge" {
+				merges = append(merges, value)
+				continue
+			}
+			child := joinPath(path, key.Value)
+			positions[child] = position{line: key.Line, column: key.Column}
+			yamlPositions(value, child, positions)
+		}
+		for _, m := range merges {
+			if m.Kind == yaml.SequenceNode {
+				for _, item := range m.Content {
+					yamlPositions(item, path, positions)
+				}
+			} else {
+				yamlPositions(m, path, positions)
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			yamlPositions(item, fmt.Sprintf("%s[%d]", path, i), positions)
+		}
+	}
+}
+
+// normalizeYAML converts the maps yaml.v3 produces for non-string keys into
+// string-keyed maps, so the document can be encoded as JSON.
+func normalizeYAML(v interface{}, path string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			n, err := normalizeYAML(item, joinPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			v[k] = n
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			key := fmt.Sprint(k)
+			n, err := normalizeYAML(item, joinPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			m[key] = n
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range v {
+			n, err := normalizeYAML(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+// parseTOMLConfig decodes TOML. Positions come from a second pass over the
+// syntax tree, which has to replay how [[array tables]] number their entries.
+func parseTOMLConfig(data []byte) (*configDoc, error) {
+	var value map[string]interface{}
+	if err := toml.Unmarshal(data, &value); err != nil {
+		var decErr *toml.DecodeError
+		if errors.As(err, &decErr) {
+			row, column := decErr.Position()
+			return nil, syntaxError(position{line: row, column: column}, "%v", decErr)
+		}
+		return nil, syntaxError(position{}, "%v", err)
+	}
+
+	doc := &configDoc{value: value, positions: make(map[string]position)}
+	var p unstable.Parser
+	p.Reset(data)
+	tablePath := ""
+	arrayCounts := make(map[string]int)
+	for p.NextExpression() {
+		expr := p.Expression()
+		switch expr.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			path, pos := tomlKeyPath(&p, "", expr.Key(), arrayCounts)
+			if expr.Kind == unstable.ArrayTable {
+				arrayCounts[path]++
+				path = fmt.Sprintf("%s[%d]", path, arrayCounts[path]-1)
+			}
+			doc.positions[path] = pos
+			tablePath = path
+		case unstable.KeyValue:
+			tomlValuePositions(&p, tablePath, expr, doc.positions)
+		}
+	}
+	return doc, nil
+}
+
+// tomlKeyPath resolves a dotted key relative to base, inserting the index of
+// the latest entry wherever a prefix names an array of tables.
+func tomlKeyPath(p *unstable.Parser, base string, it unstable.Iterator, arrayCounts map[string]int) (string, position) {
+	path := base
+	var pos position
+	first := true
+	for it.Next() {
+		if n, ok := arrayCounts[path]; ok && path != base {
+			path = fmt.Sprintf("%s[%d]", path, n-1)
+		}
+		key := it.Node()
+		if first {
+			start := p.Shape(key.Raw).Start
+			pos = position{line: start.Line, column: start.Column}
+			first = false
+		}
+		path = joinPath(path, string(key.Data))
+	}
+	return path, pos
+}
+
+// tomlValuePositions records the position of a key = value expression and of
+// everything inside inline tables and arrays.
+func tomlValuePositions(p *unstable.Parser, base string, kv *unstable.Node, positions map[string]position) {
+	path, pos := tomlKeyPath(p, base, kv.Key(), nil)
+	positions[path] = pos
+	tomlNestedPositions(p, path, kv.Value(), positions)
+}
+
+func tomlNestedPositions(p *unstable.Parser, path string, n *unstable.Node, positions map[string]position) {
+	switch n.Kind {
+	case unstable.InlineTable:
+		it := n.Children()
+		for it.Next() {
+			tomlValuePositions(p, path, it.Node(), positions)
+		}
+	case unstable.Array:
+		it := n.Children()
+		for i := 0; it.Next(); i++ {
+			child := it.Node()
+			if child.Kind == unstable.Comment {
+				i--
+				continue
+			}
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if child.Raw.Length > 0 {
+				start := p.Shape(child.Raw).Start
+				positions[itemPath] = position{line: start.Line, column: start.Column}
+			}
+			tomlNestedPositions(p, itemPath, child, positions)
+		}
+	}
+}
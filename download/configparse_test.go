@@ -0,0 +1,139 @@
+package download
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestConfigFormat(t *testing.T) {
+	tests := map[string]string{
+		"config.json":   formatJSON,
+		"config.yaml":   formatYAML,
+		"config.YML":    formatYAML,
+		"config.toml":   formatTOML,
+		"config":        formatJSON,
+		"conf.d/a.conf": formatJSON,
+	}
+	for name, want := range tests {
+		if got := configFormat(name); got != want {
+			t.Errorf("configFormat(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfig_YAMLAnchors(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+# Shared settings for every bank statement
+x-statement: &statement
+  download_attachment: true
+  save_to: /tmp
+  attachment_name_filter: '\.pdf$'
+
+label_actions:
+  - label: Bank
+    actions:
+      - <<: *statement
+        subject_filter: HDFC
+        pdf_password: secret
+      - <<: *statement
+        subject_filter: ICICI
+        mark_as_read: true
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	actions := config.LabelActions[0].Actions
+	if len(actions) != 2 {
+		t.Fatalf("LoadConfig() actions = %d, want 2", len(actions))
+	}
+	for _, action := range actions {
+		if !action.Download || action.SaveTo != "/tmp" || action.AttachmentNameFilter != `\.pdf$` {
+			t.Errorf("action %+v did not inherit the anchored settings", action)
+		}
+	}
+	if actions[0].PdfPassword.Reveal() != "secret" || !actions[1].MarkAsRead {
+		t.Errorf("actions lost their own settings: %+v", actions)
+	}
+}
+
+func TestLoadConfig_YAMLProblems(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `label_actions:
+  - label: INBOX
+    actions:
+      - download_attachment: true
+        save_to: /tmp
+        delete: true
+`)
+	_, err := LoadConfig(path)
+	var problems ConfigErrors
+	if !errors.As(err, &problems) || len(problems) != 1 {
+		t.Fatalf("LoadConfig() error = %v, want one problem", err)
+	}
+	if p := problems[0]; p.Line != 6 || p.Column != 9 || !strings.Contains(p.Message, `unknown key "delete"`) {
+		t.Errorf("problem = %v, want unknown key at 6:9", p)
+	}
+
+	_, err = LoadConfig(writeConfig(t, "bad.yml", "label_actions:\n  - label: [INBOX\n"))
+	if !errors.As(err, &problems) || problems[0].Line == 0 {
+		t.Errorf("LoadConfig() of invalid YAML error = %v, want a located syntax error", err)
+	}
+}
+
+func TestLoadConfig_TOML(t *testing.T) {
+	path := writeConfig(t, "config.toml", `# Bank statements
+[[label_actions]]
+label = "Bank"
+
+[[label_actions.actions]]
+subject_filter = "HDFC"
+download_attachment = true
+save_to = "/tmp"
+
+[[label_actions.actions]]
+subject_filter = "ICICI"
+mark_as_read = true
+
+[[label_actions]]
+label = "Receipts"
+actions = [
+  { delete_email = true },
+  { mark_as_read = true, saveto = "/tmp" },
+]
+`)
+
+	_, err := LoadConfig(path)
+	var problems ConfigErrors
+	if !errors.As(err, &problems) || len(problems) != 1 {
+		t.Fatalf("LoadConfig() error = %v, want one problem", err)
+	}
+	p := problems[0]
+	if p.Path != "label_actions[1].actions[1].saveto" || p.Line != 18 {
+		t.Errorf("problem = %v, want saveto on line 18", p)
+	}
+
+	// Without the typo the same file loads
+	fixed := writeConfig(t, "fixed.toml", strings.Replace(mustReadString(t, path), `, saveto = "/tmp"`, "", 1))
+	config, err := LoadConfig(fixed)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if len(config.LabelActions) != 2 || len(config.LabelActions[0].Actions) != 2 || !config.LabelActions[1].Actions[0].Delete {
+		t.Errorf("LoadConfig() = %+v, want two labels with two actions each", config)
+	}
+}
+
+func TestLoadConfig_TOMLSyntaxError(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, "config.toml", "[[label_actions]]\nlabel = \n"))
+	var problems ConfigErrors
+	if !errors.As(err, &problems) || problems[0].Line != 2 {
+		t.Errorf("LoadConfig() error = %v, want syntax error on line 2", err)
+	}
+}
+
+func mustReadString(t *testing.T, path string) string {
+	t.Helper()
+	return string(mustReadFile(t, path))
+}
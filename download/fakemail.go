@@ -0,0 +1,785 @@
+package download
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// defaultFakePageSize is the number of messages or history records a page
+// of FakeMail holds, as many as Gmail returns by default.
+const defaultFakePageSize = 100
+
+// FakeMail is a MailService keeping a mailbox in memory, to test what uses
+// the tool without Gmail. Messages are added with AddMessage and searched
+// with the part of the Gmail search syntax the tool uses; every change is
+// recorded in the mailbox history. Errors are injected with Fail, and the
+// calls made are recorded for Calls. ServeHTTP serves the same mailbox as
+// the Gmail REST API. It is safe for concurrent use.
+type FakeMail struct {
+	// PageSize is the number of messages or history records per page;
+	// set it before use. 0 means defaultFakePageSize.
+	PageSize int
+
+	mu            sync.Mutex
+	email         string
+	labels        []*gmail.Label
+	messages      []*fakeMessage // in the order they were added
+	byID          map[string]*fakeMessage
+	nextID        int
+	history       []*gmail.History
+	historyID     uint64
+	oldestHistory uint64 // the history before this record has expired
+	watches       []*gmail.WatchRequest
+	failures      []*fakeFailure
+	calls         []string
+	searches      []string
+
+	fakeRoutes
+}
+
+// FakeMessage is a message of a FakeMail.
+type FakeMessage struct {
+	ID          string // assigned by AddMessage when empty
+	From        string
+	Subject     string
+	Date        time.Time // now when zero
+	Body        string
+	Labels      []string // label names, e.g. INBOX, UNREAD or Bank
+	Attachments []FakeAttachment
+}
+
+// FakeAttachment is an attachment of a FakeMessage.
+type FakeAttachment struct {
+	Filename string
+	MimeType string // application/octet-stream when empty
+	Data     []byte
+}
+
+type fakeMessage struct {
+	FakeMessage
+	labelIDs []string
+}
+
+type fakeFailure struct {
+	method, id string
+	err        error
+	times      int // < 0 for ever
+}
+
+// NewFakeMail returns an empty mailbox of email with the INBOX and UNREAD
+// system labels.
+func NewFakeMail(email string) *FakeMail {
+	return &FakeMail{
+		email:     email,
+		byID:      make(map[string]*fakeMessage),
+		historyID: 1,
+		labels: []*gmail.Label{
+			{Id: "INBOX", Name: "INBOX", Type: "system"},
+			{Id: "UNREAD", Name: "UNREAD", Type: "system"},
+		},
+	}
+}
+
+// CreateLabel adds a user label to the mailbox, unless there is one called
+// name already, and returns its ID.
+func (f *FakeMail) CreateLabel(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.labelID(name)
+}
+
+// labelID returns the ID of the label called name, creating it if need be.
+func (f *FakeMail) labelID(name string) string {
+	for _, l := range f.labels {
+		if strings.EqualFold(l.Name, name) {
+			return l.Id
+		}
+	}
+	id := fmt.Sprintf("Label_%d", len(f.labels)-1)
+	f.labels = append(f.labels, &gmail.Label{Id: id, Name: name, Type: "user"})
+	return id
+}
+
+// AddMessage delivers m to the mailbox, creating the labels it has, and
+// returns its ID.
+func (f *FakeMail) AddMessage(m FakeMessage) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if m.ID == "" {
+		f.nextID++
+		m.ID = fmt.Sprintf("%016x", f.nextID)
+	}
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+	fm := &fakeMessage{FakeMessage: m}
+	for _, name := range m.Labels {
+		fm.labelIDs = append(fm.labelIDs, f.labelID(name))
+	}
+	f.messages = append(f.messages, fm)
+	f.byID[m.ID] = fm
+	f.record(&gmail.History{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: fm.ref()}}})
+	return m.ID
+}
+
+// AddLabels applies labels to the message id, creating the labels that do
+// not exist, as a filter or the user would.
+func (f *FakeMail) AddLabels(id string, labels ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.byID[id]
+	if m == nil {
+		return notFound()
+	}
+	var ids []string
+	for _, name := range labels {
+		ids = append(ids, f.labelID(name))
+	}
+	f.modify(m, ids, nil)
+	return nil
+}
+
+// Message returns the message id as it is now, with the names of its
+// labels, and false if there is no such message.
+func (f *FakeMail) Message(id string) (FakeMessage, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.byID[id]
+	if m == nil {
+		return FakeMessage{}, false
+	}
+	out := m.FakeMessage
+	out.Labels = nil
+	for _, lid := range m.labelIDs {
+		out.Labels = append(out.Labels, f.labelName(lid))
+	}
+	return out, true
+}
+
+func (f *FakeMail) labelName(id string) string {
+	for _, l := range f.labels {
+		if l.Id == id {
+			return l.Name
+		}
+	}
+	return id
+}
+
+// Fail makes the next times calls of method fail with err, for ever if
+// times is negative. method is the name of the API method, as in the quota
+// report, such as messages.get; the batch request as a whole is "batch".
+// id, if not empty, limits the failures to the calls about that message.
+// Use a *googleapi.Error to fail as Gmail does: a 429 or 5xx code is
+// retried, other codes are not.
+func (f *FakeMail) Fail(method, id string, err error, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, &fakeFailure{method: method, id: id, err: err, times: times})
+}
+
+// ExpireHistory makes the history recorded so far unavailable, as Gmail
+// does after a week or so.
+func (f *FakeMail) ExpireHistory() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.oldestHistory = f.historyID
+}
+
+// Calls returns the calls made so far, in order, as the method name
+// followed by the message ID for calls about one message, e.g.
+// "messages.get 0000000000000001".
+func (f *FakeMail) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Searches returns the queries of the messages.list calls made so far, in
+// order.
+func (f *FakeMail) Searches() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.searches...)
+}
+
+// Watches returns the watch requests made so far.
+func (f *FakeMail) Watches() []*gmail.WatchRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*gmail.WatchRequest(nil), f.watches...)
+}
+
+// begin records a call of method about the message id, if any, and returns
+// the error injected for it. f.mu must be held.
+func (f *FakeMail) begin(m apiMethod, id string) error {
+	call := m.name
+	if id != "" {
+		call += " " + id
+	}
+	f.calls = append(f.calls, call)
+	return f.injected(m.name, id)
+}
+
+func (f *FakeMail) injected(method, id string) error {
+	for i, fail := range f.failures {
+		if fail.method != method || (fail.id != "" && fail.id != id) {
+			continue
+		}
+		if fail.times > 0 {
+			fail.times--
+			if fail.times == 0 {
+				f.failures = append(f.failures[:i], f.failures[i+1:]...)
+			}
+		}
+		return fail.err
+	}
+	return nil
+}
+
+// record adds a record to the mailbox history. f.mu must be held.
+func (f *FakeMail) record(h *gmail.History) {
+	f.historyID++
+	h.Id = f.historyID
+	for _, m := range h.MessagesAdded {
+		h.Messages = append(h.Messages, m.Message)
+	}
+	for _, m := range h.LabelsAdded {
+		h.Messages = append(h.Messages, m.Message)
+	}
+	for _, m := range h.LabelsRemoved {
+		h.Messages = append(h.Messages, m.Message)
+	}
+	for _, m := range h.MessagesDeleted {
+		h.Messages = append(h.Messages, m.Message)
+	}
+	f.history = append(f.history, h)
+}
+
+// ref returns the ID and labels of m, as history records them.
+func (m *fakeMessage) ref() *gmail.Message {
+	return &gmail.Message{Id: m.ID, ThreadId: m.ID, LabelIds: append([]string(nil), m.labelIDs...)}
+}
+
+func (m *fakeMessage) hasLabel(id string) bool {
+	for _, l := range m.labelIDs {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
+
+// modify adds and removes labels of m, recording the changes in the
+// history. f.mu must be held.
+func (f *FakeMail) modify(m *fakeMessage, add, remove []string) {
+	var added, removed []string
+	for _, id := range add {
+		if !m.hasLabel(id) {
+			m.labelIDs = append(m.labelIDs, id)
+			added = append(added, id)
+		}
+	}
+	for _, id := range remove {
+		if m.hasLabel(id) {
+			removed = append(removed, id)
+			kept := m.labelIDs[:0]
+			for _, l := range m.labelIDs {
+				if l != id {
+					kept = append(kept, l)
+				}
+			}
+			m.labelIDs = kept
+		}
+	}
+	if len(added) > 0 {
+		f.record(&gmail.History{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: m.ref(), LabelIds: added}}})
+	}
+	if len(removed) > 0 {
+		f.record(&gmail.History{LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: m.ref(), LabelIds: removed}}})
+	}
+}
+
+// checkLabels returns an error if one of ids is not a label of the mailbox.
+func (f *FakeMail) checkLabels(ids []string) error {
+	for _, id := range ids {
+		found := false
+		for _, l := range f.labels {
+			found = found || l.Id == id
+		}
+		if !found {
+			return &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid label: " + id}
+		}
+	}
+	return nil
+}
+
+func (f *FakeMail) pageSize() int {
+	if f.PageSize > 0 {
+		return f.PageSize
+	}
+	return defaultFakePageSize
+}
+
+// page returns the range of n items of the page starting at pageToken and
+// the token of the next page.
+func (f *FakeMail) page(n int, pageToken string) (start, end int, next string, err error) {
+	if pageToken != "" {
+		if start, err = strconv.Atoi(pageToken); err != nil || start < 0 || start > n {
+			return 0, 0, "", &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid pageToken"}
+		}
+	}
+	end = min(start+f.pageSize(), n)
+	if end < n {
+		next = strconv.Itoa(end)
+	}
+	return start, end, next, nil
+}
+
+func notFound() error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: "Requested entity was not found."}
+}
+
+// ListMessages returns the messages matching query, newest first.
+func (f *FakeMail) ListMessages(ctx context.Context, query, pageToken string) (*gmail.ListMessagesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(messagesList, ""); err != nil {
+		return nil, err
+	}
+	f.searches = append(f.searches, query)
+	q := parseFakeQuery(query)
+	var matched []*fakeMessage
+	for _, m := range f.messages {
+		if q.matches(f, m) {
+			matched = append(matched, m)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Date.After(matched[j].Date) })
+	start, end, next, err := f.page(len(matched), pageToken)
+	if err != nil {
+		return nil, err
+	}
+	resp := &gmail.ListMessagesResponse{NextPageToken: next, ResultSizeEstimate: int64(len(matched))}
+	for _, m := range matched[start:end] {
+		resp.Messages = append(resp.Messages, &gmail.Message{Id: m.ID, ThreadId: m.ID})
+	}
+	return resp, nil
+}
+
+// GetMessage returns the message id in the format f asks for. The fields
+// mask is not applied: the message is returned whole.
+func (f *FakeMail) GetMessage(ctx context.Context, id string, fetch MessageFetch) (*gmail.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.getMessage(id, fetch)
+}
+
+func (f *FakeMail) getMessage(id string, fetch MessageFetch) (*gmail.Message, error) {
+	if err := f.begin(messagesGet, id); err != nil {
+		return nil, err
+	}
+	m := f.byID[id]
+	if m == nil {
+		return nil, notFound()
+	}
+	msg := m.ref()
+	msg.Snippet = m.Body[:min(len(m.Body), 100)]
+	msg.InternalDate = m.Date.UnixMilli()
+	msg.SizeEstimate = int64(len(m.Body))
+	if fetch.Format == "minimal" {
+		return msg, nil
+	}
+
+	headers := []*gmail.MessagePartHeader{
+		{Name: "From", Value: m.From},
+		{Name: "Subject", Value: m.Subject},
+		{Name: "Date", Value: m.Date.Format(time.RFC1123Z)},
+	}
+	msg.Payload = &gmail.MessagePart{MimeType: "text/plain", Headers: headers}
+	if fetch.Format == "metadata" {
+		if len(fetch.Headers) > 0 {
+			msg.Payload.Headers = nil
+			for _, h := range headers {
+				for _, name := range fetch.Headers {
+					if strings.EqualFold(h.Name, name) {
+						msg.Payload.Headers = append(msg.Payload.Headers, h)
+					}
+				}
+			}
+		}
+		return msg, nil
+	}
+	msg.Payload.Body = &gmail.MessagePartBody{
+		Data: base64.URLEncoding.EncodeToString([]byte(m.Body)),
+		Size: int64(len(m.Body)),
+	}
+	if len(m.Attachments) > 0 {
+		msg.Payload.MimeType = "multipart/mixed"
+	}
+	for i, a := range m.Attachments {
+		mimeType := a.MimeType
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		msg.Payload.Parts = append(msg.Payload.Parts, &gmail.MessagePart{
+			PartId:   strconv.Itoa(i + 1),
+			Filename: a.Filename,
+			MimeType: mimeType,
+			Body:     &gmail.MessagePartBody{AttachmentId: fakeAttachmentID(m.ID, i), Size: int64(len(a.Data))},
+		})
+	}
+	return msg, nil
+}
+
+func fakeAttachmentID(messageID string, i int) string {
+	return fmt.Sprintf("att-%s-%d", messageID, i)
+}
+
+// GetMessages returns the messages ids as GetMessage does, failing the
+// whole batch only for failures injected for "batch".
+func (f *FakeMail) GetMessages(ctx context.Context, ids []string, fetch MessageFetch) ([]*gmail.Message, []error, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("batch %d", len(ids)))
+	if err := f.injected("batch", ""); err != nil {
+		return nil, nil, err
+	}
+	msgs := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		msgs[i], errs[i] = f.getMessage(id, fetch)
+	}
+	return msgs, errs, nil
+}
+
+func (f *FakeMail) GetAttachment(ctx context.Context, messageID, attachmentID string, w io.Writer) (int64, error) {
+	data, err := f.attachment(messageID, attachmentID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// attachment returns the data of an attachment.
+func (f *FakeMail) attachment(messageID, attachmentID string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(attachmentsGet, messageID); err != nil {
+		return nil, err
+	}
+	if m := f.byID[messageID]; m != nil {
+		for i, a := range m.Attachments {
+			if fakeAttachmentID(messageID, i) == attachmentID {
+				return a.Data, nil
+			}
+		}
+	}
+	return nil, notFound()
+}
+
+func (f *FakeMail) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(messagesModify, id); err != nil {
+		return err
+	}
+	if err := f.checkLabels(append(req.AddLabelIds, req.RemoveLabelIds...)); err != nil {
+		return err
+	}
+	m := f.byID[id]
+	if m == nil {
+		return notFound()
+	}
+	f.modify(m, req.AddLabelIds, req.RemoveLabelIds)
+	return nil
+}
+
+// BatchModifyMessages modifies the messages of req, skipping those that do
+// not exist, as Gmail does.
+func (f *FakeMail) BatchModifyMessages(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(messagesBatchModify, ""); err != nil {
+		return err
+	}
+	if err := f.checkLabels(append(req.AddLabelIds, req.RemoveLabelIds...)); err != nil {
+		return err
+	}
+	for _, id := range req.Ids {
+		if m := f.byID[id]; m != nil {
+			f.modify(m, req.AddLabelIds, req.RemoveLabelIds)
+		}
+	}
+	return nil
+}
+
+func (f *FakeMail) DeleteMessage(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(messagesDelete, id); err != nil {
+		return err
+	}
+	if f.byID[id] == nil {
+		return notFound()
+	}
+	f.delete(id)
+	return nil
+}
+
+// BatchDeleteMessages deletes the messages ids, skipping those that do not
+// exist, as Gmail does.
+func (f *FakeMail) BatchDeleteMessages(ctx context.Context, ids []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(messagesBatchDelete, ""); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if f.byID[id] != nil {
+			f.delete(id)
+		}
+	}
+	return nil
+}
+
+// delete removes the message id. f.mu must be held.
+func (f *FakeMail) delete(id string) {
+	m := f.byID[id]
+	delete(f.byID, id)
+	for i, other := range f.messages {
+		if other == m {
+			f.messages = append(f.messages[:i], f.messages[i+1:]...)
+			break
+		}
+	}
+	f.record(&gmail.History{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: m.ref()}}})
+}
+
+func (f *FakeMail) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(labelsList, ""); err != nil {
+		return nil, err
+	}
+	labels := make([]*gmail.Label, len(f.labels))
+	for i, l := range f.labels {
+		c := *l
+		labels[i] = &c
+	}
+	return labels, nil
+}
+
+func (f *FakeMail) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(usersGetProfile, ""); err != nil {
+		return nil, err
+	}
+	return &gmail.Profile{
+		EmailAddress:  f.email,
+		MessagesTotal: int64(len(f.messages)),
+		HistoryId:     f.historyID,
+	}, nil
+}
+
+// Watch records the request, which Watches returns. No notification is
+// ever published.
+func (f *FakeMail) Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(usersWatch, ""); err != nil {
+		return nil, err
+	}
+	if req.TopicName == "" {
+		return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid topicName"}
+	}
+	if err := f.checkLabels(req.LabelIds); err != nil {
+		return nil, err
+	}
+	c := *req
+	f.watches = append(f.watches, &c)
+	return &gmail.WatchResponse{HistoryId: f.historyID, Expiration: time.Now().Add(7 * 24 * time.Hour).UnixMilli()}, nil
+}
+
+// ListHistory returns the records after startID with changes of the given
+// types, or all types when there are none. It fails with 404 once the
+// history is expired, as Gmail does.
+func (f *FakeMail) ListHistory(ctx context.Context, startID uint64, types []string, pageToken string) (*gmail.ListHistoryResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(historyList, ""); err != nil {
+		return nil, err
+	}
+	if startID < f.oldestHistory {
+		return nil, notFound()
+	}
+	want := func(t string) bool {
+		if len(types) == 0 {
+			return true
+		}
+		for _, w := range types {
+			if w == t {
+				return true
+			}
+		}
+		return false
+	}
+	var records []*gmail.History
+	for _, h := range f.history {
+		if h.Id <= startID {
+			continue
+		}
+		r := &gmail.History{Id: h.Id, Messages: h.Messages}
+		if want("messageAdded") {
+			r.MessagesAdded = h.MessagesAdded
+		}
+		if want("messageDeleted") {
+			r.MessagesDeleted = h.MessagesDeleted
+		}
+		if want("labelAdded") {
+			r.LabelsAdded = h.LabelsAdded
+		}
+		if want("labelRemoved") {
+			r.LabelsRemoved = h.LabelsRemoved
+		}
+		if len(r.MessagesAdded)+len(r.MessagesDeleted)+len(r.LabelsAdded)+len(r.LabelsRemoved) > 0 {
+			records = append(records, r)
+		}
+	}
+	start, end, next, err := f.page(len(records), pageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &gmail.ListHistoryResponse{History: records[start:end], HistoryId: f.historyID, NextPageToken: next}, nil
+}
+
+// fakeQuery is a Gmail search query, as far as FakeMail understands one:
+// the label:, subject:, from:, filename:, after:, before:, is:read,
+// is:unread and has:attachment operators, and words matched anywhere in the
+// message. All of them must match; "subject:" alone matches any message.
+type fakeQuery []fakeTerm
+
+type fakeTerm struct {
+	op, value string
+}
+
+// parseFakeQuery splits a query into its terms, keeping quoted phrases and
+// parenthesised groups, such as subject:(monthly statement), together.
+func parseFakeQuery(query string) fakeQuery {
+	var q fakeQuery
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		end := strings.IndexAny(query, " \t")
+		if i := strings.IndexAny(query, `"(`); i >= 0 && (end < 0 || i < end) {
+			closing := `"`
+			if query[i] == '(' {
+				closing = ")"
+			}
+			if j := strings.Index(query[i+1:], closing); j >= 0 {
+				end = i + 1 + j + 1
+			}
+		}
+		if end < 0 {
+			end = len(query)
+		}
+		term := query[:end]
+		query = query[end:]
+		op, value, ok := strings.Cut(term, ":")
+		if !ok {
+			op, value = "", term
+		}
+		q = append(q, fakeTerm{op: strings.ToLower(op), value: strings.Trim(value, `"()`)})
+	}
+	return q
+}
+
+// matches reports whether m matches every term of q. f.mu must be held.
+func (q fakeQuery) matches(f *FakeMail, m *fakeMessage) bool {
+	for _, t := range q {
+		if !t.matches(f, m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t fakeTerm) matches(f *FakeMail, m *fakeMessage) bool {
+	contains := func(s string) bool {
+		for _, word := range strings.Fields(t.value) {
+			if !strings.Contains(strings.ToLower(s), strings.ToLower(word)) {
+				return false
+			}
+		}
+		return true
+	}
+	switch t.op {
+	case "label", "in":
+		for _, id := range m.labelIDs {
+			name := f.labelName(id)
+			// Gmail writes spaces and slashes in label names as dashes.
+			dashed := strings.NewReplacer(" ", "-", "/", "-").Replace(name)
+			if strings.EqualFold(id, t.value) || strings.EqualFold(name, t.value) || strings.EqualFold(dashed, t.value) {
+				return true
+			}
+		}
+		return false
+	case "subject":
+		return contains(m.Subject)
+	case "from":
+		return contains(m.From)
+	case "filename":
+		for _, a := range m.Attachments {
+			if contains(a.Filename) {
+				return true
+			}
+		}
+		return false
+	case "after", "before":
+		at, ok := fakeQueryTime(t.value)
+		if !ok {
+			return false
+		}
+		if t.op == "after" {
+			return m.Date.After(at)
+		}
+		return m.Date.Before(at)
+	case "is":
+		switch strings.ToLower(t.value) {
+		case "unread":
+			return m.hasLabel("UNREAD")
+		case "read":
+			return !m.hasLabel("UNREAD")
+		}
+		return false
+	case "has":
+		return strings.EqualFold(t.value, "attachment") && len(m.Attachments) > 0
+	case "":
+		text := m.Subject + " " + m.From + " " + m.Body
+		for _, a := range m.Attachments {
+			text += " " + a.Filename
+		}
+		return contains(text)
+	}
+	return false
+}
+
+// fakeQueryTime parses the value of after: or before:, either seconds
+// since the epoch or a date written 2006/01/02.
+func fakeQueryTime(s string) (time.Time, bool) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), true
+	}
+	t, err := time.ParseInLocation("2006/01/02", s, time.Local)
+	return t, err == nil
+}
@@ -0,0 +1,103 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// newFakeMailClient returns a mailClient of fake, batching as configured.
+func newFakeMailClient(fake *FakeMail) *mailClient {
+	client := newMailClient(fake, "me", 0)
+	client.retry.baseDelay = time.Millisecond
+	return client
+}
+
+func TestProcessEmails_FakeMail(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	pdf, err := os.ReadFile(writeTestPDF(t, t.TempDir(), "ABCD0102"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeMail("me@example.com")
+	date := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	statement := fake.AddMessage(FakeMessage{
+		Subject: "HDFC statement", Date: date, Labels: []string{"Bank", "UNREAD"},
+		Attachments: []FakeAttachment{
+			{Filename: "march.pdf", MimeType: "application/pdf", Data: pdf},
+			{Filename: "logo.png", Data: []byte("png")},
+		},
+	})
+	offer := fake.AddMessage(FakeMessage{Subject: "Credit card offer", Date: date, Labels: []string{"Bank", "UNREAD"}})
+	elsewhere := fake.AddMessage(FakeMessage{Subject: "HDFC statement", Date: date, Labels: []string{"INBOX", "UNREAD"}})
+
+	labelAction := LabelAction{Label: "Bank", Actions: []Action{{
+		SubjectFilter:        "statement",
+		Download:             true,
+		AttachmentNameFilter: `\.pdf$`,
+		SaveTo:               dir,
+		FilenamePattern:      "{date}_{original}",
+		PdfPassword:          secretValue("ABCD0102"),
+		MarkAsRead:           true,
+		Delete:               true,
+	}}}
+	if err := processEmails(context.Background(), newFakeMailClient(fake), labelAction, 2); err != nil {
+		t.Fatalf("processEmails() error = %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 || !strings.HasSuffix(files[0], "_march.pdf") || !strings.HasPrefix(filepath.Base(files[0]), "2024") {
+		t.Fatalf("saved files = %v, want only the statement", files)
+	}
+	if encrypted, err := pdfEncrypted(LocalStorage{}, files[0]); err != nil || encrypted {
+		t.Errorf("saved statement encrypted = %v, %v, want it decrypted", encrypted, err)
+	}
+	if got := fake.Searches(); len(got) != 1 || got[0] != "label:Bank subject:statement" {
+		t.Errorf("searches = %q, want the query of the action", got)
+	}
+	if _, ok := fake.Message(statement); ok {
+		t.Error("the processed message was not deleted")
+	}
+	for _, id := range []string{offer, elsewhere} {
+		if m, ok := fake.Message(id); !ok || !strings.Contains(strings.Join(m.Labels, ","), "UNREAD") {
+			t.Errorf("message %q = %+v, %v, want it left alone", id, m, ok)
+		}
+	}
+}
+
+func TestProcessEmails_FakeMailFailures(t *testing.T) {
+	logs := captureLog(t)
+	fake := NewFakeMail("me@example.com")
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, fake.AddMessage(FakeMessage{Subject: "Statement", Labels: []string{"Bank", "UNREAD"}}))
+	}
+	fake.Fail("messages.get", ids[1], &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend Error"}, 2)
+	fake.Fail("messages.get", ids[2], &googleapi.Error{Code: http.StatusForbidden, Message: "Forbidden"}, -1)
+	fake.Fail("messages.modify", ids[3], &googleapi.Error{Code: http.StatusInternalServerError, Message: "Internal"}, 1)
+
+	client := newFakeMailClient(fake)
+	client.batchSize = 2
+	labelAction := LabelAction{Label: "Bank", Actions: []Action{{MarkAsRead: true}}}
+	err := processEmails(context.Background(), client, labelAction, 2)
+	if err == nil || !strings.Contains(err.Error(), ids[2]) || strings.Contains(err.Error(), ids[1]) {
+		t.Fatalf("processEmails() error = %v, want only the forbidden message to fail", err)
+	}
+	for i, id := range ids {
+		m, _ := fake.Message(id)
+		unread := strings.Contains(strings.Join(m.Labels, ","), "UNREAD")
+		if unread != (i == 2) {
+			t.Errorf("message %d unread = %v", i, unread)
+		}
+	}
+	if !strings.Contains(logs.String(), `level=WARN msg="marking message `+ids[3]+` as read failed, retrying"`) {
+		t.Errorf("log does not report the retries:\n%s", logs)
+	}
+}
@@ -0,0 +1,234 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// ServeHTTP serves the mailbox as the Gmail REST API, including batch
+// requests, for the user "me" or the email address of the mailbox.
+// Started with httptest.NewServer, it stands in for Gmail when testing the
+// HTTP side of a client, e.g. with NewFakeGmailService.
+func (f *FakeMail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.once.Do(f.routes)
+	f.mux.ServeHTTP(w, r)
+}
+
+// NewFakeGmailService returns the gmailService of the user "me" of srv, a
+// server of a FakeMail.
+func NewFakeGmailService(srv *httptest.Server) (MailService, error) {
+	svc, err := gmail.NewService(context.Background(),
+		option.WithEndpoint(srv.URL+"/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		return nil, err
+	}
+	return NewGmailService(svc, srv.Client(), "me"), nil
+}
+
+func (f *FakeMail) routes() {
+	mux := http.NewServeMux()
+	user := func(h func(w http.ResponseWriter, r *http.Request) (any, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if u := r.PathValue("user"); u != "me" && !strings.EqualFold(u, f.email) {
+				writeFakeError(w, &googleapi.Error{Code: http.StatusForbidden, Message: "Delegation denied for " + u})
+				return
+			}
+			v, err := h(w, r)
+			if err != nil {
+				writeFakeError(w, err)
+				return
+			}
+			if v == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			json.NewEncoder(w).Encode(v)
+		}
+	}
+	const users = "/gmail/v1/users/{user}"
+
+	mux.HandleFunc("GET "+users+"/messages", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		q := r.URL.Query()
+		return f.ListMessages(r.Context(), q.Get("q"), q.Get("pageToken"))
+	}))
+	mux.HandleFunc("GET "+users+"/messages/{id}", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		q := r.URL.Query()
+		return f.GetMessage(r.Context(), r.PathValue("id"), MessageFetch{
+			Format:  q.Get("format"),
+			Headers: q["metadataHeaders"],
+			Fields:  q.Get("fields"),
+		})
+	}))
+	mux.HandleFunc("GET "+users+"/messages/{id}/attachments/{attachment}", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		data, err := f.attachment(r.PathValue("id"), r.PathValue("attachment"))
+		if err != nil {
+			return nil, err
+		}
+		return &gmail.MessagePartBody{
+			AttachmentId: r.PathValue("attachment"),
+			Size:         int64(len(data)),
+			Data:         base64.URLEncoding.EncodeToString(data),
+		}, nil
+	}))
+	mux.HandleFunc("POST "+users+"/messages/{id}/modify", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		req := &gmail.ModifyMessageRequest{}
+		if err := decodeFakeRequest(r, req); err != nil {
+			return nil, err
+		}
+		if err := f.ModifyMessage(r.Context(), r.PathValue("id"), req); err != nil {
+			return nil, err
+		}
+		// Gmail answers with the message in the minimal format, which is
+		// not a call of messages.get of its own.
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if m := f.byID[r.PathValue("id")]; m != nil {
+			return m.ref(), nil
+		}
+		return nil, notFound()
+	}))
+	mux.HandleFunc("DELETE "+users+"/messages/{id}", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		return nil, f.DeleteMessage(r.Context(), r.PathValue("id"))
+	}))
+	mux.HandleFunc("POST "+users+"/messages/batchModify", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		req := &gmail.BatchModifyMessagesRequest{}
+		if err := decodeFakeRequest(r, req); err != nil {
+			return nil, err
+		}
+		return nil, f.BatchModifyMessages(r.Context(), req)
+	}))
+	mux.HandleFunc("POST "+users+"/messages/batchDelete", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		req := &gmail.BatchDeleteMessagesRequest{}
+		if err := decodeFakeRequest(r, req); err != nil {
+			return nil, err
+		}
+		return nil, f.BatchDeleteMessages(r.Context(), req.Ids)
+	}))
+	mux.HandleFunc("GET "+users+"/labels", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		labels, err := f.ListLabels(r.Context())
+		return &gmail.ListLabelsResponse{Labels: labels}, err
+	}))
+	mux.HandleFunc("GET "+users+"/profile", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		return f.GetProfile(r.Context())
+	}))
+	mux.HandleFunc("POST "+users+"/watch", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		req := &gmail.WatchRequest{}
+		if err := decodeFakeRequest(r, req); err != nil {
+			return nil, err
+		}
+		return f.Watch(r.Context(), req)
+	}))
+	mux.HandleFunc("GET "+users+"/history", user(func(w http.ResponseWriter, r *http.Request) (any, error) {
+		q := r.URL.Query()
+		start, err := strconv.ParseUint(q.Get("startHistoryId"), 10, 64)
+		if err != nil {
+			return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid startHistoryId"}
+		}
+		return f.ListHistory(r.Context(), start, q["historyTypes"], q.Get("pageToken"))
+	}))
+	mux.HandleFunc("POST /batch/gmail/v1", f.serveBatch)
+	f.mux = mux
+}
+
+// serveBatch answers a batch request by serving each of its requests. The
+// batch as a whole fails with the failures injected for "batch".
+func (f *FakeMail) serveBatch(w http.ResponseWriter, r *http.Request) {
+	// The server stops reading the request once the response is flushed.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, err)
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeFakeError(w, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	var reqs []*http.Request
+	var ids []string
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		var req *http.Request
+		if err == nil {
+			req, err = http.ReadRequest(bufio.NewReader(part))
+		}
+		if err != nil {
+			writeFakeError(w, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		reqs = append(reqs, req.WithContext(r.Context()))
+		ids = append(ids, strings.Trim(part.Header.Get("Content-ID"), "<>"))
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, fmt.Sprintf("batch %d", len(reqs)))
+	err = f.injected("batch", "")
+	f.mu.Unlock()
+	if err != nil {
+		writeFakeError(w, err)
+		return
+	}
+
+	var out bytes.Buffer
+	mw := multipart.NewWriter(&out)
+	for i, req := range reqs {
+		rec := httptest.NewRecorder()
+		f.mux.ServeHTTP(rec, req)
+		pw, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<response-" + ids[i] + ">"},
+		})
+		rec.Result().Write(pw)
+	}
+	mw.Close()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Write(out.Bytes())
+}
+
+func decodeFakeRequest(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid JSON payload: " + err.Error()}
+	}
+	return nil
+}
+
+// writeFakeError writes err as Gmail writes errors, with the code of a
+// *googleapi.Error or 500.
+func writeFakeError(w http.ResponseWriter, err error) {
+	code, message := http.StatusInternalServerError, err.Error()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		code, message = apiErr.Code, apiErr.Message
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": code, "message": message}})
+}
+
+// fakeRoutes holds the router of a FakeMail, set up on first use.
+type fakeRoutes struct {
+	once sync.Once
+	mux  *http.ServeMux
+}
@@ -0,0 +1,32 @@
+package download
+
+import "log/slog"
+
+// Keys of the attributes of log records and trace spans, shared with the
+// command line so that the records of a run can be filtered by any of them.
+const (
+	// AttrAccount is the Gmail account a record is about. The Processor
+	// leaves it to Options.Logger, as only the caller knows the account.
+	AttrAccount = "account"
+	AttrLabel   = "label"
+	// AttrAction is the 0-based index of the action within its label.
+	AttrAction  = "action"
+	AttrMessage = "message_id"
+	AttrPath    = "path"
+	// AttrSize is the size of a saved file, in bytes.
+	AttrSize  = "size"
+	AttrError = "error"
+)
+
+// logger returns the logger of the processor's records.
+func (p *Processor) logger() *slog.Logger {
+	if p.opts.Logger != nil {
+		return p.opts.Logger
+	}
+	return slog.Default()
+}
+
+// actionLogger returns the logger of the records about an action of label.
+func (p *Processor) actionLogger(label string, action int) *slog.Logger {
+	return p.logger().With(AttrLabel, label, AttrAction, action)
+}
@@ -0,0 +1,110 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrHistoryGone is returned by AddedSince when the history to sync from is
+// no longer available, as happens after a week or so.
+var ErrHistoryGone = errors.New("mailbox history no longer available")
+
+// LabelIDs returns the IDs of the labels of the mailbox by name.
+func (p *Processor) LabelIDs(ctx context.Context) (map[string]string, error) {
+	var labels []*gmail.Label
+	err := p.client.call(ctx, "listing labels", labelsList, 1, func() (err error) {
+		labels, err = p.client.svc.ListLabels(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string, len(labels))
+	for _, label := range labels {
+		ids[label.Name] = label.Id
+	}
+	return ids, nil
+}
+
+// Watch asks Gmail to publish a notification to the Pub/Sub topic whenever
+// a message is added to one of the labels with labelIDs. The watch lasts
+// seven days unless renewed by calling Watch again.
+func (p *Processor) Watch(ctx context.Context, topic string, labelIDs []string) (resp *gmail.WatchResponse, err error) {
+	err = p.client.call(ctx, "watching the mailbox", usersWatch, 1, func() error {
+		resp, err = p.client.svc.Watch(ctx, &gmail.WatchRequest{
+			TopicName:           topic,
+			LabelIds:            labelIDs,
+			LabelFilterBehavior: "include",
+		})
+		return err
+	})
+	return resp, err
+}
+
+// HistoryID returns the ID of the latest history record of the mailbox.
+func (p *Processor) HistoryID(ctx context.Context) (uint64, error) {
+	var profile *gmail.Profile
+	err := p.client.call(ctx, "getting the mailbox profile", usersGetProfile, 1, func() (err error) {
+		profile, err = p.client.svc.GetProfile(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return profile.HistoryId, nil
+}
+
+// AddedSince returns the messages added to each label, by label ID, since
+// the history record startID, and the ID of the latest record. Messages
+// delivered with the label and messages the label was applied to later both
+// count as added. It fails with ErrHistoryGone when the history from startID
+// is no longer available.
+func (p *Processor) AddedSince(ctx context.Context, startID uint64) (map[string]map[string]bool, uint64, error) {
+	added := make(map[string]map[string]bool)
+	add := func(m *gmail.Message, labelIDs []string) {
+		if m == nil {
+			return
+		}
+		for _, label := range labelIDs {
+			if added[label] == nil {
+				added[label] = make(map[string]bool)
+			}
+			added[label][m.Id] = true
+		}
+	}
+	latest, pageToken := startID, ""
+	for {
+		var resp *gmail.ListHistoryResponse
+		err := p.client.call(ctx, "listing the mailbox history", historyList, 1, func() (err error) {
+			resp, err = p.client.svc.ListHistory(ctx, startID, []string{"messageAdded", "labelAdded"}, pageToken)
+			return err
+		})
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, 0, fmt.Errorf("%w: %v", ErrHistoryGone, err)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, h := range resp.History {
+			for _, m := range h.MessagesAdded {
+				if m.Message != nil {
+					add(m.Message, m.Message.LabelIds)
+				}
+			}
+			for _, l := range h.LabelsAdded {
+				add(l.Message, l.LabelIds)
+			}
+		}
+		latest = max(latest, resp.HistoryId)
+		if resp.NextPageToken == "" {
+			return added, latest, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
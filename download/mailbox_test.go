@@ -0,0 +1,53 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestProcessor_AddedSince(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFakeMail("me@example.com")
+	fake.PageSize = 1
+	bank := fake.CreateLabel("Bank")
+	fake.AddMessage(FakeMessage{Subject: "before", Labels: []string{"Bank"}})
+	p, err := NewProcessor(&Config{}, fake, LocalStorage{}, Options{User: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, err := p.HistoryID(ctx)
+	if err != nil {
+		t.Fatalf("HistoryID() error = %v", err)
+	}
+
+	delivered := fake.AddMessage(FakeMessage{Subject: "delivered", Labels: []string{"INBOX", "Bank"}})
+	labelled := fake.AddMessage(FakeMessage{Subject: "labelled", Labels: []string{"INBOX"}})
+	if err := fake.AddLabels(labelled, "Bank"); err != nil {
+		t.Fatal(err)
+	}
+	added, latest, err := p.AddedSince(ctx, start)
+	if err != nil {
+		t.Fatalf("AddedSince() error = %v", err)
+	}
+	if len(added[bank]) != 2 || !added[bank][delivered] || !added[bank][labelled] {
+		t.Errorf("added to Bank = %v, want %s and %s", added[bank], delivered, labelled)
+	}
+	if len(added["INBOX"]) != 2 {
+		t.Errorf("added to INBOX = %v, want both new messages", added["INBOX"])
+	}
+	if current, _ := p.HistoryID(ctx); latest != current {
+		t.Errorf("latest history = %d, want %d", latest, current)
+	}
+
+	ids, err := p.LabelIDs(ctx)
+	if err != nil || ids["Bank"] != bank {
+		t.Errorf("LabelIDs() = %v, %v, want Bank as %s", ids, err, bank)
+	}
+
+	fake.AddMessage(FakeMessage{Subject: "later", Labels: []string{"Bank"}})
+	fake.ExpireHistory()
+	if _, _, err := p.AddedSince(ctx, start); !errors.Is(err, ErrHistoryGone) {
+		t.Errorf("AddedSince() of expired history error = %v, want ErrHistoryGone", err)
+	}
+}
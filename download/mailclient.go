@@ -0,0 +1,202 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// DefaultQuotaRate is Gmail's per-user limit of quota units per second.
+const DefaultQuotaRate = 250
+
+// mailClient makes the Gmail API calls of a run for one user through svc.
+// Calls are paced by a limiter counting quota units, so that concurrent
+// workers stay within the per-user rate limit, and transient failures are
+// retried as the retry policy allows. Messages are fetched with batch
+// requests, batchSize at a time. It is safe for concurrent use.
+type mailClient struct {
+	svc       MailService
+	user      string
+	limiter   *rate.Limiter
+	retry     *retryPolicy
+	batchSize int
+	usage     quotaUsage
+	// logger returns the logger of the run, slog.Default() when nil.
+	logger func() *slog.Logger
+	hook   CallHook
+	tracer trace.Tracer
+}
+
+// newMailClient returns a client for user allowing unitsPerSecond quota units
+// per second; 0 or less disables the limit. Calls are retried with the
+// default policy.
+func newMailClient(svc MailService, user string, unitsPerSecond int) *mailClient {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if unitsPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(unitsPerSecond), unitsPerSecond)
+	}
+	return &mailClient{
+		svc:       svc,
+		user:      user,
+		limiter:   limiter,
+		retry:     newRetryPolicy(DefaultMaxAttempts, DefaultRetryBudget),
+		batchSize: DefaultBatchSize,
+		tracer:    newTracer(nil),
+	}
+}
+
+// call runs fn, which makes one HTTP request with calls calls of method m,
+// until it succeeds or the retry policy gives up. op names the call in the
+// log. The call and its retries are traced as one span.
+func (c *mailClient) call(ctx context.Context, op string, m apiMethod, calls int, fn func() error) error {
+	return c.callWith(ctx, op, m, calls, nil, fn)
+}
+
+// callWith is call, adding attrs, such as the message the call is about, to
+// the span of the call.
+func (c *mailClient) callWith(ctx context.Context, op string, m apiMethod, calls int, attrs []attribute.KeyValue, fn func() error) (err error) {
+	attrs = append(attrs, attribute.String("gmail.method", m.name), attribute.Int("gmail.calls", calls))
+	ctx, span := c.tracer.Start(ctx, "gmail "+m.name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	attempt := 1
+	defer func() {
+		span.SetAttributes(attribute.Int("gmail.attempts", attempt))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, op+" failed")
+		}
+		span.End()
+	}()
+
+	for ; ; attempt++ {
+		if err := c.wait(ctx, m.units*calls); err != nil {
+			return err
+		}
+		c.usage.add(m, calls)
+		start := time.Now()
+		err := fn()
+		var delay time.Duration
+		var gaveUp error
+		if err != nil {
+			delay, gaveUp = c.retry.next(ctx, attempt, err)
+		}
+		if c.hook != nil {
+			c.hook.OnCall(ctx, CallEvent{Method: m.name, Calls: calls, Attempt: attempt,
+				Duration: time.Since(start), Err: err, Retry: err != nil && gaveUp == nil})
+		}
+		if err == nil {
+			return nil
+		}
+		if gaveUp != nil {
+			return gaveUp
+		}
+		c.log().Warn(op+" failed, retrying", "attempt", attempt, "delay", delay.Round(time.Millisecond), AttrError, err)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt),
+			attribute.String("delay", delay.Round(time.Millisecond).String()), attribute.String(AttrError, err.Error())))
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *mailClient) log() *slog.Logger {
+	if c.logger != nil {
+		return c.logger()
+	}
+	return slog.Default()
+}
+
+// wait blocks until the limiter allows spending units quota units. Costs
+// above the burst, such as large batches, are waited for in several steps.
+func (c *mailClient) wait(ctx context.Context, units int) error {
+	for units > 0 {
+		n := units
+		if burst := c.limiter.Burst(); burst > 0 && n > burst {
+			n = burst
+		}
+		if err := c.limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+		units -= n
+	}
+	return nil
+}
+
+func (c *mailClient) listMessages(ctx context.Context, query, pageToken string) (resp *gmail.ListMessagesResponse, err error) {
+	err = c.call(ctx, "listing messages", messagesList, 1, func() error {
+		resp, err = c.svc.ListMessages(ctx, query, pageToken)
+		return err
+	})
+	return resp, err
+}
+
+func (c *mailClient) getMessage(ctx context.Context, id string, f MessageFetch) (m *gmail.Message, err error) {
+	err = c.callWith(ctx, "getting message "+id, messagesGet, 1, messageAttrs(id), func() error {
+		m, err = c.svc.GetMessage(ctx, id, f)
+		return err
+	})
+	return m, err
+}
+
+// markRead removes the UNREAD label from a message.
+func (c *mailClient) markRead(ctx context.Context, id string) error {
+	return c.callWith(ctx, "marking message "+id+" as read", messagesModify, 1, messageAttrs(id), func() error {
+		return c.svc.ModifyMessage(ctx, id, &gmail.ModifyMessageRequest{
+			RemoveLabelIds: []string{"UNREAD"},
+		})
+	})
+}
+
+// deleteMessage deletes a message permanently, bypassing the trash. A retry
+// of a delete that went through finds the message gone, which counts as
+// success.
+func (c *mailClient) deleteMessage(ctx context.Context, id string) error {
+	attempted := false
+	return c.callWith(ctx, "deleting message "+id, messagesDelete, 1, messageAttrs(id), func() error {
+		err := c.svc.DeleteMessage(ctx, id)
+		var apiErr *googleapi.Error
+		if attempted && errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil
+		}
+		attempted = true
+		return err
+	})
+}
+
+// messagePage is one page of the messages matching a query.
+type messagePage struct {
+	ids   []string
+	token string // the page token that returned the page, "" for the first
+	next  string // the page token of the next page, "" for the last
+}
+
+// forEachPage calls fn with every page of messages matching query, one page
+// after the other, starting at the page pageToken returns. It stops early
+// when fn returns false.
+func (c *mailClient) forEachPage(ctx context.Context, query, pageToken string, fn func(page messagePage) bool) error {
+	for {
+		msgs, err := c.listMessages(ctx, query, pageToken)
+		if err != nil {
+			return err
+		}
+		page := messagePage{token: pageToken, next: msgs.NextPageToken}
+		for _, msg := range msgs.Messages {
+			page.ids = append(page.ids, msg.Id)
+		}
+		if len(page.ids) > 0 && !fn(page) {
+			return nil
+		}
+		pageToken = msgs.NextPageToken
+		if pageToken == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeInbox returns a mailbox of n unread messages in INBOX, m00 the
+// newest, each with an attachment m00.txt holding "content of m00", and
+// their IDs. Its pages hold 5 messages.
+func newFakeInbox(n int) (*FakeMail, []string) {
+	fake := NewFakeMail("me@example.com")
+	fake.PageSize = 5
+	date := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	var ids []string
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("m%02d", i)
+		ids = append(ids, fake.AddMessage(FakeMessage{
+			ID:          id,
+			Subject:     "Statement " + id,
+			Date:        date.Add(-time.Duration(i) * time.Minute),
+			Labels:      []string{"INBOX", "UNREAD"},
+			Attachments: []FakeAttachment{{Filename: id + ".txt", Data: []byte("content of " + id)}},
+		}))
+	}
+	return fake, ids
+}
+
+// callsAbout returns the methods of the calls fake received about the
+// message id, in order, or with id "" those about no message in particular,
+// such as bulk calls. Batch requests are left out.
+func callsAbout(fake *FakeMail, id string) []string {
+	var methods []string
+	for _, call := range fake.Calls() {
+		method, about, _ := strings.Cut(call, " ")
+		if method != "batch" && about == id {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// batchSizes returns the number of calls in each batch request fake
+// received.
+func batchSizes(fake *FakeMail) []int {
+	var sizes []int
+	for _, call := range fake.Calls() {
+		var n int
+		if _, err := fmt.Sscanf(call, "batch %d", &n); err == nil {
+			sizes = append(sizes, n)
+		}
+	}
+	return sizes
+}
+
+// inFlight passes requests on to next after a delay, recording how many
+// were served at once at most.
+type inFlight struct {
+	next  http.Handler
+	delay time.Duration
+
+	mu       sync.Mutex
+	now, max int
+}
+
+func (h *inFlight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.now++
+	h.max = max(h.max, h.now)
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.now--
+		h.mu.Unlock()
+	}()
+	time.Sleep(h.delay)
+	h.next.ServeHTTP(w, r)
+}
+
+// newTestMailClient returns a mailClient talking to handler, batching with
+// the default batch size.
+func newTestMailClient(t *testing.T, handler http.Handler) *mailClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	svc, err := NewFakeGmailService(srv)
+	if err != nil {
+		t.Fatalf("NewFakeGmailService() error = %v", err)
+	}
+	client := newMailClient(svc, "me", 0)
+	client.retry.baseDelay = time.Millisecond
+	return client
+}
+
+// testProcessor returns a Processor making its calls with client and
+// saving to the local file system.
+func testProcessor(client *mailClient, workers int) *Processor {
+	return &Processor{client: client, storage: LocalStorage{}, opts: Options{User: "me", Workers: workers}, tracer: client.tracer}
+}
+
+// processEmails runs every action of labelAction with client, without
+// checkpoints, and returns the failures.
+func processEmails(ctx context.Context, client *mailClient, labelAction LabelAction, workers int) error {
+	return testProcessor(client, workers).processLabel(ctx, 0, labelAction, nil).Err()
+}
+
+// captureLog sends the records of the default logger, at every level, to a
+// buffer in the text format for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestProcessEmails_Concurrent(t *testing.T) {
+	fake, ids := newFakeInbox(12)
+	fake.PageSize = 12
+	fake.Fail("messages.get", "m03", notFound(), -1)
+	handler := &inFlight{next: fake, delay: 10 * time.Millisecond}
+	client := newTestMailClient(t, handler)
+	logs := captureLog(t)
+	dir := t.TempDir()
+
+	labelAction := LabelAction{Label: "INBOX", Actions: []Action{{
+		Download: true, SaveTo: dir, MarkAsRead: true, Delete: true,
+	}}}
+	err := processEmails(context.Background(), client, labelAction, 4)
+	if countErrors(err) != 1 || !strings.Contains(err.Error(), "m03") {
+		t.Errorf("processEmails() error = %v, want one failure for m03", err)
+	}
+
+	for _, id := range ids {
+		want := "messages.get,messages.attachments.get"
+		_, kept := fake.Message(id)
+		if id == "m03" {
+			want = "messages.get"
+			if !kept {
+				t.Errorf("%s was deleted although it could not be fetched", id)
+			}
+		} else if data, err := os.ReadFile(filepath.Join(dir, id+".txt")); err != nil || string(data) != "content of "+id {
+			t.Errorf("attachment of %s = %q, %v", id, data, err)
+		} else if kept {
+			t.Errorf("%s was not deleted once saved", id)
+		}
+		if got := strings.Join(callsAbout(fake, id), ","); got != want {
+			t.Errorf("calls for %s = %s, want %s", id, got, want)
+		}
+	}
+	// The 11 messages saved are marked as read and deleted in bulk.
+	if got := strings.Join(callsAbout(fake, ""), ","); got != "messages.list,messages.batchModify,messages.batchDelete" {
+		t.Errorf("calls about no message = %s, want the list and the bulk calls", got)
+	}
+	// The batch of gets, then four workers downloading attachments
+	if handler.max < 2 || handler.max > 5 {
+		t.Errorf("max concurrent requests = %d, want between 2 and 5", handler.max)
+	}
+	if !strings.Contains(logs.String(), `level=ERROR msg="fetch failed" label=INBOX action=0 message_id=m03 step=fetch error="unable to retrieve message m03`) {
+		t.Errorf("log does not attribute the failure to its message:\n%s", logs)
+	}
+}
+
+func TestMailClient_RateLimit(t *testing.T) {
+	fake, _ := newFakeInbox(1)
+	client := newMailClient(fake, "me", 50)
+
+	// The burst covers the first 10 gets; the next 10 (50 units) take a second.
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if _, err := client.getMessage(context.Background(), "m00", MessageFetch{}); err != nil {
+			t.Fatalf("getMessage() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("20 gets at 50 units/s took %v, want about 1s", elapsed)
+	}
+}
@@ -0,0 +1,166 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// MailService is the Gmail API of one mailbox, as far as the tool uses it.
+// Each method makes one request and returns the API error as it is;
+// mailClient adds the rate limiting, quota accounting and retries on top.
+// gmailService implements it with the Gmail API, FakeMail in memory.
+type MailService interface {
+	// ListMessages returns a page of the messages matching a Gmail search
+	// query, starting at pageToken, "" for the first page.
+	ListMessages(ctx context.Context, query, pageToken string) (*gmail.ListMessagesResponse, error)
+	// GetMessage returns what f selects of a message.
+	GetMessage(ctx context.Context, id string, f MessageFetch) (*gmail.Message, error)
+	// GetMessages returns what f selects of several messages with one
+	// batch request. The results are in the order of ids; the error is only
+	// returned when the request as a whole failed.
+	GetMessages(ctx context.Context, ids []string, f MessageFetch) ([]*gmail.Message, []error, error)
+	// GetAttachment writes the decoded data of an attachment to w and
+	// returns the number of bytes written.
+	GetAttachment(ctx context.Context, messageID, attachmentID string, w io.Writer) (int64, error)
+	ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) error
+	BatchModifyMessages(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error
+	// DeleteMessage deletes a message permanently, bypassing the trash.
+	DeleteMessage(ctx context.Context, id string) error
+	BatchDeleteMessages(ctx context.Context, ids []string) error
+	ListLabels(ctx context.Context) ([]*gmail.Label, error)
+	GetProfile(ctx context.Context) (*gmail.Profile, error)
+	// Watch asks Gmail to publish notifications of changes to the mailbox
+	// to a Pub/Sub topic.
+	Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error)
+	// ListHistory returns a page of the changes of the given types after
+	// the history record startID.
+	ListHistory(ctx context.Context, startID uint64, types []string, pageToken string) (*gmail.ListHistoryResponse, error)
+}
+
+// MessageFetch selects what GetMessage returns of a message. The zero value
+// fetches all of it.
+type MessageFetch struct {
+	Format  string   // "metadata", "full" or "" for the default (full)
+	Headers []string // the headers returned in the metadata format
+	Fields  string   // partial response mask, e.g. "id,payload/headers"
+}
+
+// params returns f as the query parameters of Messages.Get.
+func (f MessageFetch) params() url.Values {
+	v := url.Values{}
+	if f.Format != "" {
+		v.Set("format", f.Format)
+	}
+	for _, h := range f.Headers {
+		v.Add("metadataHeaders", h)
+	}
+	if f.Fields != "" {
+		v.Set("fields", f.Fields)
+	}
+	return v
+}
+
+// gmailService is the MailService of user on Gmail. Batch requests and
+// attachment downloads are made with httpClient, the authorised client svc
+// uses, as the API library holds whole responses in memory.
+type gmailService struct {
+	svc        *gmail.Service
+	httpClient *http.Client
+	user       string
+}
+
+// NewGmailService returns the MailService of user on Gmail, calling the API
+// through svc. httpClient must be the authorised client svc was created
+// with.
+func NewGmailService(svc *gmail.Service, httpClient *http.Client, user string) MailService {
+	return &gmailService{svc: svc, httpClient: httpClient, user: user}
+}
+
+func (s *gmailService) ListMessages(ctx context.Context, query, pageToken string) (*gmail.ListMessagesResponse, error) {
+	return s.svc.Users.Messages.List(s.user).Q(query).PageToken(pageToken).Context(ctx).Do()
+}
+
+func (s *gmailService) GetMessage(ctx context.Context, id string, f MessageFetch) (*gmail.Message, error) {
+	call := s.svc.Users.Messages.Get(s.user, id).Context(ctx)
+	if f.Format != "" {
+		call.Format(f.Format)
+	}
+	if len(f.Headers) > 0 {
+		call.MetadataHeaders(f.Headers...)
+	}
+	if f.Fields != "" {
+		call.Fields(googleapi.Field(f.Fields))
+	}
+	return call.Do()
+}
+
+func (s *gmailService) GetMessages(ctx context.Context, ids []string, f MessageFetch) ([]*gmail.Message, []error, error) {
+	query := ""
+	if params := f.params(); len(params) > 0 {
+		query = "?" + params.Encode()
+	}
+	paths := make([]string, len(ids))
+	for i, id := range ids {
+		paths[i] = "gmail/v1/users/" + url.PathEscape(s.user) + "/messages/" + url.PathEscape(id) + query
+	}
+	results, err := s.batch(ctx, paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	msgs := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	for i, r := range results {
+		if errs[i] = r.err; r.err == nil {
+			msgs[i] = &gmail.Message{}
+			errs[i] = json.Unmarshal(r.body, msgs[i])
+		}
+	}
+	return msgs, errs, nil
+}
+
+func (s *gmailService) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) error {
+	_, err := s.svc.Users.Messages.Modify(s.user, id, req).Context(ctx).Do()
+	return err
+}
+
+func (s *gmailService) BatchModifyMessages(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	return s.svc.Users.Messages.BatchModify(s.user, req).Context(ctx).Do()
+}
+
+func (s *gmailService) DeleteMessage(ctx context.Context, id string) error {
+	return s.svc.Users.Messages.Delete(s.user, id).Context(ctx).Do()
+}
+
+func (s *gmailService) BatchDeleteMessages(ctx context.Context, ids []string) error {
+	return s.svc.Users.Messages.BatchDelete(s.user, &gmail.BatchDeleteMessagesRequest{Ids: ids}).Context(ctx).Do()
+}
+
+func (s *gmailService) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	resp, err := s.svc.Users.Labels.List(s.user).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Labels, nil
+}
+
+func (s *gmailService) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	return s.svc.Users.GetProfile(s.user).Context(ctx).Do()
+}
+
+func (s *gmailService) Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error) {
+	return s.svc.Users.Watch(s.user, req).Context(ctx).Do()
+}
+
+func (s *gmailService) ListHistory(ctx context.Context, startID uint64, types []string, pageToken string) (*gmail.ListHistoryResponse, error) {
+	call := s.svc.Users.History.List(s.user).StartHistoryId(startID).HistoryTypes(types...).Context(ctx)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	return call.Do()
+}
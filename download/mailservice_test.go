@@ -0,0 +1,213 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// forEachMailService runs test against a FakeMail used directly and through
+// gmailService talking to it over HTTP, as both must behave the same.
+func forEachMailService(t *testing.T, test func(t *testing.T, fake *FakeMail, svc MailService)) {
+	t.Run("memory", func(t *testing.T) {
+		fake := NewFakeMail("me@example.com")
+		test(t, fake, fake)
+	})
+	t.Run("http", func(t *testing.T) {
+		fake := NewFakeMail("me@example.com")
+		srv := httptest.NewServer(fake)
+		defer srv.Close()
+		svc, err := NewFakeGmailService(srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, fake, svc)
+	})
+}
+
+func apiCode(err error) int {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
+
+func TestMailService_Messages(t *testing.T) {
+	forEachMailService(t, func(t *testing.T, fake *FakeMail, svc MailService) {
+		ctx := context.Background()
+		day := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+		statement := fake.AddMessage(FakeMessage{
+			From: "alerts@bank.example", Subject: "Your March statement", Date: day,
+			Body: "Please find it attached.", Labels: []string{"INBOX", "UNREAD", "Bank"},
+			Attachments: []FakeAttachment{{Filename: "march.pdf", MimeType: "application/pdf", Data: []byte("%PDF-1.4 march")}},
+		})
+		older := fake.AddMessage(FakeMessage{Subject: "Your February statement", Date: day.AddDate(0, -1, 0), Labels: []string{"Bank"}})
+		other := fake.AddMessage(FakeMessage{Subject: "Lunch?", Date: day, Labels: []string{"INBOX"}})
+
+		for query, want := range map[string]string{
+			"label:Bank subject:":                                     statement + "," + older,
+			"label:bank subject:(march statement)":                    statement,
+			"label:INBOX is:unread has:attachment":                    statement,
+			"label:Bank after:" + strconv.FormatInt(day.Unix()-1, 10): statement,
+			"from:bank filename:march":                                statement,
+			`lunch`:                                                   other,
+			"label:Bank before:2024/02/15":                            older,
+			"label:Missing":                                           "",
+		} {
+			resp, err := svc.ListMessages(ctx, query, "")
+			if err != nil {
+				t.Fatalf("ListMessages(%q) error = %v", query, err)
+			}
+			var ids []string
+			for _, m := range resp.Messages {
+				ids = append(ids, m.Id)
+			}
+			if got := strings.Join(ids, ","); got != want {
+				t.Errorf("ListMessages(%q) = %s, want %s", query, got, want)
+			}
+		}
+
+		fake.PageSize = 1
+		resp, err := svc.ListMessages(ctx, "label:Bank", "")
+		if err != nil || len(resp.Messages) != 1 || resp.NextPageToken == "" {
+			t.Fatalf("first page = %+v, %v", resp, err)
+		}
+		resp, err = svc.ListMessages(ctx, "label:Bank", resp.NextPageToken)
+		if err != nil || len(resp.Messages) != 1 || resp.Messages[0].Id != older || resp.NextPageToken != "" {
+			t.Fatalf("last page = %+v, %v", resp, err)
+		}
+
+		m, err := svc.GetMessage(ctx, statement, MessageFetch{Format: "metadata", Headers: []string{"Subject"}})
+		if err != nil || len(m.Payload.Headers) != 1 || m.Payload.Headers[0].Value != "Your March statement" || m.Payload.Parts != nil {
+			t.Errorf("metadata = %+v, %v", m.Payload, err)
+		}
+		m, err = svc.GetMessage(ctx, statement, MessageFetch{Format: "full"})
+		if err != nil || HeaderValue(m, "Date") != "Fri, 01 Mar 2024 09:00:00 +0000" || len(m.Payload.Parts) != 1 {
+			t.Fatalf("full = %+v, %v", m, err)
+		}
+		var data bytes.Buffer
+		part := m.Payload.Parts[0]
+		if n, err := svc.GetAttachment(ctx, statement, part.Body.AttachmentId, &data); err != nil || n != 14 || data.String() != "%PDF-1.4 march" {
+			t.Errorf("GetAttachment() = %d %q, %v", n, data.String(), err)
+		}
+
+		msgs, errs, err := svc.GetMessages(ctx, []string{other, "nope"}, MessageFetch{})
+		if err != nil || msgs[0].Id != other || errs[0] != nil || apiCode(errs[1]) != http.StatusNotFound {
+			t.Errorf("GetMessages() = %v, %v, %v", msgs, errs, err)
+		}
+
+		if err := svc.ModifyMessage(ctx, statement, &gmail.ModifyMessageRequest{RemoveLabelIds: []string{"UNREAD"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.ModifyMessage(ctx, statement, &gmail.ModifyMessageRequest{AddLabelIds: []string{"Label_99"}}); apiCode(err) != http.StatusBadRequest {
+			t.Errorf("adding a missing label: error = %v, want 400", err)
+		}
+		if err := svc.BatchModifyMessages(ctx, &gmail.BatchModifyMessagesRequest{Ids: []string{other, "nope"}, AddLabelIds: []string{"UNREAD"}}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := fake.Message(statement); strings.Join(got.Labels, ",") != "INBOX,Bank" {
+			t.Errorf("labels after modify = %v", got.Labels)
+		}
+		if got, _ := fake.Message(other); strings.Join(got.Labels, ",") != "INBOX,UNREAD" {
+			t.Errorf("labels after batch modify = %v", got.Labels)
+		}
+
+		if err := svc.DeleteMessage(ctx, older); err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.DeleteMessage(ctx, older); apiCode(err) != http.StatusNotFound {
+			t.Errorf("deleting again: error = %v, want 404", err)
+		}
+		if err := svc.BatchDeleteMessages(ctx, []string{statement, "nope"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fake.Message(statement); ok {
+			t.Error("the message is still there after BatchDeleteMessages")
+		}
+		if p, err := svc.GetProfile(ctx); err != nil || p.EmailAddress != "me@example.com" || p.MessagesTotal != 1 {
+			t.Errorf("GetProfile() = %+v, %v", p, err)
+		}
+	})
+}
+
+func TestMailService_HistoryAndWatch(t *testing.T) {
+	forEachMailService(t, func(t *testing.T, fake *FakeMail, svc MailService) {
+		ctx := context.Background()
+		bank := fake.CreateLabel("Bank")
+		p, err := svc.GetProfile(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := p.HistoryId
+		id := fake.AddMessage(FakeMessage{Subject: "Statement", Labels: []string{"INBOX"}})
+		fake.AddLabels(id, "Bank")
+
+		resp, err := svc.ListHistory(ctx, start, []string{"labelAdded"}, "")
+		if err != nil || len(resp.History) != 1 {
+			t.Fatalf("ListHistory() = %+v, %v", resp, err)
+		}
+		if added := resp.History[0].LabelsAdded; len(added) != 1 || added[0].Message.Id != id || added[0].LabelIds[0] != bank {
+			t.Errorf("labels added = %+v", added)
+		}
+		if resp.HistoryId != start+2 {
+			t.Errorf("history ID = %d, want %d", resp.HistoryId, start+2)
+		}
+		resp, err = svc.ListHistory(ctx, start, nil, "")
+		if err != nil || len(resp.History) != 2 || len(resp.History[0].MessagesAdded) != 1 {
+			t.Errorf("all history = %+v, %v", resp, err)
+		}
+
+		fake.ExpireHistory()
+		if _, err := svc.ListHistory(ctx, start, nil, ""); apiCode(err) != http.StatusNotFound {
+			t.Errorf("expired history: error = %v, want 404", err)
+		}
+
+		labels, err := svc.ListLabels(ctx)
+		if err != nil || len(labels) != 3 || labels[2].Name != "Bank" {
+			t.Errorf("ListLabels() = %v, %v", labels, err)
+		}
+		w, err := svc.Watch(ctx, &gmail.WatchRequest{TopicName: "projects/p/topics/t", LabelIds: []string{bank}})
+		if err != nil || w.HistoryId != start+2 || w.Expiration == 0 {
+			t.Errorf("Watch() = %+v, %v", w, err)
+		}
+		if watches := fake.Watches(); len(watches) != 1 || watches[0].TopicName != "projects/p/topics/t" {
+			t.Errorf("watches = %+v", watches)
+		}
+	})
+}
+
+func TestMailService_Fail(t *testing.T) {
+	forEachMailService(t, func(t *testing.T, fake *FakeMail, svc MailService) {
+		ctx := context.Background()
+		a := fake.AddMessage(FakeMessage{Subject: "a"})
+		b := fake.AddMessage(FakeMessage{Subject: "b"})
+		fake.Fail("messages.get", b, &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend Error"}, 1)
+		fake.Fail("batch", "", &googleapi.Error{Code: http.StatusTooManyRequests, Message: "Too many requests"}, 1)
+
+		if _, _, err := svc.GetMessages(ctx, []string{a, b}, MessageFetch{}); apiCode(err) != http.StatusTooManyRequests {
+			t.Errorf("batch error = %v, want 429", err)
+		}
+		_, errs, err := svc.GetMessages(ctx, []string{a, b}, MessageFetch{})
+		if err != nil || errs[0] != nil || apiCode(errs[1]) != http.StatusServiceUnavailable {
+			t.Errorf("GetMessages() errors = %v, %v, want b to fail", errs, err)
+		}
+		if _, err := svc.GetMessage(ctx, b, MessageFetch{}); err != nil {
+			t.Errorf("GetMessage() after the failures = %v", err)
+		}
+
+		want := []string{"batch 2", "batch 2", "messages.get " + a, "messages.get " + b, "messages.get " + b}
+		if got := fake.Calls(); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("calls = %q, want %q", got, want)
+		}
+	})
+}
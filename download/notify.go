@@ -0,0 +1,568 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Types of notifications.
+const (
+	// NotifyWebhook posts the event as a JSON object to a URL.
+	NotifyWebhook = "webhook"
+	// NotifySlack posts the message to a Slack incoming webhook, or to
+	// anything accepting its {"text": ...} payload.
+	NotifySlack = "slack"
+	// NotifySMTP mails the message through a relay.
+	NotifySMTP = "smtp"
+	// NotifyNtfy publishes the message to an ntfy topic, the URL of the
+	// topic on the server.
+	NotifyNtfy = "ntfy"
+)
+
+// Events notifications are sent on.
+const (
+	// EventRun is the completion of a run, interrupted or not.
+	EventRun = "run"
+	// EventError is a run that had failures, or failed altogether. A run
+	// with failures is notified once, as an error to the notifications on
+	// errors and as a run to those only on runs.
+	EventError = "error"
+	// EventFile is a file saved: an attachment or an email as a PDF.
+	EventFile = "file"
+)
+
+// notifyTimeout bounds how long sending a notification may take, so that a
+// slow endpoint does not hold up the run for long.
+const notifyTimeout = 10 * time.Second
+
+// Notification is a notification of the config: where to send what, on
+// which events.
+type Notification struct {
+	// Name tells the notification apart in the log; its type and index
+	// when empty.
+	Name string `json:"name"`
+	// Type is NotifyWebhook, NotifySlack, NotifySMTP or NotifyNtfy.
+	Type string `json:"type"`
+	// On lists the events to notify of: EventRun, EventError and
+	// EventFile. Defaults to errors only.
+	On []string `json:"on"`
+	// Labels, if set, limits the notifications to runs and files of these
+	// labels.
+	Labels []string `json:"labels"`
+
+	// URL is where webhook, slack and ntfy notifications are posted; for
+	// ntfy, the URL of the topic, e.g. https://ntfy.sh/my-statements.
+	URL Secret `json:"url"`
+	// Headers are added to the HTTP requests, e.g. Authorization.
+	Headers map[string]Secret `json:"headers"`
+	// Token is the access token of an ntfy topic.
+	Token Secret `json:"token"`
+	// Priority and Tags are the priority (1-5, min to max) and tags of ntfy
+	// messages.
+	Priority string   `json:"priority"`
+	Tags     []string `json:"tags"`
+	// SMTP is the relay smtp notifications are mailed through.
+	SMTP *SMTPSettings `json:"smtp"`
+
+	// Title and Message are text/template templates of the title (the
+	// subject of emails) and the body of the notification, executed with
+	// NotificationData. The defaults describe the event, the body of runs
+	// being their summary.
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// SMTPSettings say how to mail notifications.
+type SMTPSettings struct {
+	// Addr is the host:port of the relay. STARTTLS is used when the relay
+	// offers it.
+	Addr string `json:"addr"`
+	// Username and Password, if set, authenticate with PLAIN, which is only
+	// done over TLS or to localhost.
+	Username string   `json:"username"`
+	Password Secret   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// NotificationData is what the title and message templates of a
+// notification are executed with.
+type NotificationData struct {
+	// Event is EventRun, EventError or EventFile.
+	Event   string
+	Account string
+	Time    time.Time
+	// Result is the outcome of the run, nil for files and for runs that
+	// failed altogether.
+	Result *Result
+	// Summary is the summary of the result, one line per item.
+	Summary []string
+	// Failures is the number of failures of the run.
+	Failures int
+	// Error is what went wrong: the failures of the run, joined, or why it
+	// failed altogether.
+	Error string
+	// File is the file saved, for EventFile.
+	File *FileEvent
+}
+
+// notificationFuncs are the functions the templates may use besides the
+// builtin ones.
+var notificationFuncs = template.FuncMap{
+	"join": strings.Join,
+	"base": filepath.Base,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		return string(data), err
+	},
+}
+
+// Default templates of notifications.
+const (
+	defaultNotifyTitle = `gmail-download: ` +
+		`{{if eq .Event "file"}}saved {{base .File.Path}}` +
+		`{{else if eq .Event "error"}}{{if .Result}}{{.Failures}} failure(s){{else}}run failed{{end}}` +
+		`{{else if .Result.Interrupted}}run interrupted{{else}}run completed{{end}}` +
+		`{{with .Account}} for {{.}}{{end}}`
+	defaultNotifyMessage = `{{if .File}}Saved {{.File.Kind}} {{.File.Path}} ({{.File.Size}} bytes) ` +
+		`of message {{.File.MessageID}} in label {{.File.Label}}` +
+		`{{else if .Result}}{{join .Summary "\n"}}{{else}}{{.Error}}{{end}}`
+)
+
+var (
+	defaultTitleTemplate   = template.Must(newNotificationTemplate("title", defaultNotifyTitle))
+	defaultMessageTemplate = template.Must(newNotificationTemplate("message", defaultNotifyMessage))
+)
+
+func newNotificationTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(notificationFuncs).Option("missingkey=error").Parse(text)
+}
+
+// ntfyPriorities are the priorities ntfy accepts.
+var ntfyPriorities = []string{"1", "2", "3", "4", "5", "min", "low", "default", "high", "urgent", "max"}
+
+// validate checks a single notification. Paths in the returned problems
+// are relative to the notification, starting with ".".
+func (n *Notification) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(key, format string, args ...interface{}) {
+		path := ""
+		if key != "" {
+			path = "." + key
+		}
+		problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	known, isHTTP := true, false
+	switch n.Type {
+	case NotifyWebhook, NotifySlack, NotifyNtfy:
+		isHTTP = true
+		if !n.URL.IsSet() {
+			add("url", "url must be set for %s notifications", n.Type)
+		} else if !IsSecretRef(n.URL.ref) {
+			// References are checked once resolved, when sending.
+			if u, err := url.Parse(n.URL.ref); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add("url", "url must be an http or https URL")
+			}
+		}
+	case NotifySMTP:
+		if n.SMTP == nil {
+			add("smtp", "smtp must be set for smtp notifications")
+		} else {
+			for _, p := range n.SMTP.validate() {
+				problems = append(problems, ConfigProblem{Path: ".smtp" + p.Path, Message: p.Message})
+			}
+		}
+	case "":
+		known = false
+		add("type", "type must be set: webhook, slack, smtp or ntfy")
+	default:
+		known = false
+		add("type", "unknown notification type %q (supported: webhook, slack, smtp, ntfy)", n.Type)
+	}
+
+	for _, key := range []struct {
+		name string
+		set  bool
+		ok   bool
+	}{
+		{"url", n.URL.IsSet(), isHTTP},
+		{"headers", len(n.Headers) > 0, isHTTP},
+		{"smtp", n.SMTP != nil, n.Type == NotifySMTP},
+		{"token", n.Token.IsSet(), n.Type == NotifyNtfy},
+		{"priority", n.Priority != "", n.Type == NotifyNtfy},
+		{"tags", len(n.Tags) > 0, n.Type == NotifyNtfy},
+	} {
+		if key.set && !key.ok && known {
+			add(key.name, "%s has no effect on %s notifications", key.name, n.Type)
+		}
+	}
+	if n.Type == NotifyNtfy && n.Priority != "" && !slices.Contains(ntfyPriorities, n.Priority) {
+		add("priority", "unknown priority %q (supported: 1-5, min, low, default, high, urgent, max)", n.Priority)
+	}
+	for i, event := range n.On {
+		if event != EventRun && event != EventError && event != EventFile {
+			add(fmt.Sprintf("on[%d]", i), "unknown event %q (supported: run, error, file)", event)
+		}
+	}
+	for _, t := range []struct{ key, text string }{{"title", n.Title}, {"message", n.Message}} {
+		if _, err := newNotificationTemplate(t.key, t.text); err != nil {
+			add(t.key, "invalid template: %v", err)
+		}
+	}
+	return problems
+}
+
+func (s *SMTPSettings) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(key, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{Path: "." + key, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.Addr == "" {
+		add("addr", "addr must be set to the host:port of the relay")
+	} else if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		add("addr", "addr must be host:port: %v", err)
+	}
+	if s.From == "" {
+		add("from", "from must be set")
+	}
+	if len(s.To) == 0 {
+		add("to", "to must list at least one address")
+	}
+	if s.Password.IsSet() && s.Username == "" {
+		add("password", "password has no effect without username")
+	}
+	return problems
+}
+
+// name returns the name of the notification at index in the log.
+func (n *Notification) name(index int) string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return fmt.Sprintf("%s[%d]", n.Type, index)
+}
+
+// wants reports whether n is sent on event.
+func (n *Notification) wants(event string) bool {
+	if len(n.On) == 0 {
+		return event == EventError
+	}
+	return slices.Contains(n.On, event)
+}
+
+// wantsLabel reports whether n is sent for something about label.
+func (n *Notification) wantsLabel(label string) bool {
+	return len(n.Labels) == 0 || slices.Contains(n.Labels, label)
+}
+
+// Notifier sends the notifications of a config. It is the FileHook of the
+// Processor for the notifications on files; NotifyRun and NotifyError send
+// those on runs. Notifications are sent one after the other, and failing to
+// send one is logged but does not fail the run. A Notifier is safe for
+// concurrent use.
+type Notifier struct {
+	account string
+	client  *http.Client
+
+	mu            sync.RWMutex
+	notifications []Notification
+}
+
+// NewNotifier returns a Notifier sending notifications, which must be
+// valid, about the runs of account.
+func NewNotifier(notifications []Notification, account string) *Notifier {
+	return &Notifier{
+		account:       account,
+		client:        &http.Client{Timeout: notifyTimeout},
+		notifications: notifications,
+	}
+}
+
+// SetNotifications replaces the notifications sent, as when the config is
+// reloaded.
+func (n *Notifier) SetNotifications(notifications []Notification) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notifications = notifications
+}
+
+// OnFile notifies of a file saved. Files that could not be saved are
+// reported by the notifications on errors, at the end of the run. As the
+// file is saved whatever happens to the run, the notification is sent even
+// when ctx is cancelled.
+func (n *Notifier) OnFile(ctx context.Context, e FileEvent) {
+	if e.Path == "" || (e.Err != nil && e.Size == 0) {
+		return
+	}
+	n.notify(context.WithoutCancel(ctx), []string{e.Label}, func(*Notification) (string, *NotificationData) {
+		return EventFile, &NotificationData{Event: EventFile, File: &e}
+	})
+}
+
+// NotifyRun notifies of a completed run, as an error if it had failures.
+func (n *Notifier) NotifyRun(ctx context.Context, result *Result) {
+	permanent, transient := result.Failures()
+	data := NotificationData{Result: result, Summary: result.Summary(), Failures: permanent + transient}
+	if err := result.Err(); err != nil {
+		data.Error = err.Error()
+	}
+	labels := make([]string, len(result.Labels))
+	for i, l := range result.Labels {
+		labels[i] = l.Label
+	}
+	n.notify(ctx, labels, func(nt *Notification) (string, *NotificationData) {
+		d := data
+		d.Event = EventRun
+		if d.Failures > 0 && nt.wants(EventError) {
+			d.Event = EventError
+		}
+		return d.Event, &d
+	})
+}
+
+// NotifyError notifies that a run failed altogether with err, before it got
+// to any label.
+func (n *Notifier) NotifyError(ctx context.Context, err error) {
+	n.notify(ctx, nil, func(*Notification) (string, *NotificationData) {
+		return EventError, &NotificationData{Event: EventError, Failures: 1, Error: err.Error()}
+	})
+}
+
+// notify sends every notification that wants the event data returns for
+// it, about labels, nil for all.
+func (n *Notifier) notify(ctx context.Context, labels []string, data func(*Notification) (string, *NotificationData)) {
+	n.mu.RLock()
+	notifications := n.notifications
+	n.mu.RUnlock()
+
+	for i := range notifications {
+		nt := &notifications[i]
+		event, d := data(nt)
+		if !nt.wants(event) || (labels != nil && !slices.ContainsFunc(labels, nt.wantsLabel)) {
+			continue
+		}
+		d.Account, d.Time = n.account, time.Now()
+		l := slog.Default().With("notification", nt.name(i), "event", event)
+		if err := n.send(ctx, nt, d); err != nil {
+			l.Warn("unable to send notification", AttrError, err)
+			continue
+		}
+		l.Debug("sent notification")
+	}
+}
+
+// send sends the notification nt of d.
+func (n *Notifier) send(ctx context.Context, nt *Notification, d *NotificationData) error {
+	title, err := render(nt.Title, defaultTitleTemplate, d)
+	if err != nil {
+		return fmt.Errorf("title: %w", err)
+	}
+	message, err := render(nt.Message, defaultMessageTemplate, d)
+	if err != nil {
+		return fmt.Errorf("message: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	switch nt.Type {
+	case NotifyWebhook:
+		body, err := json.Marshal(newNotificationPayload(d, title, message))
+		if err != nil {
+			return err
+		}
+		return n.post(ctx, nt, bytes.NewReader(body), map[string]string{"Content-Type": "application/json"})
+	case NotifySlack:
+		body, err := json.Marshal(map[string]string{"text": "*" + title + "*\n" + message})
+		if err != nil {
+			return err
+		}
+		return n.post(ctx, nt, bytes.NewReader(body), map[string]string{"Content-Type": "application/json"})
+	case NotifyNtfy:
+		headers := map[string]string{"Title": mime.QEncoding.Encode("utf-8", title)}
+		if nt.Priority != "" {
+			headers["Priority"] = nt.Priority
+		}
+		if len(nt.Tags) > 0 {
+			headers["Tags"] = strings.Join(nt.Tags, ",")
+		}
+		if nt.Token.IsSet() {
+			headers["Authorization"] = "Bearer " + nt.Token.Reveal()
+		}
+		return n.post(ctx, nt, strings.NewReader(message), headers)
+	case NotifySMTP:
+		return sendMail(ctx, nt.SMTP, title, message)
+	}
+	return fmt.Errorf("unknown notification type %q", nt.Type)
+}
+
+// render executes the template text, or def when text is empty, with d.
+func render(text string, def *template.Template, d *NotificationData) (string, error) {
+	t := def
+	if text != "" {
+		var err error
+		if t, err = newNotificationTemplate(def.Name(), text); err != nil {
+			return "", err
+		}
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, d); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// notificationPayload is the JSON object webhook notifications post.
+type notificationPayload struct {
+	Event    string    `json:"event"`
+	Account  string    `json:"account,omitempty"`
+	Time     time.Time `json:"time"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Failures int       `json:"failures,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// Result is the report of the run.
+	Result *Result       `json:"result,omitempty"`
+	File   *notifiedFile `json:"file,omitempty"`
+}
+
+// notifiedFile is a saved file in a webhook notification.
+type notifiedFile struct {
+	Label     string `json:"label"`
+	Action    int    `json:"action"`
+	MessageID string `json:"message_id"`
+	FileResult
+	Error string `json:"error,omitempty"`
+}
+
+func newNotificationPayload(d *NotificationData, title, message string) notificationPayload {
+	p := notificationPayload{
+		Event:    d.Event,
+		Account:  d.Account,
+		Time:     d.Time,
+		Title:    title,
+		Message:  message,
+		Failures: d.Failures,
+		Error:    d.Error,
+		Result:   d.Result,
+	}
+	if e := d.File; e != nil {
+		p.File = &notifiedFile{Label: e.Label, Action: e.Action, MessageID: e.MessageID, FileResult: e.FileResult}
+		if e.Err != nil {
+			p.File.Error = e.Err.Error()
+		}
+	}
+	return p
+}
+
+// post posts body to the URL of nt with the headers of nt and headers.
+func (n *Notifier) post(ctx context.Context, nt *Notification, body io.Reader, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nt.URL.Reveal(), body)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range nt.Headers {
+		req.Header.Set(k, v.Reveal())
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// The URL may hold a token, as Slack's do.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("posting to %s: %w", req.URL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("posting to %s: %s: %s", req.URL.Redacted(), resp.Status, bytes.TrimSpace(text))
+	}
+	return nil
+}
+
+// sendMail mails subject and body through the relay of s.
+func sendMail(ctx context.Context, s *SMTPSettings, subject, body string) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password.Reveal(), host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mailMessage(s, subject, body, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// mailMessage returns the email of subject and body sent at date.
+func mailMessage(s *SMTPSettings, subject, body string, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
@@ -0,0 +1,360 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotificationValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		notification Notification
+		want         []string
+	}{
+		{
+			name:         "valid webhook",
+			notification: Notification{Type: NotifyWebhook, URL: secretValue("https://example.com/hook"), On: []string{EventRun, EventFile}},
+		},
+		{
+			name:         "webhook url from the environment",
+			notification: Notification{Type: NotifySlack, URL: secretValue("env:SLACK_WEBHOOK_URL")},
+		},
+		{
+			name: "valid smtp",
+			notification: Notification{Type: NotifySMTP, SMTP: &SMTPSettings{
+				Addr: "relay.example.com:587", Username: "me", Password: secretValue("pw"), From: "me@example.com", To: []string{"you@example.com"}}},
+		},
+		{
+			name:         "no type",
+			notification: Notification{URL: secretValue("https://example.com/hook")},
+			want:         []string{"type must be set"},
+		},
+		{
+			name:         "unknown type and event",
+			notification: Notification{Type: "pager", On: []string{"run", "saved"}},
+			want:         []string{`unknown notification type "pager"`, `unknown event "saved"`},
+		},
+		{
+			name:         "bad url",
+			notification: Notification{Type: NotifyNtfy, URL: secretValue("ntfy.sh/statements"), Priority: "loud"},
+			want:         []string{"url must be an http or https URL", `unknown priority "loud"`},
+		},
+		{
+			name:         "smtp without settings",
+			notification: Notification{Type: NotifySMTP, URL: secretValue("https://example.com/hook")},
+			want:         []string{"smtp must be set", "url has no effect on smtp notifications"},
+		},
+		{
+			name:         "incomplete smtp",
+			notification: Notification{Type: NotifySMTP, SMTP: &SMTPSettings{Addr: "relay.example.com", Password: secretValue("pw")}},
+			want:         []string{"addr must be host:port", "from must be set", "to must list at least one address", "password has no effect without username"},
+		},
+		{
+			name:         "ntfy settings on a webhook",
+			notification: Notification{Type: NotifyWebhook, URL: secretValue("https://example.com/hook"), Token: secretValue("tk"), Tags: []string{"bank"}},
+			want:         []string{"token has no effect on webhook notifications", "tags has no effect on webhook notifications"},
+		},
+		{
+			name:         "invalid template",
+			notification: Notification{Type: NotifyWebhook, URL: secretValue("https://example.com/hook"), Message: "{{.Result"},
+			want:         []string{"invalid template"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.notification.validate()
+			if len(problems) != len(tt.want) {
+				t.Fatalf("validate() = %v, want %d problem(s)", problems, len(tt.want))
+			}
+			for i, p := range problems {
+				if !strings.Contains(p.Message, tt.want[i]) {
+					t.Errorf("validate()[%d] = %q, want it to contain %q", i, p.Message, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Notifications(t *testing.T) {
+	t.Setenv("GMAIL_TEST_HOOK", "https://hooks.example.com/T000/B000/XXXX")
+	config, err := LoadConfig(writeConfig(t, "config.yaml", `
+label_actions:
+  - label: Bank
+    actions: [{mark_as_read: true}]
+notifications:
+  - type: slack
+    url: env:GMAIL_TEST_HOOK
+  - type: ntfy
+    url: https://ntfy.sh/statements
+    on: [file]
+    labels: [Bank]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if len(config.Notifications) != 2 || config.Notifications[0].URL.Reveal() != "https://hooks.example.com/T000/B000/XXXX" {
+		t.Errorf("notifications = %+v, want 2 with the Slack URL resolved", config.Notifications)
+	}
+
+	problems := configProblems(t, `{"label_actions": [{"label": "Bank", "actions": [{"mark_as_read": true}]}],
+"notifications": [{"type": "webhook", "url": "https://example.com/hook", "on": ["done"]}]}`)
+	if len(problems) != 1 || problems[0].Path != "notifications[0].on[0]" || problems[0].Line != 2 {
+		t.Errorf("LoadConfig() problems = %v, want the unknown event on line 2", problems)
+	}
+}
+
+// request is a request received by a notification endpoint.
+type request struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+// notificationServer returns a server recording the requests it receives.
+func notificationServer(t *testing.T) (*httptest.Server, func() []request) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, request{path: r.URL.Path, header: r.Header, body: string(body)})
+		mu.Unlock()
+		if r.URL.Path == "/broken" {
+			http.Error(w, "no such hook", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]request(nil), requests...)
+	}
+}
+
+// requestsTo returns the requests to path.
+func requestsTo(requests []request, path string) []request {
+	var to []request
+	for _, r := range requests {
+		if r.path == path {
+			to = append(to, r)
+		}
+	}
+	return to
+}
+
+func TestNotifier_HTTP(t *testing.T) {
+	logs := captureLog(t)
+	srv, received := notificationServer(t)
+	notifier := NewNotifier([]Notification{
+		{Type: NotifyWebhook, URL: secretValue(srv.URL + "/hook"), On: []string{EventRun, EventError, EventFile},
+			Headers: map[string]Secret{"Authorization": secretValue("Bearer hook-token")}},
+		{Type: NotifySlack, URL: secretValue(srv.URL + "/slack")},
+		{Type: NotifyNtfy, URL: secretValue(srv.URL + "/statements"), On: []string{EventFile}, Labels: []string{"Bank"},
+			Token: secretValue("tk_secret"), Priority: "high", Tags: []string{"bank", "page_facing_up"}},
+		{Type: NotifyNtfy, URL: secretValue(srv.URL + "/receipts"), On: []string{EventFile}, Labels: []string{"Receipts"}},
+		{Name: "broken", Type: NotifyWebhook, URL: secretValue(srv.URL + "/broken"), On: []string{EventRun}},
+	}, "me@example.com")
+
+	fake, _ := newTestMailbox(2)
+	p, err := NewProcessor(statementConfig(t.TempDir()), fake, LocalStorage{}, Options{User: "me", Workers: 1, FileHook: notifier})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Run(context.Background())
+	if err != nil || result.Err() != nil {
+		t.Fatalf("Run() = %v, %v", err, result.Err())
+	}
+	notifier.NotifyRun(context.Background(), result)
+
+	requests := received()
+	hook := requestsTo(requests, "/hook")
+	if len(hook) != 3 {
+		t.Fatalf("webhook got %d requests, want 2 files and the run", len(hook))
+	}
+	var file, run notificationPayload
+	if err := json.Unmarshal([]byte(hook[0].body), &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Event != EventFile || file.File == nil || file.File.Label != "Bank" || file.File.Size != int64(len("not really a pdf")) ||
+		!strings.HasPrefix(file.Title, "gmail-download: saved statement") {
+		t.Errorf("file notification = %s", hook[0].body)
+	}
+	if got := hook[0].header.Get("Authorization"); got != "Bearer hook-token" {
+		t.Errorf("webhook Authorization = %q, want the configured header", got)
+	}
+	if err := json.Unmarshal([]byte(hook[2].body), &run); err != nil {
+		t.Fatal(err)
+	}
+	if run.Event != EventRun || run.Account != "me@example.com" || run.Result == nil || len(run.Result.Labels) != 1 ||
+		!strings.Contains(run.Message, "label Bank, action 0: 2 matched") {
+		t.Errorf("run notification = %s", hook[2].body)
+	}
+
+	// Slack is only told about errors, the default.
+	if n := len(requestsTo(requests, "/slack")); n != 0 {
+		t.Errorf("slack got %d requests for a run without failures, want none", n)
+	}
+	ntfy := requestsTo(requests, "/statements")
+	if len(ntfy) != 2 || len(requestsTo(requests, "/receipts")) != 0 {
+		t.Fatalf("ntfy topics got %d requests, want the 2 files of Bank only", len(ntfy))
+	}
+	if h := ntfy[0].header; h.Get("Authorization") != "Bearer tk_secret" || h.Get("Priority") != "high" ||
+		h.Get("Tags") != "bank,page_facing_up" || !strings.HasPrefix(h.Get("Title"), "gmail-download: saved statement") {
+		t.Errorf("ntfy headers = %v", h)
+	}
+	if !strings.HasPrefix(ntfy[0].body, "Saved attachment ") {
+		t.Errorf("ntfy message = %q, want the saved file", ntfy[0].body)
+	}
+	if !strings.Contains(logs.String(), `level=WARN msg="unable to send notification" notification=broken event=run`) ||
+		!strings.Contains(logs.String(), "404 Not Found: no such hook") {
+		t.Errorf("log does not have the failed notification:\n%s", logs)
+	}
+
+	notifier.NotifyError(context.Background(), errors.New("unable to read checkpoint"))
+	slack := requestsTo(received(), "/slack")
+	if len(slack) != 1 {
+		t.Fatalf("slack got %d requests, want the error", len(slack))
+	}
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(slack[0].body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if want := "*gmail-download: run failed for me@example.com*\nunable to read checkpoint"; payload["text"] != want {
+		t.Errorf("slack text = %q, want %q", payload["text"], want)
+	}
+}
+
+func TestNotifier_RunWithFailures(t *testing.T) {
+	captureLog(t)
+	srv, received := notificationServer(t)
+	notifier := NewNotifier([]Notification{
+		{Type: NotifyWebhook, URL: secretValue(srv.URL + "/errors")},
+		{Type: NotifyWebhook, URL: secretValue(srv.URL + "/runs"), On: []string{EventRun},
+			Title: "{{.Event}} {{.Failures}}", Message: "{{range .Result.Labels}}{{.Label}}: {{.Files}} file(s){{end}}"},
+		{Type: NotifyWebhook, URL: secretValue(srv.URL + "/bad"), On: []string{EventRun}, Message: "{{.File.Path}}"},
+	}, "")
+	result := &Result{Labels: []*LabelResult{{Label: "Bank", Files: 1, Failures: []error{errors.New("save failed")}, Actions: []*ActionResult{{
+		Messages: []*MessageResult{{ID: "m1", Errors: []ErrorResult{{Step: StepSave, Category: ErrorPermanent, Message: "save failed"}}}},
+	}}}}}
+	notifier.NotifyRun(context.Background(), result)
+
+	requests := received()
+	var failed, run notificationPayload
+	if r := requestsTo(requests, "/errors"); len(r) != 1 || json.Unmarshal([]byte(r[0].body), &failed) != nil {
+		t.Fatalf("errors webhook got %v, want the failed run", r)
+	}
+	if failed.Event != EventError || failed.Failures != 1 || failed.Error != "save failed" || failed.Title != "gmail-download: 1 failure(s)" {
+		t.Errorf("error notification = %+v", failed)
+	}
+	if r := requestsTo(requests, "/runs"); len(r) != 1 || json.Unmarshal([]byte(r[0].body), &run) != nil {
+		t.Fatalf("runs webhook got %v, want the run", r)
+	}
+	if run.Event != EventRun || run.Title != "run 1" || run.Message != "Bank: 1 file(s)" {
+		t.Errorf("run notification = %+v, want the templated title and message", run)
+	}
+	// A template failing on the data is not sent.
+	if r := requestsTo(requests, "/bad"); len(r) != 0 {
+		t.Errorf("bad template webhook got %v, want nothing", r)
+	}
+}
+
+// smtpServer accepts a single SMTP session on a local port and sends the
+// envelope and message it receives to the returned channel.
+func smtpServer(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 localhost ESMTP")
+		var session []string
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb, _, _ := strings.Cut(line, " "); strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				c.PrintfLine("250 localhost")
+			case "DATA":
+				c.PrintfLine("354 go ahead")
+				data, _ := c.ReadDotBytes()
+				session = append(session, string(data))
+				c.PrintfLine("250 queued")
+			case "QUIT":
+				c.PrintfLine("221 bye")
+				received <- session
+				return
+			default:
+				session = append(session, line)
+				c.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestNotifier_SMTP(t *testing.T) {
+	captureLog(t)
+	addr, received := smtpServer(t)
+	notifier := NewNotifier([]Notification{{Type: NotifySMTP, On: []string{EventRun}, SMTP: &SMTPSettings{
+		Addr: addr, From: "gmail-download@example.com", To: []string{"me@example.com", "you@example.com"}}}}, "me@example.com")
+	notifier.NotifyRun(context.Background(), &Result{Labels: []*LabelResult{{Label: "Bank"}}, Duration: Duration(time.Second)})
+
+	var session []string
+	select {
+	case session = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the mail")
+	}
+	if len(session) != 4 || session[0] != "MAIL FROM:<gmail-download@example.com>" ||
+		session[1] != "RCPT TO:<me@example.com>" || session[2] != "RCPT TO:<you@example.com>" {
+		t.Fatalf("SMTP session = %q, want the sender, both recipients and the message", session)
+	}
+	for _, want := range []string{
+		"From: gmail-download@example.com\n",
+		"To: me@example.com, you@example.com\n",
+		"Subject: gmail-download: run completed for me@example.com\n",
+		"Content-Type: text/plain; charset=utf-8\n",
+		"\n\nRun completed in 1s: 1 label(s), 0 message(s)",
+	} {
+		if !strings.Contains(session[3], want) {
+			t.Errorf("mail does not have %q:\n%s", want, session[3])
+		}
+	}
+}
+
+func TestMailMessage_EncodesSubject(t *testing.T) {
+	msg := string(mailMessage(&SMTPSettings{From: "a@example.com", To: []string{"b@example.com"}}, "saved März.pdf", "line 1\nline 2",
+		time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)))
+	for _, want := range []string{
+		"Subject: =?utf-8?q?saved_M=C3=A4rz.pdf?=\r\n",
+		"Date: Fri, 01 Mar 2024 09:00:00 +0000\r\n",
+		"\r\n\r\nline 1\r\nline 2\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("mail does not have %q:\n%s", want, msg)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// PdfEncryption re-encrypts the PDFs an action saves with passwords of our
+// own, using AES-256.
+type PdfEncryption struct {
+	// Password is needed to open the file. When empty, anyone can open it
+	// but only with the rights given by Permissions.
+	Password Secret `json:"password"`
+	// OwnerPassword lifts the restrictions. It defaults to Password.
+	OwnerPassword Secret `json:"owner_password"`
+	// Permissions lists what a reader without the owner password may do:
+	// any of print, modify, copy, annotate, fill and assemble, or all.
+	// Nothing is allowed by default.
+	Permissions []string `json:"permissions"`
+}
+
+// pdfPermissions maps the names accepted in permissions to pdfcpu flags.
+var pdfPermissions = map[string]model.PermissionFlags{
+	"print":    model.PermissionPrintRev2 | model.PermissionPrintRev3,
+	"modify":   model.PermissionModify,
+	"copy":     model.PermissionExtract | model.PermissionExtractRev3,
+	"annotate": model.PermissionModAnnFillForm,
+	"fill":     model.PermissionFillRev3,
+	"assemble": model.PermissionAssembleRev3,
+	"all":      model.PermissionsAll,
+}
+
+// errPDFStillEncrypted is returned by encryptPDF for a file that still has
+// the sender's encryption.
+var errPDFStillEncrypted = errors.New("PDF is still encrypted with its original password; set pdf_password so it can be decrypted first")
+
+// validate checks the encryption settings. Paths in the returned problems are
+// relative to encrypt_pdf, starting with ".".
+func (e *PdfEncryption) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	if !e.Password.IsSet() && !e.OwnerPassword.IsSet() {
+		problems = append(problems, ConfigProblem{Message: "encrypt_pdf needs a password or an owner_password"})
+	}
+	for i, name := range e.Permissions {
+		if _, ok := pdfPermissions[name]; !ok {
+			problems = append(problems, ConfigProblem{
+				Path:    fmt.Sprintf(".permissions[%d]", i),
+				Message: fmt.Sprintf("unknown permission %q (supported: %s)", name, strings.Join(permissionNames(), ", ")),
+			})
+		}
+	}
+	return problems
+}
+
+func permissionNames() []string {
+	names := make([]string, 0, len(pdfPermissions))
+	for name := range pdfPermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configuration returns the pdfcpu configuration encrypting with e.
+func (e *PdfEncryption) configuration() *model.Configuration {
+	owner := e.OwnerPassword.Reveal()
+	if owner == "" {
+		owner = e.Password.Reveal()
+	}
+	conf := model.NewAESConfiguration(e.Password.Reveal(), owner, 256)
+	conf.Permissions = model.PermissionsNone
+	for _, name := range e.Permissions {
+		conf.Permissions |= pdfPermissions[name]
+	}
+	return conf
+}
+
+// encryptPDF encrypts the PDF at path in storage in place. The file is only
+// replaced once encryption succeeded, so the original is untouched on error.
+func encryptPDF(storage Storage, path string, e *PdfEncryption) error {
+	data, err := readFile(storage, path)
+	if err != nil {
+		return err
+	}
+	isEncrypted, err := encrypted(data)
+	if err != nil {
+		return err
+	}
+	if isEncrypted {
+		return errPDFStillEncrypted
+	}
+
+	var out bytes.Buffer
+	if err := api.Encrypt(bytes.NewReader(data), &out, e.configuration()); err != nil {
+		return err
+	}
+	return writeFile(storage, path, out.Bytes())
+}
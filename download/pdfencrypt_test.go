@@ -0,0 +1,101 @@
+package download
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+func TestEncryptPDF(t *testing.T) {
+	path := writeTestPDF(t, t.TempDir(), "")
+	enc := &PdfEncryption{
+		Password:      secretValue("team"),
+		OwnerPassword: secretValue("admin"),
+		Permissions:   []string{"print"},
+	}
+
+	if err := encryptPDF(LocalStorage{}, path, enc); err != nil {
+		t.Fatalf("encryptPDF() error = %v", err)
+	}
+	if encrypted, err := pdfEncrypted(LocalStorage{}, path); err != nil || !encrypted {
+		t.Fatalf("pdfEncrypted() = %v, %v, want true", encrypted, err)
+	}
+
+	conf := model.NewDefaultConfiguration()
+	conf.UserPW, conf.OwnerPW = "team", "admin"
+	p, err := api.GetPermissionsFile(path, conf)
+	if err != nil || p == nil {
+		t.Fatalf("GetPermissionsFile() = %v, %v", p, err)
+	}
+	perms := model.PermissionFlags(uint16(*p))
+	if perms&model.PermissionPrintRev3 == 0 || perms&model.PermissionExtract != 0 {
+		t.Errorf("permissions = %#x, want print but not copy", uint16(*p))
+	}
+
+	// Our own password opens it again
+	if index, _, err := decryptPDF(LocalStorage{}, path, []string{"team"}); err != nil || index != 0 {
+		t.Errorf("decryptPDF() with the team password = %d, %v", index, err)
+	}
+}
+
+func TestEncryptPDF_StillEncrypted(t *testing.T) {
+	path := writeTestPDF(t, t.TempDir(), "bank")
+	before := mustReadFile(t, path)
+
+	err := encryptPDF(LocalStorage{}, path, &PdfEncryption{Password: secretValue("team")})
+	if !errors.Is(err, errPDFStillEncrypted) {
+		t.Fatalf("encryptPDF() error = %v, want errPDFStillEncrypted", err)
+	}
+	if string(mustReadFile(t, path)) != string(before) {
+		t.Error("encryptPDF() changed the file on error")
+	}
+}
+
+func TestSecurePDF_DecryptThenEncrypt(t *testing.T) {
+	path := writeTestPDF(t, t.TempDir(), "bank")
+	action := Action{
+		Download:     true,
+		PdfPasswords: []Secret{secretValue("bank")},
+		EncryptPdf:   &PdfEncryption{Password: secretValue("team")},
+	}
+
+	file := FileResult{Kind: FileAttachment, Path: path}
+	if _, err := securePDF(LocalStorage{}, slog.Default(), action, &file); err != nil {
+		t.Fatalf("securePDF() error = %v", err)
+	}
+	if file.Decrypt != DecryptDecrypted || !file.Encrypted {
+		t.Errorf("file = %+v, want it decrypted and encrypted", file)
+	}
+	if _, _, err := decryptPDF(LocalStorage{}, path, []string{"bank"}); !errors.Is(err, errNoPDFPassword) {
+		t.Errorf("decryptPDF() with the bank password error = %v, want errNoPDFPassword", err)
+	}
+	if index, _, err := decryptPDF(LocalStorage{}, path, []string{"team"}); err != nil || index != 0 {
+		t.Errorf("decryptPDF() with the team password = %d, %v", index, err)
+	}
+}
+
+func TestPdfEncryptionValidate(t *testing.T) {
+	problems := configProblems(t, `{"label_actions": [{"label": "Bank", "actions": [
+	{"download_attachment": true, "save_to": "/tmp", "encrypt_pdf": {"permissions": ["print", "read"]}},
+	{"mark_as_read": true, "encrypt_pdf": {"password": "env:GMAIL_TEST_UNSET_PW"}}
+]}]}`)
+
+	want := []string{
+		"encrypt_pdf needs a password",
+		`unknown permission "read"`,
+		"encrypt_pdf has no effect",
+		"GMAIL_TEST_UNSET_PW is not set",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("LoadConfig() problems = %v, want %d", problems, len(want))
+	}
+	for i, w := range want {
+		if !strings.Contains(problems[i].Message, w) {
+			t.Errorf("problem[%d] = %v, want %q", i, problems[i], w)
+		}
+	}
+}
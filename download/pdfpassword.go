@@ -0,0 +1,208 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// errNoPDFPassword is returned by decryptPDF when none of the passwords
+// opens the file.
+var errNoPDFPassword = errors.New("none of the passwords opens the PDF")
+
+// passwordFuncs are the functions available to pdf_password_templates, in
+// addition to the text/template builtins. Functions taking a count or layout
+// take the value last, so they can be used in pipelines:
+// {{.name | first 4 | upper}}{{.dob | date "0201"}}.
+var passwordFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	"first": func(n int, s string) string {
+		r := []rune(s)
+		if n < len(r) {
+			r = r[:n]
+		}
+		return string(r)
+	},
+	"last": func(n int, s string) string {
+		r := []rune(s)
+		if n < len(r) {
+			r = r[len(r)-n:]
+		}
+		return string(r)
+	},
+	"digits": func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, s)
+	},
+	"nospace": func(s string) string {
+		return strings.Join(strings.Fields(s), "")
+	},
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	"date": func(layout, s string) (string, error) {
+		for _, in := range []string{"2006-01-02", "02/01/2006", "02-01-2006", "02.01.2006", "20060102"} {
+			if t, err := time.Parse(in, s); err == nil {
+				return t.Format(layout), nil
+			}
+		}
+		return "", fmt.Errorf("cannot parse %q as a date (want YYYY-MM-DD or DD/MM/YYYY)", s)
+	},
+}
+
+// parsePasswordTemplate parses one of pdf_password_templates.
+func parsePasswordTemplate(text string) (*template.Template, error) {
+	return template.New("pdf_password").Funcs(passwordFuncs).Option("missingkey=error").Parse(text)
+}
+
+// derivePasswords renders the password templates of every action with its
+// resolved variables. It runs after resolveSecrets, at load time, so that a
+// template referring to a missing variable is reported as a config problem.
+func (c *Config) derivePasswords() []ConfigProblem {
+	var problems []ConfigProblem
+	for i := range c.LabelActions {
+		for j := range c.LabelActions[i].Actions {
+			action := &c.LabelActions[i].Actions[j]
+			vars := make(map[string]string, len(action.PdfPasswordVars))
+			for name, value := range action.PdfPasswordVars {
+				vars[name] = value.Reveal()
+			}
+			action.derivedPasswords = nil
+			for k, text := range action.PdfPasswordTemplates {
+				tmpl, err := parsePasswordTemplate(text)
+				if err != nil {
+					continue // reported by Validate
+				}
+				var b strings.Builder
+				if err := tmpl.Execute(&b, vars); err != nil {
+					problems = append(problems, ConfigProblem{
+						Path:    fmt.Sprintf("label_actions[%d].actions[%d].pdf_password_templates[%d]", i, j, k),
+						Message: fmt.Sprintf("cannot derive password: %v", err),
+					})
+					continue
+				}
+				action.derivedPasswords = append(action.derivedPasswords, b.String())
+			}
+		}
+	}
+	return problems
+}
+
+// pdfPasswordCandidates returns the passwords to try on an encrypted PDF, in
+// order: pdf_password, pdf_passwords and then the derived ones. Duplicates and
+// empty values are dropped.
+func (a *Action) pdfPasswordCandidates() []string {
+	var candidates []string
+	seen := make(map[string]bool)
+	add := func(pw string) {
+		if pw != "" && !seen[pw] {
+			seen[pw] = true
+			candidates = append(candidates, pw)
+		}
+	}
+	add(a.PdfPassword.Reveal())
+	for _, pw := range a.PdfPasswords {
+		add(pw.Reveal())
+	}
+	for _, pw := range a.derivedPasswords {
+		add(pw)
+	}
+	return candidates
+}
+
+// pdfEncrypted reports whether the PDF at path in storage is encrypted.
+// Files that only have an owner password count as encrypted, since they
+// open without one.
+func pdfEncrypted(storage Storage, path string) (bool, error) {
+	data, err := readFile(storage, path)
+	if err != nil {
+		return false, err
+	}
+	return encrypted(data)
+}
+
+func encrypted(data []byte) (bool, error) {
+	ctx, err := api.ReadContext(bytes.NewReader(data), model.NewDefaultConfiguration())
+	if errors.Is(err, pdfcpu.ErrWrongPassword) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ctx.Encrypt != nil, nil
+}
+
+// decryptPDF decrypts the PDF at path in storage in place, trying an empty
+// password and then each of passwords in turn. It returns the index of the
+// password that worked (-1 for the empty one) and whether the file was
+// encrypted at all. The file is only replaced once decryption succeeded, so
+// on error the original is left untouched.
+func decryptPDF(storage Storage, path string, passwords []string) (index int, isEncrypted bool, err error) {
+	data, err := readFile(storage, path)
+	if err != nil {
+		return -1, false, err
+	}
+	if isEncrypted, err = encrypted(data); err != nil || !isEncrypted {
+		return -1, isEncrypted, err
+	}
+
+	// The file was readable above, so a failure now is down to the password,
+	// e.g. one the encryption scheme cannot represent: try the next one.
+	var lastErr error
+	for i, pw := range append([]string{""}, passwords...) {
+		conf := model.NewDefaultConfiguration()
+		conf.UserPW = pw
+		conf.OwnerPW = pw
+		var out bytes.Buffer
+		err := api.Decrypt(bytes.NewReader(data), &out, conf)
+		if err == nil {
+			return i - 1, true, writeFile(storage, path, out.Bytes())
+		}
+		if !errors.Is(err, pdfcpu.ErrWrongPassword) {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return -1, true, fmt.Errorf("%w (%v)", errNoPDFPassword, lastErr)
+	}
+	return -1, true, errNoPDFPassword
+}
+
+// readFile returns the content of the file at path in storage. Saved PDFs
+// are read whole, as pdfcpu needs to seek through them.
+func readFile(storage Storage, path string) ([]byte, error) {
+	f, err := storage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFile replaces the file at path in storage with data.
+func writeFile(storage Storage, path string, data []byte) error {
+	f, err := storage.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,174 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return data
+}
+
+// writeTestPDF writes a one-page PDF to dir, encrypted with userPW unless it
+// is empty.
+func writeTestPDF(t *testing.T, dir, userPW string) string {
+	t.Helper()
+	path := filepath.Join(dir, "statement.pdf")
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetFont("Arial", "", 12)
+	pdf.AddPage()
+	pdf.CellFormat(0, 10, "Statement", "", 1, "L", false, 0, "")
+	if err := pdf.OutputFileAndClose(path); err != nil {
+		t.Fatalf("Failed to write PDF: %v", err)
+	}
+	if userPW != "" {
+		conf := model.NewAESConfiguration(userPW, "owner-"+userPW, 256)
+		if err := api.EncryptFile(path, "", conf); err != nil {
+			t.Fatalf("Failed to encrypt PDF: %v", err)
+		}
+	}
+	return path
+}
+
+func TestDecryptPDF(t *testing.T) {
+	path := writeTestPDF(t, t.TempDir(), "ABCD0102")
+
+	index, encrypted, err := decryptPDF(LocalStorage{}, path, []string{"wrong", "ABCD0102"})
+	if err != nil {
+		t.Fatalf("decryptPDF() error = %v", err)
+	}
+	if !encrypted || index != 1 {
+		t.Errorf("decryptPDF() = %d, %v, want the second password", index, encrypted)
+	}
+	if encrypted, err := pdfEncrypted(LocalStorage{}, path); err != nil || encrypted {
+		t.Errorf("pdfEncrypted() after decryption = %v, %v, want false", encrypted, err)
+	}
+}
+
+func TestDecryptPDF_NotEncrypted(t *testing.T) {
+	path := writeTestPDF(t, t.TempDir(), "")
+	before := mustReadFile(t, path)
+
+	_, encrypted, err := decryptPDF(LocalStorage{}, path, []string{"whatever"})
+	if err != nil || encrypted {
+		t.Errorf("decryptPDF() = %v, %v, want an unencrypted file without error", encrypted, err)
+	}
+	if !bytes.Equal(mustReadFile(t, path), before) {
+		t.Error("decryptPDF() changed an unencrypted file")
+	}
+}
+
+func TestDecryptPDF_WrongPasswordsKeepOriginal(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestPDF(t, dir, "ABCD0102")
+	before := mustReadFile(t, path)
+
+	_, _, err := decryptPDF(LocalStorage{}, path, []string{"wrong", "also wrong"})
+	if !errors.Is(err, errNoPDFPassword) {
+		t.Fatalf("decryptPDF() error = %v, want errNoPDFPassword", err)
+	}
+	if !bytes.Equal(mustReadFile(t, path), before) {
+		t.Error("decryptPDF() changed the file although no password matched")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("files left in the directory = %v, want only the original", files)
+	}
+}
+
+func TestProcessor_RunWrongPDFPassword(t *testing.T) {
+	captureLog(t)
+	pdf := mustReadFile(t, writeTestPDF(t, t.TempDir(), "ABCD0102"))
+	fake := NewFakeMail("me@example.com")
+	id := fake.AddMessage(FakeMessage{
+		Subject:     "statement",
+		Labels:      []string{"Bank", "UNREAD"},
+		Attachments: []FakeAttachment{{Filename: "statement.pdf", Data: pdf}},
+	})
+	dir := t.TempDir()
+	config := statementConfig(dir)
+	config.LabelActions[0].Actions[0].PdfPassword = secretValue("wrong")
+	p, err := NewProcessor(config, fake, LocalStorage{}, Options{User: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// The failure is reported, but the PDF is kept as downloaded and the
+	// message marked as read, so the next run does not fetch it again.
+	bank := result.Labels[0]
+	if bank.Files != 1 || len(bank.Failures) != 1 || !strings.Contains(bank.Failures[0].Error(), "decrypt") {
+		t.Errorf("label result = %+v, want 1 file and the decryption failure", bank)
+	}
+	if !bytes.Equal(mustReadFile(t, filepath.Join(dir, "statement.pdf")), pdf) {
+		t.Error("saved PDF differs from the encrypted original")
+	}
+	if m, _ := fake.Message(id); slices.Contains(m.Labels, "UNREAD") {
+		t.Errorf("message labels = %v, want it marked as read", m.Labels)
+	}
+}
+
+func TestLoadConfig_PasswordTemplates(t *testing.T) {
+	t.Setenv("GMAIL_TEST_DOB", "1990-02-01")
+	path := writeConfig(t, "config.yaml", `
+label_actions:
+  - label: Bank
+    defaults:
+      pdf_password_vars:
+        name: bhargava
+        dob: env:GMAIL_TEST_DOB
+    actions:
+      - download_attachment: true
+        save_to: /tmp
+        pdf_password: first
+        pdf_passwords: [second, first]
+        pdf_password_templates:
+          - '{{.name | first 4 | upper}}{{.dob | date "0201"}}'
+          - '{{.name | lower}}{{.dob | digits | last 4}}'
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	got := config.LabelActions[0].Actions[0].pdfPasswordCandidates()
+	want := "first,second,BHAR0102,bhargava0201"
+	if strings.Join(got, ",") != want {
+		t.Errorf("pdfPasswordCandidates() = %v, want %s", got, want)
+	}
+}
+
+func TestLoadConfig_PasswordTemplateProblems(t *testing.T) {
+	problems := configProblems(t, `{"label_actions": [{"label": "Bank", "actions": [{
+	"download_attachment": true, "save_to": "/tmp",
+	"pdf_password_vars": {"name": "x"},
+	"pdf_password_templates": ["{{.name", "{{.dob}}"]
+}]}]}`)
+
+	if len(problems) != 2 {
+		t.Fatalf("LoadConfig() problems = %v, want 2", problems)
+	}
+	if !strings.Contains(problems[0].Message, "invalid template") || !strings.HasSuffix(problems[0].Path, "pdf_password_templates[0]") {
+		t.Errorf("problem[0] = %v, want invalid template", problems[0])
+	}
+	if !strings.Contains(problems[1].Message, "cannot derive password") || !strings.HasSuffix(problems[1].Path, "pdf_password_templates[1]") {
+		t.Errorf("problem[1] = %v, want missing variable", problems[1])
+	}
+}
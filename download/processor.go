@@ -0,0 +1,464 @@
+// Package download downloads attachments from Gmail and applies the actions
+// of an action config to the matching messages: saving attachments and
+// emails as PDFs, decrypting and encrypting saved PDFs, marking messages as
+// read and deleting them.
+//
+// A Processor runs the actions of a Config against a MailService, saving
+// files to a Storage:
+//
+//	config, err := download.LoadConfig("config.yaml")
+//	...
+//	p, err := download.NewProcessor(config, mail, download.LocalStorage{}, download.DefaultOptions())
+//	...
+//	result, err := p.Run(ctx)
+//
+// MessageHook and FileHook are told about every message handled and every
+// file saved as the run goes.
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultWorkers is the number of messages processed concurrently by
+// default.
+const DefaultWorkers = 4
+
+// Options tune how a Processor calls Gmail and processes messages.
+type Options struct {
+	// User is the Gmail user the mail service is for, "me" when empty. It
+	// is recorded in checkpoints, so that one user's run is never resumed
+	// for another.
+	User string
+	// Workers is the number of messages processed concurrently, 1 when 0
+	// or less.
+	Workers int
+	// QuotaRate is the number of Gmail quota units spent per second at
+	// most; 0 or less for no limit.
+	QuotaRate int
+	// BatchSize is the number of messages fetched per batch request, at
+	// most MaxBatchSize; 1 or less disables batching.
+	BatchSize int
+	// MaxAttempts is the number of attempts per Gmail call on transient
+	// errors, 1 when 0 or less.
+	MaxAttempts int
+	// RetryBudget is the number of retries allowed in each run.
+	RetryBudget int
+	// Checkpoint is the file recording the progress of Run, to resume it
+	// after an interruption; "" for none.
+	Checkpoint string
+
+	// MessageHook and FileHook, if set, are called for every message
+	// handled and every file saved. They are called from the workers, so
+	// concurrently unless Workers is 1, and slow hooks slow the run down.
+	MessageHook MessageHook
+	FileHook    FileHook
+	// CallHook, if set, is called after every attempt at a Gmail API call,
+	// concurrently like the other hooks.
+	CallHook CallHook
+
+	// Logger receives the log records of the processor, slog.Default() when
+	// nil. Records about a label, action, message or file carry the
+	// AttrLabel, AttrAction, AttrMessage and AttrPath attributes; add
+	// AttrAccount to the logger to tell the records of several accounts
+	// apart.
+	Logger *slog.Logger
+	// TracerProvider provides the tracer of the spans of runs, labels,
+	// actions, messages, saved files and Gmail API calls; the global
+	// provider of otel when nil, which traces nothing unless set.
+	TracerProvider trace.TracerProvider
+}
+
+// DefaultOptions returns the options the command line defaults to.
+func DefaultOptions() Options {
+	return Options{
+		Workers:     DefaultWorkers,
+		QuotaRate:   DefaultQuotaRate,
+		BatchSize:   DefaultBatchSize,
+		MaxAttempts: DefaultMaxAttempts,
+		RetryBudget: DefaultRetryBudget,
+	}
+}
+
+// Processor runs the actions of a config against one mailbox. The calls it
+// makes to Gmail are paced as its Options say across all its runs, and
+// retried within the retry budget of each run. It is safe for concurrent
+// use, though concurrent runs share the quota of the mailbox.
+type Processor struct {
+	config  *Config
+	client  *mailClient
+	storage Storage
+	opts    Options
+	tracer  trace.Tracer
+}
+
+// NewProcessor returns a Processor running the actions of config against
+// the mailbox of mail, saving files to storage.
+func NewProcessor(config *Config, mail MailService, storage Storage, opts Options) (*Processor, error) {
+	if config == nil || mail == nil || storage == nil {
+		return nil, errors.New("a processor needs a config, a mail service and a storage")
+	}
+	if opts.BatchSize > MaxBatchSize {
+		return nil, fmt.Errorf("batch size must be at most %d, got %d", MaxBatchSize, opts.BatchSize)
+	}
+	if opts.User == "" {
+		opts.User = "me"
+	}
+	opts.Workers = max(opts.Workers, 1)
+	client := newMailClient(mail, opts.User, opts.QuotaRate)
+	client.batchSize = opts.BatchSize
+	client.retry = newRetryPolicy(max(opts.MaxAttempts, 1), max(opts.RetryBudget, 0))
+	p := &Processor{config: config, client: client, storage: storage, opts: opts, tracer: newTracer(opts.TracerProvider)}
+	client.logger = p.logger
+	client.hook = opts.CallHook
+	client.tracer = p.tracer
+	return p, nil
+}
+
+// Result is the outcome of a run, down to what was done to every message.
+// It is written as JSON as the run report, and Summary renders it for
+// people.
+type Result struct {
+	// Labels has the outcome of each label that ran, in config order.
+	// Labels a checkpoint shows as done are left out.
+	Labels []*LabelResult `json:"labels"`
+	// Retries is the number of Gmail calls retried after transient errors.
+	Retries int `json:"retries"`
+	// Interrupted says the run was cancelled before it completed. With a
+	// checkpoint, the next run resumes where it stopped.
+	Interrupted bool      `json:"interrupted"`
+	Started     time.Time `json:"started"`
+	Duration    Duration  `json:"duration"`
+}
+
+// LabelResult is the outcome of running the actions of a label.
+type LabelResult struct {
+	Label string `json:"label"`
+	// Messages is the number of messages handled, successfully or not.
+	Messages int `json:"messages"`
+	// Files is the number of files saved.
+	Files int `json:"files"`
+	// Actions has the outcome of each action that ran, in config order.
+	Actions  []*ActionResult `json:"actions"`
+	Duration Duration        `json:"duration"`
+	// Failures are the failures on individual messages, logged as they
+	// happened. The run carries on after them. The report has them as the
+	// Errors of the actions and messages they are about.
+	Failures []error `json:"-"`
+}
+
+// Err returns the failures of the label joined together, nil if there were
+// none.
+func (r *LabelResult) Err() error {
+	return errors.Join(r.Failures...)
+}
+
+// Err returns the failures of the run joined together, nil if there were
+// none.
+func (r *Result) Err() error {
+	var errs []error
+	for _, l := range r.Labels {
+		errs = append(errs, l.Failures...)
+	}
+	return errors.Join(errs...)
+}
+
+// Failures counts the failures of the run into permanent ones and transient
+// ones that persisted after retries.
+func (r *Result) Failures() (permanent, transient int) {
+	return classifyErrors(r.Err())
+}
+
+// MessageHook is told about every message a Processor handles, once the
+// actions are done with it or have failed on it.
+type MessageHook interface {
+	OnMessage(ctx context.Context, e MessageEvent)
+}
+
+// MessageHookFunc is a function used as a MessageHook.
+type MessageHookFunc func(ctx context.Context, e MessageEvent)
+
+func (f MessageHookFunc) OnMessage(ctx context.Context, e MessageEvent) { f(ctx, e) }
+
+// MessageEvent describes a message handled by an action.
+type MessageEvent struct {
+	Label string
+	// Action is the index of the action within the label.
+	Action  int
+	ID      string
+	Subject string
+	// Err joins the failures of the action on the message, nil if every
+	// step succeeded.
+	Err error
+}
+
+// FileHook is told about every file a Processor saves or fails to save.
+type FileHook interface {
+	OnFile(ctx context.Context, e FileEvent)
+}
+
+// FileHookFunc is a function used as a FileHook.
+type FileHookFunc func(ctx context.Context, e FileEvent)
+
+func (f FileHookFunc) OnFile(ctx context.Context, e FileEvent) { f(ctx, e) }
+
+// FileEvent describes a file saved for a message.
+type FileEvent struct {
+	Label     string
+	Action    int
+	MessageID string
+	FileResult
+	// Err says why the file could not be saved, or why decrypting or
+	// encrypting a saved PDF failed, in which case the file is kept as
+	// saved.
+	Err error
+}
+
+// CallHook is told about every attempt at a Gmail API call a Processor
+// makes, including those that are retried.
+type CallHook interface {
+	OnCall(ctx context.Context, e CallEvent)
+}
+
+// CallHookFunc is a function used as a CallHook.
+type CallHookFunc func(ctx context.Context, e CallEvent)
+
+func (f CallHookFunc) OnCall(ctx context.Context, e CallEvent) { f(ctx, e) }
+
+// CallEvent describes an attempt at a Gmail API call.
+type CallEvent struct {
+	// Method is the API method, e.g. "messages.get".
+	Method string
+	// Calls is the number of calls the request made, more than 1 for the
+	// requests of a batch.
+	Calls int
+	// Attempt is 1 for the first attempt, and counts up with the retries.
+	Attempt  int
+	Duration time.Duration
+	Err      error
+	// Retry says the call is tried again after Err.
+	Retry bool
+}
+
+// Run runs every label action of the config, in order, and returns the
+// outcome. Failures on individual messages do not stop the run: they are
+// logged and reported in the result. Run only fails when it cannot start,
+// e.g. because a save_to directory is not usable or the checkpoint cannot be
+// read.
+//
+// When ctx is cancelled, Run stops as soon as the messages in hand are
+// done with, saves its progress to the checkpoint and returns a result
+// marked Interrupted. The checkpoint is removed once a run completes.
+func (p *Processor) Run(ctx context.Context) (*Result, error) {
+	if problems := CheckSaveDirs(p.config, p.storage); len(problems) > 0 {
+		return nil, ConfigErrors(problems)
+	}
+	cp, err := newCheckpointer(p.opts.Checkpoint, p.opts.User, p.config, p.logger())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read checkpoint: %w", err)
+	}
+
+	ctx, result := p.startRun(ctx)
+	for i, labelAction := range p.config.LabelActions {
+		if ctx.Err() != nil {
+			break
+		}
+		if cp.skipLabel(i) {
+			continue
+		}
+		result.Labels = append(result.Labels, p.processLabel(ctx, i, labelAction, cp))
+	}
+	p.endRun(ctx, result)
+	if !result.Interrupted {
+		if err := cp.clear(); err != nil {
+			p.logger().Warn("unable to remove checkpoint", AttrPath, p.opts.Checkpoint, AttrError, err)
+		}
+	}
+	return result, nil
+}
+
+// NewMessages are the messages of a label that a run is limited to, such as
+// the messages the mailbox history reports as added.
+type NewMessages struct {
+	IDs map[string]bool
+	// Since is when the messages were received at the earliest. The search
+	// of each action is narrowed to messages received after it, so that it
+	// lists few messages besides those.
+	Since time.Time
+}
+
+// RunLabel runs the actions of labelAction alone, on the messages in added
+// only if set, as a run of its own without a checkpoint. labelAction need
+// not be part of the config, so that a long-running caller can run labels
+// of a newer config.
+func (p *Processor) RunLabel(ctx context.Context, labelAction LabelAction, added *NewMessages) *Result {
+	ctx, result := p.startRun(ctx)
+	if added != nil {
+		result.Labels = append(result.Labels, p.processAdded(ctx, labelAction, added))
+	} else {
+		result.Labels = append(result.Labels, p.processLabel(ctx, 0, labelAction, nil))
+	}
+	p.endRun(ctx, result)
+	return result
+}
+
+// startRun gives a new run its own retry budget and starts its span.
+func (p *Processor) startRun(ctx context.Context) (context.Context, *Result) {
+	ctx, _ = withRetryBudget(ctx, max(p.opts.RetryBudget, 0))
+	ctx, _ = p.tracer.Start(ctx, spanRun, trace.WithAttributes(attribute.String("gmail.user", p.opts.User)))
+	return ctx, &Result{Started: time.Now()}
+}
+
+// endRun completes the result and ends the span of the run.
+func (p *Processor) endRun(ctx context.Context, result *Result) {
+	result.Retries = p.client.retry.budgetFor(ctx).Retries()
+	result.Duration = since(result.Started)
+	result.Interrupted = ctx.Err() != nil
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("labels", len(result.Labels)), attribute.Int("retries", result.Retries),
+		attribute.Bool("interrupted", result.Interrupted))
+	if permanent, transient := result.Failures(); permanent+transient > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d failure(s)", permanent+transient))
+	}
+	span.End()
+}
+
+// Plan writes to w what Run would do, without downloading or changing
+// anything.
+func (p *Processor) Plan(ctx context.Context, w io.Writer) error {
+	for _, labelAction := range p.config.LabelActions {
+		if err := p.planEmails(ctx, labelAction, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuotaUsage returns the Gmail quota units spent so far by all runs, the
+// calls made and the HTTP requests they took.
+func (p *Processor) QuotaUsage() (units, calls, requests int) {
+	return p.client.usage.Total()
+}
+
+// QuotaReport returns a summary of the Gmail quota spent so far, one line
+// per method after a total.
+func (p *Processor) QuotaReport() []string {
+	return p.client.usage.Report()
+}
+
+// Retries returns the number of Gmail calls retried so far by all runs.
+func (p *Processor) Retries() int {
+	return p.client.retry.Retries()
+}
+
+// labelRun collects the outcome of running the actions of a label.
+// Failures caused by the cancellation of ctx are logged as such and not
+// collected, as the messages are picked up again by the next run. It is safe
+// for concurrent use.
+type labelRun struct {
+	ctx     context.Context // with the span of the label
+	log     *slog.Logger    // with the label
+	tracer  trace.Tracer
+	started time.Time
+	mu      sync.Mutex
+	result  *LabelResult
+}
+
+// newLabelRun starts running the actions of label, returning ctx with the
+// span of the label.
+func (p *Processor) newLabelRun(ctx context.Context, label string) (context.Context, *labelRun) {
+	ctx, _ = p.tracer.Start(ctx, spanLabel, trace.WithAttributes(attribute.String(AttrLabel, label)))
+	return ctx, &labelRun{
+		ctx:     ctx,
+		log:     p.logger().With(AttrLabel, label),
+		tracer:  p.tracer,
+		started: time.Now(),
+		result:  &LabelResult{Label: label, Actions: []*ActionResult{}},
+	}
+}
+
+// action adds the outcome of the action at index, searching with query, to
+// the result, returning ctx with the span of the action.
+func (r *labelRun) action(ctx context.Context, index int, query string) (context.Context, *ActionResult) {
+	ctx, span := r.tracer.Start(ctx, spanAction, trace.WithAttributes(
+		attribute.String(AttrLabel, r.result.Label), attribute.Int(AttrAction, index), attribute.String("query", query)))
+	a := &ActionResult{Index: index, Query: query, Messages: []*MessageResult{}, started: time.Now(), span: span}
+	r.result.Actions = append(r.result.Actions, a)
+	return ctx, a
+}
+
+// endAction records how long the action a took and ends its span.
+func (r *labelRun) endAction(a *ActionResult) {
+	a.Duration = since(a.started)
+	a.span.SetAttributes(attribute.Int("scanned", a.Scanned), attribute.Int("matched", a.Matched))
+	a.span.End()
+}
+
+// failAction logs and collects a failure of the action a as a whole, such
+// as listing its messages.
+func (r *labelRun) failAction(a *ActionResult, step string, err error) {
+	if r.fail(r.log.With(AttrAction, a.Index), step, err) {
+		a.Errors = append(a.Errors, newErrorResult(step, err))
+		recordFailure(a.span, step, err)
+	}
+}
+
+// finish returns the result, with how long the label took, and ends the
+// span of the label.
+func (r *labelRun) finish() *LabelResult {
+	r.result.Duration = since(r.started)
+	span := trace.SpanFromContext(r.ctx)
+	span.SetAttributes(attribute.Int("messages", r.result.Messages), attribute.Int("files", r.result.Files))
+	if n := len(r.result.Failures); n > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d failure(s)", n))
+	}
+	span.End()
+	return r.result
+}
+
+// fail logs err, the failure of step, to l and collects it, unless it is
+// down to the cancellation of the run. It reports whether err was collected.
+func (r *labelRun) fail(l *slog.Logger, step string, err error) bool {
+	if r.ctx.Err() != nil && errors.Is(err, r.ctx.Err()) {
+		l.Warn("interrupted", "step", step, AttrError, err)
+		return false
+	}
+	l.Error(step+" failed", "step", step, AttrError, err)
+	r.mu.Lock()
+	r.result.Failures = append(r.result.Failures, err)
+	r.mu.Unlock()
+	return true
+}
+
+// count adds to the messages handled and files saved.
+func (r *labelRun) count(messages, files int) {
+	r.mu.Lock()
+	r.result.Messages += messages
+	r.result.Files += files
+	r.mu.Unlock()
+}
+
+// messageEvent reports a message handled to the hook, if any.
+func (p *Processor) messageEvent(ctx context.Context, e MessageEvent) {
+	if p.opts.MessageHook != nil {
+		p.opts.MessageHook.OnMessage(ctx, e)
+	}
+}
+
+// fileEvent reports a file saved to the hook, if any.
+func (p *Processor) fileEvent(ctx context.Context, e FileEvent) {
+	if p.opts.FileHook != nil {
+		p.opts.FileHook.OnFile(ctx, e)
+	}
+}
@@ -0,0 +1,278 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// hookRecorder collects the events of a run.
+type hookRecorder struct {
+	mu       sync.Mutex
+	messages []MessageEvent
+	files    []FileEvent
+}
+
+func (h *hookRecorder) options(workers int) Options {
+	return Options{
+		User:    "me",
+		Workers: workers,
+		MessageHook: MessageHookFunc(func(ctx context.Context, e MessageEvent) {
+			h.mu.Lock()
+			h.messages = append(h.messages, e)
+			h.mu.Unlock()
+		}),
+		FileHook: FileHookFunc(func(ctx context.Context, e FileEvent) {
+			h.mu.Lock()
+			h.files = append(h.files, e)
+			h.mu.Unlock()
+		}),
+	}
+}
+
+// newTestMailbox returns a mailbox with n statements in the label Bank, each
+// with a PDF attachment, and their IDs.
+func newTestMailbox(n int) (*FakeMail, []string) {
+	fake := NewFakeMail("me@example.com")
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, fake.AddMessage(FakeMessage{
+			Subject: "statement",
+			Date:    time.Date(2024, 3, 1+i, 9, 0, 0, 0, time.UTC),
+			Labels:  []string{"Bank", "UNREAD"},
+			Attachments: []FakeAttachment{
+				{Filename: "statement" + string(rune('a'+i)) + ".pdf", Data: []byte("not really a pdf")},
+			},
+		}))
+	}
+	return fake, ids
+}
+
+func statementConfig(dir string) *Config {
+	return &Config{LabelActions: []LabelAction{{Label: "Bank", Actions: []Action{{
+		SubjectFilter:   "statement",
+		Download:        true,
+		SaveTo:          dir,
+		FilenamePattern: "{original}",
+		MarkAsRead:      true,
+	}}}}}
+}
+
+func TestNewProcessor(t *testing.T) {
+	fake := NewFakeMail("me@example.com")
+	if _, err := NewProcessor(nil, fake, LocalStorage{}, DefaultOptions()); err == nil {
+		t.Error("NewProcessor() without a config error = nil, want error")
+	}
+	if _, err := NewProcessor(&Config{}, fake, LocalStorage{}, Options{BatchSize: MaxBatchSize + 1}); err == nil {
+		t.Error("NewProcessor() with an oversized batch error = nil, want error")
+	}
+	if _, err := NewProcessor(&Config{}, fake, LocalStorage{}, DefaultOptions()); err != nil {
+		t.Errorf("NewProcessor() error = %v", err)
+	}
+}
+
+func TestProcessor_Run(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	fake, ids := newTestMailbox(3)
+	fake.Fail("messages.get", ids[1], &googleapi.Error{Code: http.StatusForbidden, Message: "Forbidden"}, -1)
+
+	var hooks hookRecorder
+	p, err := NewProcessor(statementConfig(dir), fake, LocalStorage{}, hooks.options(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if len(result.Labels) != 1 {
+		t.Fatalf("label results = %d, want 1", len(result.Labels))
+	}
+	bank := result.Labels[0]
+	if bank.Label != "Bank" || bank.Messages != 3 || bank.Files != 2 || len(bank.Failures) != 1 {
+		t.Errorf("label result = %+v, want 3 messages, 2 files and 1 failure", bank)
+	}
+	if permanent, transient := result.Failures(); permanent != 1 || transient != 0 {
+		t.Errorf("Failures() = %d, %d, want 1 permanent", permanent, transient)
+	}
+	if result.Interrupted || result.Started.IsZero() || result.Duration <= 0 {
+		t.Errorf("result = %+v, want a completed run", result)
+	}
+
+	failed := 0
+	for _, e := range hooks.messages {
+		if e.Label != "Bank" || e.Action != 0 {
+			t.Errorf("message event = %+v", e)
+		}
+		if e.Err != nil {
+			failed++
+			if e.ID != ids[1] {
+				t.Errorf("failure reported for %s, want %s", e.ID, ids[1])
+			}
+		}
+	}
+	if len(hooks.messages) != 3 || failed != 1 {
+		t.Errorf("message events = %+v, want 3 with 1 failure", hooks.messages)
+	}
+
+	sort.Slice(hooks.files, func(i, j int) bool { return hooks.files[i].Name < hooks.files[j].Name })
+	if len(hooks.files) != 2 {
+		t.Fatalf("file events = %+v, want 2", hooks.files)
+	}
+	for i, e := range hooks.files {
+		want := filepath.Join(dir, []string{"statementa.pdf", "statementc.pdf"}[i])
+		if e.Kind != FileAttachment || e.Path != want || e.Size != int64(len("not really a pdf")) || e.Err != nil {
+			t.Errorf("file event = %+v, want %s saved", e, want)
+		}
+		if _, err := os.Stat(e.Path); err != nil {
+			t.Errorf("saved file: %v", err)
+		}
+	}
+}
+
+func TestProcessor_RunAttachmentFailed(t *testing.T) {
+	captureLog(t)
+	fake, ids := newTestMailbox(2)
+	fake.Fail("messages.attachments.get", ids[0], &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend Error"}, -1)
+	config := statementConfig(t.TempDir())
+	config.LabelActions[0].Actions[0].Delete = true
+	p, err := NewProcessor(config, fake, LocalStorage{}, Options{User: "me", Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if bank := result.Labels[0]; bank.Files != 1 || len(bank.Failures) != 1 {
+		t.Errorf("label result = %+v, want 1 file and 1 failure", bank)
+	}
+
+	// The message whose attachment could not be saved is left as it was,
+	// to be tried again by the next run.
+	m, ok := fake.Message(ids[0])
+	if !ok {
+		t.Fatalf("message %s was deleted although its attachment was not saved", ids[0])
+	}
+	if !slices.Contains(m.Labels, "UNREAD") {
+		t.Errorf("message %s labels = %v, want it left unread", ids[0], m.Labels)
+	}
+	if _, ok := fake.Message(ids[1]); ok {
+		t.Errorf("message %s was not deleted once saved", ids[1])
+	}
+}
+
+func TestProcessor_RunUnusableSaveDir(t *testing.T) {
+	fake, _ := newTestMailbox(1)
+	p, err := NewProcessor(statementConfig(filepath.Join(t.TempDir(), "missing")), fake, LocalStorage{}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var problems ConfigErrors
+	if _, err := p.Run(context.Background()); !errors.As(err, &problems) {
+		t.Errorf("Run() error = %v, want ConfigErrors", err)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("calls = %v, want none before the config is usable", calls)
+	}
+}
+
+func TestProcessor_RunInterrupted(t *testing.T) {
+	captureLog(t)
+	fake, _ := newTestMailbox(1)
+	p, err := NewProcessor(statementConfig(t.TempDir()), fake, LocalStorage{}, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := p.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !result.Interrupted || len(result.Labels) != 0 {
+		t.Errorf("result = %+v, want an interrupted run", result)
+	}
+}
+
+func TestProcessor_RunLabel(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	fake, ids := newTestMailbox(3)
+	config := statementConfig(dir)
+	p, err := NewProcessor(&Config{}, fake, LocalStorage{}, Options{User: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := &NewMessages{IDs: map[string]bool{ids[2]: true}, Since: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	result := p.RunLabel(context.Background(), config.LabelActions[0], added)
+	if err := result.Err(); err != nil {
+		t.Fatalf("RunLabel() failures = %v", err)
+	}
+	if len(result.Labels) != 1 || result.Labels[0].Messages != 1 || result.Labels[0].Files != 1 {
+		t.Errorf("result = %+v, want the new message alone", result.Labels)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 || filepath.Base(files[0]) != "statementc.pdf" {
+		t.Errorf("saved files = %v, want the new statement alone", files)
+	}
+
+	result = p.RunLabel(context.Background(), config.LabelActions[0], nil)
+	if len(result.Labels) != 1 || result.Labels[0].Messages != 3 {
+		t.Errorf("result = %+v, want every message of the label", result.Labels)
+	}
+	if units, calls, _ := p.QuotaUsage(); units == 0 || calls == 0 {
+		t.Errorf("QuotaUsage() = %d units, %d calls, want the calls of both runs", units, calls)
+	}
+}
+
+func TestProcessor_CallHook(t *testing.T) {
+	captureLog(t)
+	fake, ids := newTestMailbox(2)
+	fake.Fail("messages.get", ids[0], &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend Error"}, 1)
+	var mu sync.Mutex
+	var calls []CallEvent
+	opts := Options{User: "me", BatchSize: 1, MaxAttempts: 2, RetryBudget: 10, CallHook: CallHookFunc(func(ctx context.Context, e CallEvent) {
+		mu.Lock()
+		calls = append(calls, e)
+		mu.Unlock()
+	})}
+	p, err := NewProcessor(statementConfig(t.TempDir()), fake, LocalStorage{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.client.retry.baseDelay = time.Millisecond
+	result, err := p.Run(context.Background())
+	if err != nil || result.Err() != nil {
+		t.Fatalf("Run() = %v, %v", err, result.Err())
+	}
+
+	byMethod := make(map[string]int)
+	retried := 0
+	for _, e := range calls {
+		byMethod[e.Method]++
+		if e.Retry {
+			retried++
+			if e.Method != "messages.get" || e.Attempt != 1 || e.Err == nil {
+				t.Errorf("retried call = %+v, want the first attempt at messages.get", e)
+			}
+		}
+	}
+	if byMethod["messages.list"] != 1 || byMethod["messages.get"] != 3 || byMethod["messages.attachments.get"] != 2 || retried != 1 {
+		t.Errorf("calls by method = %v with %d retried, want a list, 3 gets, 2 attachments and 1 retry", byMethod, retried)
+	}
+	if a := result.Labels[0].Actions[0]; a.Scanned != 2 || a.Matched != 2 {
+		t.Errorf("action = %+v, want 2 messages scanned and matched", a)
+	}
+}
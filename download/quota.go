@@ -0,0 +1,97 @@
+package download
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// apiMethod is a Gmail API method and the quota units one call of it costs,
+// see https://developers.google.com/gmail/api/reference/quota.
+type apiMethod struct {
+	name  string
+	units int
+}
+
+var (
+	messagesList        = apiMethod{"messages.list", 5}
+	messagesGet         = apiMethod{"messages.get", 5}
+	attachmentsGet      = apiMethod{"messages.attachments.get", 5}
+	messagesModify      = apiMethod{"messages.modify", 5}
+	messagesDelete      = apiMethod{"messages.delete", 10}
+	messagesBatchModify = apiMethod{"messages.batchModify", 50}
+	messagesBatchDelete = apiMethod{"messages.batchDelete", 50}
+	labelsList          = apiMethod{"labels.list", 1}
+	historyList         = apiMethod{"history.list", 2}
+	usersGetProfile     = apiMethod{"getProfile", 1}
+	usersWatch          = apiMethod{"watch", 100}
+)
+
+// quotaUsage accounts for the calls a run makes and the quota units they
+// cost, by method. Failed attempts count too, as Gmail charges for them. It
+// is safe for concurrent use.
+type quotaUsage struct {
+	mu       sync.Mutex
+	methods  map[string]*methodUsage
+	requests int
+}
+
+type methodUsage struct {
+	calls, units int
+}
+
+// add records one HTTP request making calls calls of m; calls is more than
+// one for a batch request.
+func (u *quotaUsage) add(m apiMethod, calls int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.methods == nil {
+		u.methods = make(map[string]*methodUsage)
+	}
+	mu := u.methods[m.name]
+	if mu == nil {
+		mu = &methodUsage{}
+		u.methods[m.name] = mu
+	}
+	mu.calls += calls
+	mu.units += m.units * calls
+	u.requests++
+}
+
+// Total returns the quota units spent so far, the calls made and the HTTP
+// requests they took.
+func (u *quotaUsage) Total() (units, calls, requests int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, mu := range u.methods {
+		units += mu.units
+		calls += mu.calls
+	}
+	return units, calls, u.requests
+}
+
+// Report returns a summary line followed by one line per method, the most
+// expensive first.
+func (u *quotaUsage) Report() []string {
+	units, calls, requests := u.Total()
+	lines := []string{fmt.Sprintf("Gmail quota used: %d units in %d call(s) over %d request(s)", units, calls, requests)}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	names := make([]string, 0, len(u.methods))
+	for name := range u.methods {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := u.methods[names[i]], u.methods[names[j]]
+		if a.units != b.units {
+			return a.units > b.units
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		mu := u.methods[name]
+		lines = append(lines, fmt.Sprintf("  %-26s %6d call(s) %8d units", name, mu.calls, mu.units))
+	}
+	return lines
+}
@@ -0,0 +1,91 @@
+package download
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestQuotaUsage(t *testing.T) {
+	var u quotaUsage
+	u.add(messagesList, 1)
+	u.add(messagesGet, 50)
+	u.add(messagesGet, 1)
+	u.add(messagesBatchDelete, 1)
+
+	units, calls, requests := u.Total()
+	if units != 5+255+50 || calls != 53 || requests != 4 {
+		t.Errorf("Total() = %d units, %d calls, %d requests, want 310, 53, 4", units, calls, requests)
+	}
+	report := u.Report()
+	if len(report) != 4 || report[0] != "Gmail quota used: 310 units in 53 call(s) over 4 request(s)" {
+		t.Fatalf("Report() = %q", report)
+	}
+	for i, name := range []string{"messages.get", "messages.batchDelete", "messages.list"} {
+		if !strings.Contains(report[i+1], name) {
+			t.Errorf("Report() line %d = %q, want %s", i+1, report[i+1], name)
+		}
+	}
+}
+
+func TestAction_MessageFetch(t *testing.T) {
+	tests := []struct {
+		action Action
+		want   MessageFetch
+	}{
+		{Action{MarkAsRead: true, Delete: true},
+			MessageFetch{Format: "metadata", Headers: []string{"Date", "Subject"}, Fields: "id,payload/headers"}},
+		{Action{Download: true},
+			MessageFetch{Format: "full", Fields: "id,payload(headers,parts(filename,body/attachmentId))"}},
+		{Action{SaveAsPdf: true},
+			MessageFetch{Format: "full", Fields: "id,payload(headers,body/data)"}},
+		{Action{Download: true, SaveAsPdf: true},
+			MessageFetch{Format: "full", Fields: "id,payload(headers,body/data,parts(filename,body/attachmentId))"}},
+	}
+	for _, tt := range tests {
+		if got := tt.action.messageFetch(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v.messageFetch() = %+v, want %+v", tt.action, got, tt.want)
+		}
+	}
+}
+
+// fetchRecorder records what is fetched of the messages got in batches.
+type fetchRecorder struct {
+	*FakeMail
+	mu      sync.Mutex
+	fetches []MessageFetch
+}
+
+func (f *fetchRecorder) GetMessages(ctx context.Context, ids []string, fetch MessageFetch) ([]*gmail.Message, []error, error) {
+	f.mu.Lock()
+	f.fetches = append(f.fetches, fetch)
+	f.mu.Unlock()
+	return f.FakeMail.GetMessages(ctx, ids, fetch)
+}
+
+func TestProcessEmails_MessageFetchAndUsage(t *testing.T) {
+	fake, _ := newFakeInbox(12)
+	fake.PageSize = 12
+	svc := &fetchRecorder{FakeMail: fake}
+	client := newMailClient(svc, "me", 0)
+	captureLog(t)
+
+	labelAction := LabelAction{Label: "INBOX", Actions: []Action{{MarkAsRead: true}}}
+	if err := processEmails(context.Background(), client, labelAction, 4); err != nil {
+		t.Fatalf("processEmails() error = %v", err)
+	}
+	want := MessageFetch{Format: "metadata", Headers: []string{"Date", "Subject"}, Fields: "id,payload/headers"}
+	if len(svc.fetches) != 1 || !reflect.DeepEqual(svc.fetches[0], want) {
+		t.Errorf("fetches = %+v, want the metadata format with Date and Subject", svc.fetches)
+	}
+
+	// One list, 12 gets in one batch and one batchModify.
+	units, calls, requests := client.usage.Total()
+	if units != 5+60+50 || calls != 14 || requests != 3 {
+		t.Errorf("usage = %d units, %d calls, %d requests, want 115, 14, 3", units, calls, requests)
+	}
+}
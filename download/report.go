@@ -0,0 +1,183 @@
+package download
+
+import (
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ActionResult is the outcome of an action of a label.
+type ActionResult struct {
+	// Index is the index of the action within the label.
+	Index int    `json:"index"`
+	Query string `json:"query"`
+	// Scanned is the number of messages the search of the action listed.
+	Scanned int `json:"scanned"`
+	// Matched is the number of messages the search of the action listed,
+	// less those a resumed or push-triggered run was not after.
+	Matched int `json:"matched"`
+	// Messages has the outcome of each message handled, in the order the
+	// search listed them.
+	Messages []*MessageResult `json:"messages"`
+	// Errors are the failures of the action as a whole, such as being
+	// unable to list its messages.
+	Errors   []ErrorResult `json:"errors,omitempty"`
+	Duration Duration      `json:"duration"`
+
+	started time.Time
+	span    trace.Span
+}
+
+// MessageResult is what an action did to a message.
+type MessageResult struct {
+	ID      string `json:"id"`
+	Subject string `json:"subject,omitempty"`
+	// Files are the files saved for the message.
+	Files []FileResult `json:"files,omitempty"`
+	// LabelsRemoved are the labels taken off the message, UNREAD when it
+	// was marked as read.
+	LabelsRemoved []string `json:"labels_removed,omitempty"`
+	Deleted       bool     `json:"deleted,omitempty"`
+	// Errors are the steps that failed on the message.
+	Errors []ErrorResult `json:"errors,omitempty"`
+}
+
+// Kinds of saved files.
+const (
+	FileAttachment = "attachment"
+	FileEmail      = "email" // an email saved as a PDF
+)
+
+// Outcomes of decrypting a saved PDF.
+const (
+	DecryptNotEncrypted = "not_encrypted"
+	DecryptDecrypted    = "decrypted"
+	// DecryptOwnerRemoved says the PDF opened without a password and only
+	// its owner password, restricting printing or copying, was removed.
+	DecryptOwnerRemoved = "owner_password_removed"
+	// DecryptFailed says none of the passwords opened the PDF, which is
+	// kept as downloaded.
+	DecryptFailed = "failed"
+)
+
+// FileResult describes a saved file.
+type FileResult struct {
+	// Kind is FileAttachment or FileEmail.
+	Kind string `json:"kind"`
+	// Name is the filename of the attachment in the message, "" for emails.
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+	// Size is the number of bytes saved.
+	Size int64 `json:"size"`
+	// Decrypt is the outcome of decrypting the PDF with the passwords of
+	// the action, "" when there was nothing to try.
+	Decrypt string `json:"decrypt,omitempty"`
+	// Encrypted says the file was encrypted with encrypt_pdf.
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// Steps of an action that may fail.
+const (
+	StepList     = "list"
+	StepFetch    = "fetch"
+	StepSave     = "save"
+	StepDecrypt  = "decrypt"
+	StepEncrypt  = "encrypt"
+	StepMarkRead = "mark_read"
+	StepDelete   = "delete"
+)
+
+// Categories of failures.
+const (
+	// ErrorTransient is a failure Gmail may not repeat, such as rate
+	// limiting or a server error, that persisted after the retries.
+	ErrorTransient = "transient"
+	// ErrorPermanent is any other failure, which running again will not
+	// fix by itself.
+	ErrorPermanent = "permanent"
+)
+
+// ErrorResult describes a failure.
+type ErrorResult struct {
+	// Step is the step that failed, e.g. StepSave.
+	Step string `json:"step"`
+	// Category is ErrorTransient or ErrorPermanent.
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+func newErrorResult(step string, err error) ErrorResult {
+	category := ErrorPermanent
+	if isTransient(err) {
+		category = ErrorTransient
+	}
+	return ErrorResult{Step: step, Category: category, Message: err.Error()}
+}
+
+// since returns the time elapsed since start, to the millisecond.
+func since(start time.Time) Duration {
+	return Duration(time.Since(start).Round(time.Millisecond))
+}
+
+// actionTotals sums up what an action did.
+type actionTotals struct {
+	messages, files, decrypted, read, deleted, failures int
+	bytes                                               int64
+}
+
+func (t *actionTotals) add(a *ActionResult) {
+	t.failures += len(a.Errors)
+	for _, m := range a.Messages {
+		t.messages++
+		t.failures += len(m.Errors)
+		if len(m.LabelsRemoved) > 0 {
+			t.read++
+		}
+		if m.Deleted {
+			t.deleted++
+		}
+		for _, f := range m.Files {
+			t.files++
+			t.bytes += f.Size
+			if f.Decrypt == DecryptDecrypted || f.Decrypt == DecryptOwnerRemoved {
+				t.decrypted++
+			}
+		}
+	}
+}
+
+// Summary renders the result for people, as log lines: the totals of the
+// run, then a line for each action with a line for each of its failures.
+func (r *Result) Summary() []string {
+	var total actionTotals
+	for _, l := range r.Labels {
+		for _, a := range l.Actions {
+			total.add(a)
+		}
+	}
+	status := "completed"
+	if r.Interrupted {
+		status = "interrupted"
+	}
+	lines := []string{fmt.Sprintf("Run %s in %v: %d label(s), %d message(s), %d file(s) (%d bytes), %d failure(s), %d retries",
+		status, time.Duration(r.Duration), len(r.Labels), total.messages, total.files, total.bytes, total.failures, r.Retries)}
+
+	for _, l := range r.Labels {
+		for _, a := range l.Actions {
+			var t actionTotals
+			t.add(a)
+			lines = append(lines, fmt.Sprintf("  label %s, action %d: %d matched, %d file(s) (%d bytes), %d decrypted, %d marked as read, %d deleted, %d failure(s) in %v",
+				l.Label, a.Index, a.Matched, t.files, t.bytes, t.decrypted, t.read, t.deleted, t.failures, time.Duration(a.Duration)))
+			for _, e := range a.Errors {
+				lines = append(lines, fmt.Sprintf("    %s, %s: %s", e.Step, e.Category, e.Message))
+			}
+			for _, m := range a.Messages {
+				for _, e := range m.Errors {
+					lines = append(lines, fmt.Sprintf("    message %s %s, %s: %s", m.ID, e.Step, e.Category, e.Message))
+				}
+			}
+		}
+	}
+	return lines
+}
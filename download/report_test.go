@@ -0,0 +1,143 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestResult_Report(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	pdf, err := os.ReadFile(writeTestPDF(t, t.TempDir(), "ABCD0102"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeMail("me@example.com")
+	date := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	statement := fake.AddMessage(FakeMessage{
+		Subject: "HDFC statement", Date: date, Labels: []string{"Bank", "UNREAD"},
+		Attachments: []FakeAttachment{{Filename: "march.pdf", Data: pdf}},
+	})
+	locked := fake.AddMessage(FakeMessage{
+		Subject: "ICICI statement", Date: date.Add(time.Hour), Labels: []string{"Bank", "UNREAD"},
+		Attachments: []FakeAttachment{{Filename: "april.pdf", Data: pdf}},
+	})
+	flaky := fake.AddMessage(FakeMessage{Subject: "SBI statement", Date: date.Add(2 * time.Hour), Labels: []string{"Bank", "UNREAD"}})
+	fake.Fail("messages.delete", locked, &googleapi.Error{Code: http.StatusForbidden, Message: "Forbidden"}, -1)
+	fake.Fail("messages.get", flaky, &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend Error"}, -1)
+
+	config := &Config{LabelActions: []LabelAction{{Label: "Bank", Actions: []Action{{
+		SubjectFilter:   "statement",
+		Download:        true,
+		SaveTo:          dir,
+		FilenamePattern: "{original}",
+		PdfPasswords:    []Secret{secretValue("wrong"), secretValue("ABCD0102")},
+		MarkAsRead:      true,
+		Delete:          true,
+	}}}}}
+	p, err := NewProcessor(config, fake, LocalStorage{}, Options{User: "me", Workers: 1, MaxAttempts: 2, RetryBudget: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.client.retry.baseDelay = time.Millisecond
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	bank := result.Labels[0]
+	if len(bank.Actions) != 1 {
+		t.Fatalf("action results = %d, want 1", len(bank.Actions))
+	}
+	action := bank.Actions[0]
+	if action.Index != 0 || action.Query != "label:Bank subject:statement" || action.Matched != 3 || len(action.Messages) != 3 {
+		t.Fatalf("action result = %+v, want 3 messages matched and handled", action)
+	}
+	byID := make(map[string]*MessageResult)
+	for _, m := range action.Messages {
+		byID[m.ID] = m
+	}
+
+	saved := byID[statement]
+	if len(saved.Files) != 1 || saved.Subject != "HDFC statement" || !saved.Deleted ||
+		strings.Join(saved.LabelsRemoved, ",") != "UNREAD" || len(saved.Errors) != 0 {
+		t.Errorf("statement result = %+v, want it saved, marked as read and deleted", saved)
+	}
+	if f := saved.Files[0]; f.Kind != FileAttachment || f.Name != "march.pdf" || f.Path != filepath.Join(dir, "march.pdf") ||
+		f.Size != int64(len(pdf)) || f.Decrypt != DecryptDecrypted {
+		t.Errorf("statement file = %+v, want march.pdf saved and decrypted", f)
+	}
+
+	undeleted := byID[locked]
+	if undeleted.Deleted || len(undeleted.Files) != 1 || len(undeleted.Errors) != 1 ||
+		undeleted.Errors[0].Step != StepDelete || undeleted.Errors[0].Category != ErrorPermanent {
+		t.Errorf("locked result = %+v, want a permanent delete failure", undeleted)
+	}
+
+	unfetched := byID[flaky]
+	if len(unfetched.Errors) != 1 || unfetched.Errors[0].Step != StepFetch || unfetched.Errors[0].Category != ErrorTransient ||
+		len(unfetched.LabelsRemoved) != 0 || unfetched.Deleted {
+		t.Errorf("flaky result = %+v, want a transient fetch failure and nothing done", unfetched)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("marshalling the report: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := decoded["duration"].(string); !ok || !strings.HasSuffix(d, "s") {
+		t.Errorf("report duration = %v, want a duration string", decoded["duration"])
+	}
+	for _, want := range []string{`"decrypt":"decrypted"`, `"step":"delete"`, `"category":"transient"`, `"labels_removed":["UNREAD"]`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("report does not contain %s:\n%s", want, data)
+		}
+	}
+
+	summary := strings.Join(result.Summary(), "\n")
+	for _, want := range []string{
+		"Run completed in",
+		"1 label(s), 3 message(s), 2 file(s)",
+		"2 failure(s)",
+		"label Bank, action 0: 3 matched, 2 file(s)",
+		"2 decrypted, 2 marked as read, 1 deleted, 2 failure(s)",
+		"message " + locked + " delete, permanent: failed to delete email",
+		"message " + flaky + " fetch, transient:",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary does not contain %q:\n%s", want, summary)
+		}
+	}
+}
+
+func TestResult_ReportListFailure(t *testing.T) {
+	captureLog(t)
+	fake, _ := newTestMailbox(1)
+	fake.Fail("messages.list", "", &googleapi.Error{Code: http.StatusForbidden, Message: "Forbidden"}, -1)
+	p, err := NewProcessor(statementConfig(t.TempDir()), fake, LocalStorage{}, Options{User: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	action := result.Labels[0].Actions[0]
+	if action.Matched != 0 || len(action.Messages) != 0 || len(action.Errors) != 1 || action.Errors[0].Step != StepList {
+		t.Errorf("action result = %+v, want a list failure", action)
+	}
+	if summary := strings.Join(result.Summary(), "\n"); !strings.Contains(summary, "    list, permanent: unable to list messages") {
+		t.Errorf("summary does not report the list failure:\n%s", summary)
+	}
+}
@@ -0,0 +1,212 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Defaults for the retry policy of a run.
+const (
+	DefaultMaxAttempts = 5
+	DefaultRetryBudget = 100
+	defaultBaseDelay   = 500 * time.Millisecond
+	defaultMaxDelay    = 30 * time.Second
+	// maxRetryAfter caps the wait asked for by a Retry-After header, so a
+	// bogus value cannot stall the run.
+	maxRetryAfter = 5 * time.Minute
+)
+
+// retryPolicy decides whether and when a failed Gmail call is retried:
+// transient errors are retried with jittered exponential backoff, up to
+// maxAttempts per call and, across the whole run, up to the retries left in
+// the budget of the run. Calls made outside a run share the budget of the
+// policy.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	budget      retryBudget  // for calls made outside a run
+	retries     atomic.Int64 // retries made so far, by all runs
+}
+
+func newRetryPolicy(maxAttempts, budget int) *retryPolicy {
+	p := &retryPolicy{maxAttempts: maxAttempts, baseDelay: defaultBaseDelay, maxDelay: defaultMaxDelay}
+	p.budget.left.Store(int64(budget))
+	return p
+}
+
+// Retries returns how many retries were made so far.
+func (p *retryPolicy) Retries() int {
+	return int(p.retries.Load())
+}
+
+// retryBudget is the retries allowed to one run, so that concurrent runs
+// of a Processor, such as the labels of the daemon, each have their own.
+type retryBudget struct {
+	left    atomic.Int64 // retries left
+	retries atomic.Int64 // retries made
+}
+
+// Retries returns how many retries were made within the budget.
+func (b *retryBudget) Retries() int {
+	return int(b.retries.Load())
+}
+
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a context for the calls of a run allowed budget
+// retries, and the budget.
+func withRetryBudget(ctx context.Context, budget int) (context.Context, *retryBudget) {
+	b := &retryBudget{}
+	b.left.Store(int64(budget))
+	return context.WithValue(ctx, retryBudgetKey{}, b), b
+}
+
+// budgetFor returns the budget of the run ctx belongs to, or that of the
+// policy for calls made outside a run.
+func (p *retryPolicy) budgetFor(ctx context.Context) *retryBudget {
+	if b, ok := ctx.Value(retryBudgetKey{}).(*retryBudget); ok {
+		return b
+	}
+	return &p.budget
+}
+
+// transientError is a transient failure that was still failing when the
+// retries for the call or the budget for the run ran out.
+type transientError struct {
+	err      error
+	attempts int
+	reason   string
+}
+
+func (e *transientError) Error() string {
+	return fmt.Sprintf("%v (transient, gave up after %d attempt(s): %s)", e.err, e.attempts, e.reason)
+}
+
+func (e *transientError) Unwrap() error { return e.err }
+
+// isTransient reports whether err is a transient failure that was given up
+// on, as opposed to a permanent one that retrying would not fix.
+func isTransient(err error) bool {
+	var te *transientError
+	return errors.As(err, &te)
+}
+
+// classifyErrors counts the errors err joins together into permanent ones and
+// transient ones that were retried in vain. A nil err counts as none.
+func classifyErrors(err error) (permanent, transient int) {
+	if err == nil {
+		return 0, 0
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, e := range errs {
+		if isTransient(e) {
+			transient++
+		} else {
+			permanent++
+		}
+	}
+	return permanent, transient
+}
+
+// retriable reports whether err may go away when the call is repeated: rate
+// limiting, server errors and network failures.
+func retriable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		case http.StatusForbidden:
+			// Gmail reports some rate limits as 403 with a reason.
+			for _, item := range apiErr.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// retryAfter returns the delay asked for by the Retry-After header of err,
+// in seconds or as an HTTP date, or 0 if there is none.
+func retryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0
+	}
+	value := apiErr.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = time.Until(t)
+	}
+	return min(max(d, 0), maxRetryAfter)
+}
+
+// backoff returns the delay before retry number attempt (0-based): a random
+// duration up to baseDelay doubled attempt times, capped at maxDelay ("full
+// jitter"), but never less than the server asked for.
+func (p *retryPolicy) backoff(attempt int, err error) time.Duration {
+	ceiling := p.maxDelay
+	if attempt < 30 {
+		ceiling = min(p.baseDelay<<attempt, p.maxDelay)
+	}
+	d := time.Duration(rand.Int64N(int64(ceiling) + 1))
+	return max(d, retryAfter(err))
+}
+
+// next decides what to do after attempt number attempt (1-based) of a call
+// made with ctx failed with err. It returns the delay before the next
+// attempt, or the error to give up with.
+func (p *retryPolicy) next(ctx context.Context, attempt int, err error) (time.Duration, error) {
+	if p == nil || !retriable(err) {
+		return 0, err
+	}
+	if attempt >= p.maxAttempts {
+		return 0, &transientError{err: err, attempts: attempt, reason: "no attempts left"}
+	}
+	b := p.budgetFor(ctx)
+	if b.left.Add(-1) < 0 {
+		return 0, &transientError{err: err, attempts: attempt, reason: "retry budget of the run exhausted"}
+	}
+	b.retries.Add(1)
+	p.retries.Add(1)
+	return p.backoff(attempt-1, err), nil
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,192 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetriable(t *testing.T) {
+	apiErr := func(code int, reason string) error {
+		e := &googleapi.Error{Code: code}
+		if reason != "" {
+			e.Errors = []googleapi.ErrorItem{{Reason: reason}}
+		}
+		return fmt.Errorf("wrapped: %w", e)
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many requests", apiErr(429, ""), true},
+		{"server error", apiErr(500, ""), true},
+		{"unavailable", apiErr(503, ""), true},
+		{"rate limit as 403", apiErr(403, "userRateLimitExceeded"), true},
+		{"forbidden", apiErr(403, "insufficientPermissions"), false},
+		{"not found", apiErr(404, ""), false},
+		{"bad request", apiErr(400, ""), false},
+		{"connection cut", io.ErrUnexpectedEOF, true},
+		{"canceled", context.Canceled, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := retriable(tt.err); got != tt.want {
+			t.Errorf("%s: retriable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	withHeader := func(value string) error {
+		h := http.Header{}
+		h.Set("Retry-After", value)
+		return &googleapi.Error{Code: 429, Header: h}
+	}
+	if got := retryAfter(withHeader("3")); got != 3*time.Second {
+		t.Errorf("retryAfter(3) = %v, want 3s", got)
+	}
+	date := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	if got := retryAfter(withHeader(date)); got < 8*time.Second || got > 10*time.Second {
+		t.Errorf("retryAfter(%s) = %v, want about 10s", date, got)
+	}
+	if got := retryAfter(withHeader("86400")); got != maxRetryAfter {
+		t.Errorf("retryAfter(86400) = %v, want the cap %v", got, maxRetryAfter)
+	}
+	if got := retryAfter(withHeader("soon")); got != 0 {
+		t.Errorf("retryAfter(soon) = %v, want 0", got)
+	}
+	if got := retryAfter(errors.New("boom")); got != 0 {
+		t.Errorf("retryAfter(no header) = %v, want 0", got)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := newRetryPolicy(5, 10)
+	for attempt := 0; attempt < 40; attempt++ {
+		ceiling := min(p.baseDelay<<min(attempt, 30), p.maxDelay)
+		if d := p.backoff(attempt, errors.New("boom")); d < 0 || d > ceiling {
+			t.Errorf("backoff(%d) = %v, want within [0, %v]", attempt, d, ceiling)
+		}
+	}
+	h := http.Header{}
+	h.Set("Retry-After", "60")
+	if d := p.backoff(0, &googleapi.Error{Code: 429, Header: h}); d != time.Minute {
+		t.Errorf("backoff() with Retry-After: 60 = %v, want 1m", d)
+	}
+}
+
+func TestRetryPolicy_Next(t *testing.T) {
+	transient := &googleapi.Error{Code: 503}
+	permanent := &googleapi.Error{Code: 404}
+
+	ctx := context.Background()
+	p := newRetryPolicy(3, 10)
+	if _, err := p.next(ctx, 1, permanent); err != permanent {
+		t.Errorf("next(permanent) error = %v, want it unchanged", err)
+	}
+	if _, err := p.next(ctx, 1, transient); err != nil {
+		t.Errorf("next(1, transient) error = %v, want a retry", err)
+	}
+	_, err := p.next(ctx, 3, transient)
+	if !isTransient(err) || !errors.Is(err, transient) {
+		t.Errorf("next(3, transient) error = %v, want a transient error wrapping the cause", err)
+	}
+
+	p = newRetryPolicy(10, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := p.next(ctx, 1, transient); err != nil {
+			t.Fatalf("retry %d within budget: error = %v", i, err)
+		}
+	}
+	if _, err := p.next(ctx, 1, transient); !isTransient(err) || !strings.Contains(err.Error(), "budget") {
+		t.Errorf("next() past the budget error = %v, want the budget exhausted", err)
+	}
+	if p.Retries() != 2 {
+		t.Errorf("Retries() = %d, want 2", p.Retries())
+	}
+
+	// Each run has a budget of its own, whatever the other runs spent.
+	p = newRetryPolicy(10, 0)
+	ctx1, run1 := withRetryBudget(ctx, 1)
+	ctx2, run2 := withRetryBudget(ctx, 1)
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		if _, err := p.next(ctx, 1, transient); err != nil {
+			t.Errorf("next() within the budget of the run error = %v, want a retry", err)
+		}
+	}
+	if _, err := p.next(ctx1, 1, transient); !isTransient(err) {
+		t.Errorf("next() past the budget of the run error = %v, want the budget exhausted", err)
+	}
+	if run1.Retries() != 1 || run2.Retries() != 1 || p.Retries() != 2 {
+		t.Errorf("retries = %d and %d, %d in all, want 1 and 1, 2 in all", run1.Retries(), run2.Retries(), p.Retries())
+	}
+
+	var none *retryPolicy
+	if _, err := none.next(ctx, 1, transient); err != transient {
+		t.Errorf("nil policy next() error = %v, want no retry", err)
+	}
+}
+
+func TestMailClient_Retry(t *testing.T) {
+	fake, _ := newFakeInbox(1)
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend Error"}
+	fake.Fail("messages.get", "m00", unavailable, 2)
+	client := newTestMailClient(t, fake)
+	logs := captureLog(t)
+
+	if _, err := client.getMessage(context.Background(), "m00", MessageFetch{}); err != nil {
+		t.Fatalf("getMessage() error = %v, want success after retries", err)
+	}
+	if got := len(callsAbout(fake, "m00")); got != 3 {
+		t.Errorf("requests made = %d, want 3", got)
+	}
+	if client.retry.Retries() != 2 || !strings.Contains(logs.String(), `level=WARN msg="getting message m00 failed, retrying" attempt=1`) {
+		t.Errorf("retries = %d, log:\n%s", client.retry.Retries(), logs)
+	}
+
+	fake, _ = newFakeInbox(1)
+	fake.Fail("messages.get", "m00", unavailable, -1)
+	client = newTestMailClient(t, fake)
+	client.retry = newRetryPolicy(3, 100)
+	client.retry.baseDelay = time.Millisecond
+	if _, err := client.getMessage(context.Background(), "m00", MessageFetch{}); !isTransient(err) {
+		t.Errorf("getMessage() error = %v, want a transient error", err)
+	}
+	if got := len(callsAbout(fake, "m00")); got != 3 {
+		t.Errorf("requests made = %d, want 3 attempts", got)
+	}
+}
+
+func TestClassifyErrors(t *testing.T) {
+	transient := &transientError{err: errors.New("503"), attempts: 5, reason: "no attempts left"}
+	err := errors.Join(
+		fmt.Errorf("message a: %w", transient),
+		errors.New("message b: not found"),
+		errors.New("message c: not found"),
+	)
+	if p, tr := classifyErrors(err); p != 2 || tr != 1 {
+		t.Errorf("classifyErrors() = %d permanent, %d transient, want 2 and 1", p, tr)
+	}
+	if p, tr := classifyErrors(nil); p != 0 || tr != 0 {
+		t.Errorf("classifyErrors(nil) = %d, %d, want none", p, tr)
+	}
+	if p, tr := classifyErrors(transient); p != 0 || tr != 1 {
+		t.Errorf("classifyErrors(single) = %d, %d, want one transient", p, tr)
+	}
+}
+
+// countErrors returns how many errors err joins together.
+func countErrors(err error) int {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return len(joined.Unwrap())
+	}
+	return 1
+}
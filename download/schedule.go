@@ -0,0 +1,255 @@
+package download
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule says when the daemon runs the actions of a label: every fixed
+// interval, or at the times a cron expression matches. Each run is delayed by
+// a random amount up to Jitter, so that several labels, or several daemons,
+// do not all call Gmail at the same moment.
+type Schedule struct {
+	Every  Duration `json:"every"`
+	Cron   string   `json:"cron"`
+	Jitter Duration `json:"jitter"`
+}
+
+func (s Schedule) String() string {
+	var text string
+	if s.Cron != "" {
+		text = "cron " + s.Cron
+	} else {
+		text = "every " + time.Duration(s.Every).String()
+	}
+	if s.Jitter > 0 {
+		text += ", jitter " + time.Duration(s.Jitter).String()
+	}
+	return text
+}
+
+// validate checks the schedule. Paths in the returned problems are relative
+// to the schedule, starting with ".".
+func (s *Schedule) validate() []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(key, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{Path: "." + key, Message: fmt.Sprintf(format, args...)})
+	}
+	switch {
+	case s.Every != 0 && s.Cron != "":
+		add("cron", "set either every or cron, not both")
+	case s.Every < 0:
+		add("every", "every must be positive")
+	case s.Every == 0 && s.Cron == "":
+		add("every", "set every or cron")
+	case s.Cron != "":
+		if cron, err := parseCron(s.Cron); err != nil {
+			add("cron", "invalid cron expression: %v", err)
+		} else if cron.next(time.Now()).IsZero() {
+			add("cron", "cron expression %q never matches", s.Cron)
+		}
+	}
+	if s.Jitter < 0 {
+		add("jitter", "jitter must not be negative")
+	}
+	return problems
+}
+
+// Next returns when to run after a run that finished at now. Runs every
+// Every start that long after the previous one finished, so that a slow run
+// never makes runs pile up. The schedule must be valid.
+func (s Schedule) Next(now time.Time) time.Time {
+	var t time.Time
+	if s.Cron != "" {
+		cron, _ := parseCron(s.Cron)
+		t = cron.next(now)
+	} else {
+		t = now.Add(time.Duration(s.Every))
+	}
+	return t.Add(s.jitter())
+}
+
+// First returns when to run first after the daemon starts at now: at once
+// for interval schedules, at the next match for cron ones.
+func (s Schedule) First(now time.Time) time.Time {
+	if s.Cron != "" {
+		return s.Next(now)
+	}
+	return now.Add(s.jitter())
+}
+
+func (s Schedule) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return rand.N(time.Duration(s.Jitter))
+}
+
+// Duration is a time.Duration written in the config as a string such as
+// "15m" or "1h30m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// cronSchedule is a parsed cron expression: the minutes, hours, days of the
+// month, months and days of the week it matches, as bit sets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// A day matches when either the day of the month or the day of the
+	// week does if both are restricted, as in cron.
+	domStar, dowStar bool
+}
+
+// cronDescriptors are the @ shorthands cron accepts.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a standard five-field cron expression (minute, hour, day
+// of month, month, day of week) or one of the @ descriptors. Fields accept
+// *, numbers, ranges, lists and steps; months and days of the week accept
+// their three-letter English names too. Sunday is 0 or 7.
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("want 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+	c := &cronSchedule{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	return c, nil
+}
+
+// parseCronField parses one field whose values range from min to max. names,
+// if any, name the values from min on.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		if n < min || n > max {
+			return 0, fmt.Errorf("%d is out of range %d-%d", n, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = value(first); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(last); err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("range %s ends before it starts", rangePart)
+				}
+			} else if hasStep {
+				hi = max // 5/15 means from 5 on, every 15
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after t the schedule matches, in the location
+// of t. It returns the zero time if there is none within five years, which
+// only happens for dates that do not exist, such as February 30.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,124 @@
+package download
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronSchedule_Next(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2024-03-01 10:00", "2024-03-01 10:01"},
+		{"*/15 * * * *", "2024-03-01 10:07", "2024-03-01 10:15"},
+		{"30 7 * * *", "2024-03-01 07:30", "2024-03-02 07:30"},
+		{"0 9-17/4 * * *", "2024-03-01 10:00", "2024-03-01 13:00"},
+		{"0 0 1 * *", "2024-03-15 12:00", "2024-04-01 00:00"},
+		{"0 8 * * mon-fri", "2024-03-01 09:00", "2024-03-04 08:00"}, // Friday to Monday
+		{"0 8 * * 7", "2024-03-01 09:00", "2024-03-03 08:00"},       // 7 is Sunday
+		{"0 0 29 feb *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		// Both days restricted: either matches, as in cron.
+		{"0 0 13 * fri", "2024-03-02 00:00", "2024-03-08 00:00"},
+		{"@daily", "2024-12-31 23:59", "2025-01-01 00:00"},
+		{"@hourly", "2024-03-01 10:30", "2024-03-01 11:00"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if got := c.next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.from, got.Format("2006-01-02 15:04 Mon"), tt.want)
+		}
+	}
+
+	c, _ := parseCron("0 0 30 2 *")
+	if got := c.next(at("2024-01-01 00:00")); !got.IsZero() {
+		t.Errorf("February 30 = %v, want no match", got)
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * smarch *",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestSchedule_Validate(t *testing.T) {
+	tests := []struct {
+		json, want string
+	}{
+		{`{"every": "15m"}`, ""},
+		{`{"cron": "0 7 * * *", "jitter": "5m"}`, ""},
+		{`{}`, "set every or cron"},
+		{`{"every": "1h", "cron": "@daily"}`, "not both"},
+		{`{"every": "-1h"}`, "positive"},
+		{`{"cron": "0 7 * *"}`, "invalid cron expression"},
+		{`{"cron": "0 0 31 4 *"}`, "never matches"},
+		{`{"every": "1h", "jitter": "-1m"}`, "jitter must not be negative"},
+	}
+	for _, tt := range tests {
+		var s Schedule
+		if err := json.Unmarshal([]byte(tt.json), &s); err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		problems := s.validate()
+		if tt.want == "" {
+			if len(problems) > 0 {
+				t.Errorf("%s: problems %v, want none", tt.json, problems)
+			}
+			continue
+		}
+		if len(problems) == 0 || !strings.Contains(problems[0].Message, tt.want) {
+			t.Errorf("%s: problems %v, want %q", tt.json, problems, tt.want)
+		}
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	every := Schedule{Every: Duration(time.Hour), Jitter: Duration(10 * time.Minute)}
+	for i := 0; i < 20; i++ {
+		if got := every.Next(now); got.Before(now.Add(time.Hour)) || !got.Before(now.Add(70*time.Minute)) {
+			t.Fatalf("Next() = %v, want within the jitter after an hour", got)
+		}
+		if got := every.First(now); got.Before(now) || !got.Before(now.Add(10*time.Minute)) {
+			t.Fatalf("First() = %v, want within the jitter of now", got)
+		}
+	}
+
+	cron := Schedule{Cron: "30 7 * * *"}
+	want := time.Date(2024, 3, 2, 7, 30, 0, 0, time.UTC)
+	if got := cron.First(now); !got.Equal(want) {
+		t.Errorf("First() = %v, want the next match %v", got, want)
+	}
+	if got := cron.String(); got != "cron 30 7 * * *" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := every.String(); got != "every 1h0m0s, jitter 10m0s" {
+		t.Errorf("String() = %q", got)
+	}
+}
@@ -0,0 +1,306 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bhargavakumark/gmail-download/internal/atomicfile"
+	"github.com/bhargavakumark/gmail-download/internal/sealed"
+)
+
+// Prefixes of secret references. A config value starting with one of them is
+// looked up when the config is loaded instead of being used as written.
+const (
+	secretEnvPrefix   = "env:"    // env:NAME, an environment variable
+	secretFilePrefix  = "file:"   // file:/path, the content of a file
+	secretStorePrefix = "secret:" // secret:NAME, an entry of the secrets file
+)
+
+// DefaultSecretsFile is where the encrypted secrets are kept unless
+// GMAIL_SECRETS_FILE says otherwise.
+const DefaultSecretsFile = "secrets.json.enc"
+
+// secretsAAD binds the secrets file to its purpose, so that an encrypted
+// token cannot be passed off as a secrets file or the other way round.
+var secretsAAD = []byte("gmail-download secrets v1")
+
+// redacted replaces secret values in anything shown to the user.
+const redacted = "[redacted]"
+
+// Secret is a sensitive config value such as a PDF password. It is written
+// either literally or as a reference (env:, file: or secret:) that is
+// resolved when the config is loaded. Printing or marshalling a Secret never
+// shows its value: references are shown as written, literal values as
+// [redacted]. Use Reveal to get the value itself.
+type Secret struct {
+	ref   string // as written in the config
+	value string
+}
+
+// UnmarshalText stores the value as written in the config; references are
+// resolved later by resolve.
+func (s *Secret) UnmarshalText(text []byte) error {
+	*s = Secret{ref: string(text)}
+	if !IsSecretRef(s.ref) {
+		s.value = s.ref
+	}
+	return nil
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s Secret) String() string {
+	if s.ref == "" || IsSecretRef(s.ref) {
+		return s.ref
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return strconv.Quote(s.String())
+}
+
+// IsSet reports whether the config gave a value.
+func (s Secret) IsSet() bool {
+	return s.ref != ""
+}
+
+// Reveal returns the secret value.
+func (s Secret) Reveal() string {
+	return s.value
+}
+
+// resolve looks up the value of a reference, reading a relative file:
+// path from dir.
+func (s *Secret) resolve(r *secretResolver, dir string) error {
+	if !IsSecretRef(s.ref) {
+		return nil
+	}
+	value, err := r.lookup(s.ref, dir)
+	if err != nil {
+		return err
+	}
+	s.value = value
+	return nil
+}
+
+// IsSecretRef reports whether s is a secret reference rather than a value.
+func IsSecretRef(s string) bool {
+	return strings.HasPrefix(s, secretEnvPrefix) ||
+		strings.HasPrefix(s, secretFilePrefix) ||
+		strings.HasPrefix(s, secretStorePrefix)
+}
+
+// secretResolver looks up secret references. The secrets file is only opened
+// when a secret: reference needs it, and then only once.
+type secretResolver struct {
+	secrets map[string]string
+	err     error
+	// dir returns the directory of the config file holding the value at
+	// path, which relative file: paths are read from. When nil, they are
+	// read from the working directory.
+	dir func(path string) string
+}
+
+func newSecretResolver() *secretResolver {
+	return &secretResolver{}
+}
+
+// LookupSecret returns the value the secret reference ref refers to, or ref
+// itself if it is not a reference. Errors name the reference but never
+// include a value.
+func LookupSecret(ref string) (string, error) {
+	return newSecretResolver().lookup(ref, "")
+}
+
+// lookup returns the value ref refers to, reading a relative file: path
+// from dir. Errors name the reference but never include a value.
+func (r *secretResolver) lookup(ref, dir string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, secretEnvPrefix):
+		name := strings.TrimPrefix(ref, secretEnvPrefix)
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return "", fmt.Errorf("%s: environment variable %s is not set", ref, name)
+		}
+		return value, nil
+
+	case strings.HasPrefix(ref, secretFilePrefix):
+		path := strings.TrimPrefix(ref, secretFilePrefix)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", ref, err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		if value == "" {
+			return "", fmt.Errorf("%s: file is empty", ref)
+		}
+		return value, nil
+
+	case strings.HasPrefix(ref, secretStorePrefix):
+		if r.secrets == nil && r.err == nil {
+			var f *SecretsFile
+			if f, r.err = OpenSecretsFile(""); r.err == nil {
+				r.secrets, r.err = f.Load()
+			}
+		}
+		if r.err != nil {
+			return "", fmt.Errorf("%s: %v", ref, r.err)
+		}
+		name := strings.TrimPrefix(ref, secretStorePrefix)
+		value, ok := r.secrets[name]
+		if !ok {
+			return "", fmt.Errorf("%s: no secret %q in the secrets file", ref, name)
+		}
+		return value, nil
+	}
+	return ref, nil
+}
+
+// resolveSecrets resolves every secret reference in the actions and
+// notifications of c. The problems carry the path of the offending value.
+func (c *Config) resolveSecrets(r *secretResolver) []ConfigProblem {
+	var problems []ConfigProblem
+	dir := func(path string) string {
+		if r.dir == nil {
+			return ""
+		}
+		return r.dir(path)
+	}
+	for i := range c.LabelActions {
+		for j := range c.LabelActions[i].Actions {
+			action := &c.LabelActions[i].Actions[j]
+			base := fmt.Sprintf("label_actions[%d].actions[%d]", i, j)
+			resolve := func(path string, s *Secret) {
+				if err := s.resolve(r, dir(base+"."+path)); err != nil {
+					problems = append(problems, ConfigProblem{Path: base + "." + path, Message: err.Error()})
+				}
+			}
+
+			resolve("pdf_password", &action.PdfPassword)
+			for k := range action.PdfPasswords {
+				resolve(fmt.Sprintf("pdf_passwords[%d]", k), &action.PdfPasswords[k])
+			}
+			for _, name := range sortedSecretKeys(action.PdfPasswordVars) {
+				s := action.PdfPasswordVars[name]
+				resolve("pdf_password_vars."+name, &s)
+				action.PdfPasswordVars[name] = s
+			}
+			if e := action.EncryptPdf; e != nil {
+				resolve("encrypt_pdf.password", &e.Password)
+				resolve("encrypt_pdf.owner_password", &e.OwnerPassword)
+			}
+		}
+	}
+	for i := range c.Notifications {
+		n := &c.Notifications[i]
+		base := fmt.Sprintf("notifications[%d]", i)
+		resolve := func(path string, s *Secret) {
+			if err := s.resolve(r, dir(base+"."+path)); err != nil {
+				problems = append(problems, ConfigProblem{Path: base + "." + path, Message: err.Error()})
+			}
+		}
+
+		resolve("url", &n.URL)
+		resolve("token", &n.Token)
+		for _, name := range sortedSecretKeys(n.Headers) {
+			s := n.Headers[name]
+			resolve("headers."+name, &s)
+			n.Headers[name] = s
+		}
+		if n.SMTP != nil {
+			resolve("smtp.password", &n.SMTP.Password)
+		}
+	}
+	return problems
+}
+
+func sortedSecretKeys(m map[string]Secret) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SecretsFile is a local file of named secrets, encrypted like the token
+// store with a passphrase from the environment.
+type SecretsFile struct {
+	path       string
+	passphrase []byte
+}
+
+// OpenSecretsFile returns the secrets file at path, or at GMAIL_SECRETS_FILE
+// or its default location when path is empty. The passphrase comes from
+// GMAIL_SECRETS_PASSPHRASE(_FILE), falling back to the token passphrase.
+func OpenSecretsFile(path string) (*SecretsFile, error) {
+	if path == "" {
+		path = os.Getenv("GMAIL_SECRETS_FILE")
+	}
+	if path == "" {
+		path = DefaultSecretsFile
+	}
+	passphrase, err := sealed.EnvPassphrase("GMAIL_SECRETS_PASSPHRASE")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		if passphrase, err = sealed.EnvPassphrase("GMAIL_TOKEN_PASSPHRASE"); err != nil {
+			return nil, err
+		}
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("no secrets passphrase: set GMAIL_SECRETS_PASSPHRASE or GMAIL_SECRETS_PASSPHRASE_FILE")
+	}
+	return &SecretsFile{path: path, passphrase: passphrase}, nil
+}
+
+// Path returns the path of the file.
+func (f *SecretsFile) Path() string {
+	return f.path
+}
+
+// Load returns the secrets by name. A missing file holds no secrets.
+func (f *SecretsFile) Load() (map[string]string, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := sealed.Open(data, f.passphrase, secretsAAD)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.path, err)
+	}
+	secrets := map[string]string{}
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, fmt.Errorf("%s: %v", f.path, err)
+	}
+	return secrets, nil
+}
+
+// Save replaces the content of the file with secrets.
+func (f *SecretsFile) Save(secrets map[string]string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	data, err := sealed.Seal(plain, f.passphrase, secretsAAD)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(f.path, data, 0o600)
+}
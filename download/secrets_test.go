@@ -0,0 +1,183 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// secretValue returns a Secret as if it had been read from a config.
+func secretValue(value string) Secret {
+	var s Secret
+	s.UnmarshalText([]byte(value))
+	return s
+}
+
+func TestSecret_Redacted(t *testing.T) {
+	action := Action{Download: true, SaveTo: "/tmp", PdfPassword: secretValue("hunter2")}
+
+	out, err := json.Marshal(action)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	for _, s := range []string{
+		fmt.Sprintf("%v", action),
+		fmt.Sprintf("%+v", action),
+		fmt.Sprintf("%#v", action),
+		string(out),
+	} {
+		if strings.Contains(s, "hunter2") {
+			t.Errorf("formatted action contains the password: %s", s)
+		}
+		if !strings.Contains(s, redacted) {
+			t.Errorf("formatted action = %s, want %s", s, redacted)
+		}
+	}
+	if action.PdfPassword.Reveal() != "hunter2" {
+		t.Errorf("Reveal() = %q, want hunter2", action.PdfPassword.Reveal())
+	}
+
+	// References are not secret themselves and are shown as written
+	ref := secretValue("env:HDFC_PW")
+	if ref.String() != "env:HDFC_PW" || ref.Reveal() != "" {
+		t.Errorf("unresolved reference String() = %q, Reveal() = %q", ref.String(), ref.Reveal())
+	}
+}
+
+func TestSecretResolver(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"pw": "from-file\n", "empty": ""})
+	t.Setenv("GMAIL_TEST_PW", "from-env")
+	os.Unsetenv("GMAIL_TEST_UNSET")
+
+	t.Setenv("GMAIL_SECRETS_FILE", filepath.Join(dir, "secrets.json.enc"))
+	t.Setenv("GMAIL_SECRETS_PASSPHRASE", "pass")
+	f, err := OpenSecretsFile("")
+	if err != nil {
+		t.Fatalf("OpenSecretsFile() error = %v", err)
+	}
+	if err := f.Save(map[string]string{"hdfc": "from-store"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if data := mustReadFile(t, f.path); strings.Contains(string(data), "from-store") {
+		t.Error("secrets file contains a secret in plaintext")
+	}
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{ref: "env:GMAIL_TEST_PW", want: "from-env"},
+		{ref: "file:" + filepath.Join(dir, "pw"), want: "from-file"},
+		{ref: "secret:hdfc", want: "from-store"},
+		{ref: "env:GMAIL_TEST_UNSET", wantErr: true},
+		{ref: "file:" + filepath.Join(dir, "missing"), wantErr: true},
+		{ref: "file:" + filepath.Join(dir, "empty"), wantErr: true},
+		{ref: "secret:other", wantErr: true},
+	}
+
+	r := newSecretResolver()
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			s := secretValue(tt.ref)
+			err := s.resolve(r, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && s.Reveal() != tt.want {
+				t.Errorf("Reveal() = %q, want %q", s.Reveal(), tt.want)
+			}
+			if s.String() != tt.ref {
+				t.Errorf("String() = %q, want the reference %q", s.String(), tt.ref)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_SecretFileRelative(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "bank"), 0755)
+	for name, content := range map[string]string{
+		"config.json": `{"include": ["bank/hdfc.json"], "label_actions": [{"label": "Tax", "actions": [
+	{"download_attachment": true, "save_to": "/tmp", "pdf_password": "file:pw"}
+]}]}`,
+		"bank/hdfc.json": `{"label_actions": [{"label": "Bank", "actions": [
+	{"download_attachment": true, "save_to": "/tmp", "pdf_password": "file:pw"}
+]}]}`,
+		"pw":      "root-pw\n",
+		"bank/pw": "bank-pw\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Relative file: paths do not depend on where the tool runs from.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	config, err := LoadConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	got := map[string]string{}
+	for _, la := range config.LabelActions {
+		got[la.Label] = la.Actions[0].PdfPassword.Reveal()
+	}
+	if got["Tax"] != "root-pw" || got["Bank"] != "bank-pw" {
+		t.Errorf("passwords = %v, want each read next to the file referring to it", got)
+	}
+}
+
+func TestSecretsFile_WrongPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json.enc")
+	t.Setenv("GMAIL_SECRETS_PASSPHRASE", "right")
+	f, _ := OpenSecretsFile(path)
+	if err := f.Save(map[string]string{"a": "b"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	t.Setenv("GMAIL_SECRETS_PASSPHRASE", "wrong")
+	other, _ := OpenSecretsFile(path)
+	if _, err := other.Load(); err == nil {
+		t.Error("Load() with wrong passphrase error = nil, want error")
+	}
+}
+
+func TestLoadConfig_SecretReferences(t *testing.T) {
+	t.Setenv("GMAIL_TEST_PW", "from-env")
+	os.Unsetenv("GMAIL_TEST_UNSET")
+
+	problems := configProblems(t, `{"label_actions": [{"label": "Bank", "actions": [
+	{"download_attachment": true, "save_to": "/tmp", "pdf_password": "env:GMAIL_TEST_UNSET"},
+	{"download_attachment": true, "save_to": "/tmp", "pdf_password": 1234}
+]}]}`)
+	if len(problems) != 2 {
+		t.Fatalf("LoadConfig() problems = %v, want 2", problems)
+	}
+	if problems[0].Line != 2 || !strings.Contains(problems[0].Message, "GMAIL_TEST_UNSET is not set") {
+		t.Errorf("problem[0] = %v, want the unset variable on line 2", problems[0])
+	}
+	if problems[1].Line != 3 || !strings.Contains(problems[1].Message, "expected a string, got a number") {
+		t.Errorf("problem[1] = %v, want a type error on line 3", problems[1])
+	}
+
+	config, err := LoadConfig(writeConfig(t, "config.json", `{"label_actions": [{"label": "Bank", "actions": [
+	{"download_attachment": true, "save_to": "/tmp", "pdf_password": "env:GMAIL_TEST_PW"}
+]}]}`))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if got := config.LabelActions[0].Actions[0].PdfPassword.Reveal(); got != "from-env" {
+		t.Errorf("pdf_password = %q, want from-env", got)
+	}
+}
@@ -0,0 +1,61 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bhargavakumark/gmail-download/internal/atomicfile"
+)
+
+// Storage is where a Processor saves attachments and emails, at the paths
+// the save_to directories and filename patterns of the config give.
+// LocalStorage, the default, saves them on the local file system; other
+// implementations may save them elsewhere, such as in an object store.
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// CheckDir returns an error unless files can be saved in dir.
+	CheckDir(dir string) error
+	// Create starts writing the file at path. Nothing appears at path until
+	// the File is committed, which then replaces any file there whole.
+	Create(path string) (File, error)
+	// Open opens a file saved before, for the processing of saved PDFs.
+	Open(path string) (io.ReadCloser, error)
+}
+
+// File is a file of a Storage being written.
+type File interface {
+	io.Writer
+	// Reset discards what was written so far, to write the file again from
+	// the start, as when a download is retried.
+	Reset() error
+	// Commit makes the file appear at its path.
+	Commit() error
+	// Abort discards the file unless it was committed. It is meant to be
+	// deferred.
+	Abort()
+}
+
+// LocalStorage is the Storage of the local file system. Files are written
+// next to their path and renamed into place once complete and synced, so a
+// path never holds a partial file, even after a crash.
+type LocalStorage struct{}
+
+func (LocalStorage) CheckDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+func (LocalStorage) Create(path string) (File, error) {
+	return atomicfile.Create(path, 0644)
+}
+
+func (LocalStorage) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
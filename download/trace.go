@@ -0,0 +1,63 @@
+package download
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the package, as the instrumentation scope of
+// its spans.
+const tracerName = "github.com/bhargavakumark/gmail-download/download"
+
+// Names of the spans of a run. Gmail API calls are spans named after their
+// method, e.g. "gmail messages.get".
+const (
+	spanRun        = "download.run"
+	spanLabel      = "download.label"
+	spanAction     = "download.action"
+	spanMessage    = "download.message"
+	spanAttachment = "download.attachment"
+	spanEmail      = "download.email"
+)
+
+// newTracer returns the tracer of tp, of the global tracer provider when tp
+// is nil. The global provider hands out tracers that follow it, so a
+// provider set after the processor is created is used all the same.
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// recordFailure records err, the failure of step, on span with attrs and
+// marks the span as failed.
+func recordFailure(span trace.Span, step string, err error, attrs ...attribute.KeyValue) {
+	attrs = append([]attribute.KeyValue{attribute.String("step", step)}, attrs...)
+	span.RecordError(err, trace.WithAttributes(attrs...))
+	span.SetStatus(codes.Error, step+" failed")
+}
+
+// messageAttrs returns the attributes of a span about the message id.
+func messageAttrs(id string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String(AttrMessage, id)}
+}
+
+// messagesAttrs returns the attributes of a span about the messages ids.
+func messagesAttrs(ids []string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.StringSlice(AttrMessage+"s", ids)}
+}
+
+// fileAttrs returns the attributes of a saved file.
+func fileAttrs(f FileResult) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String(AttrPath, f.Path), attribute.Int64(AttrSize, f.Size)}
+	if f.Decrypt != "" {
+		attrs = append(attrs, attribute.String("decrypt", f.Decrypt))
+	}
+	if f.Encrypted {
+		attrs = append(attrs, attribute.Bool("encrypted", true))
+	}
+	return attrs
+}
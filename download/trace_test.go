@@ -0,0 +1,112 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/googleapi"
+)
+
+// spanAttr returns the value of the attribute key of span, and whether it
+// has one.
+func spanAttr(span sdktrace.ReadOnlySpan, key string) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestProcessor_Trace(t *testing.T) {
+	captureLog(t)
+	fake, ids := newTestMailbox(2)
+	fake.Fail("messages.modify", ids[1], &googleapi.Error{Code: http.StatusForbidden, Message: "Forbidden"}, 1)
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	p, err := NewProcessor(statementConfig(t.TempDir()), fake, LocalStorage{}, Options{User: "me", BatchSize: 1, TracerProvider: tp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	spans := rec.Ended()
+	byID := make(map[trace.SpanID]sdktrace.ReadOnlySpan)
+	byName := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byID[s.SpanContext().SpanID()] = s
+		byName[s.Name()] = append(byName[s.Name()], s)
+	}
+	parent := func(s sdktrace.ReadOnlySpan) string {
+		if p, ok := byID[s.Parent().SpanID()]; ok {
+			return p.Name()
+		}
+		return ""
+	}
+	for name, want := range map[string]struct {
+		n      int
+		parent string
+	}{
+		spanRun:                          {1, ""},
+		spanLabel:                        {1, spanRun},
+		spanAction:                       {1, spanLabel},
+		"gmail messages.list":            {1, spanAction},
+		spanMessage:                      {2, spanAction},
+		"gmail messages.get":             {2, spanMessage},
+		spanAttachment:                   {2, spanMessage},
+		"gmail messages.attachments.get": {2, spanAttachment},
+		"gmail messages.modify":          {2, spanAction},
+	} {
+		if got := byName[name]; len(got) != want.n {
+			t.Errorf("%d %s spans, want %d", len(got), name, want.n)
+			continue
+		}
+		for _, s := range byName[name] {
+			if got := parent(s); got != want.parent {
+				t.Errorf("parent of %s = %q, want %q", name, got, want.parent)
+			}
+		}
+	}
+
+	for _, name := range []string{spanMessage, "gmail messages.get", "gmail messages.attachments.get"} {
+		for _, s := range byName[name] {
+			if v, ok := spanAttr(s, AttrMessage); !ok || (v.AsString() != ids[0] && v.AsString() != ids[1]) {
+				t.Errorf("%s span %s = %v, want a message ID", name, AttrMessage, v.Emit())
+			}
+		}
+	}
+	for _, s := range byName[spanAttachment] {
+		if v, ok := spanAttr(s, AttrSize); !ok || v.AsInt64() != int64(len("not really a pdf")) {
+			t.Errorf("attachment span %s = %v, want %d", AttrSize, v.Emit(), len("not really a pdf"))
+		}
+	}
+
+	// Marking as read fails for the page, so the action records it.
+	action := byName[spanAction][0]
+	if action.Status().Code != codes.Error || len(action.Events()) != 1 {
+		t.Fatalf("action span status = %v with %d events, want an error and its event", action.Status(), len(action.Events()))
+	}
+	var step, message string
+	for _, kv := range action.Events()[0].Attributes {
+		switch kv.Key {
+		case "step":
+			step = kv.Value.AsString()
+		case AttrMessage:
+			message = kv.Value.AsString()
+		}
+	}
+	if step != StepMarkRead || message != ids[1] {
+		t.Errorf("action span error event step = %q, %s = %q, want %q, %q", step, AttrMessage, message, StepMarkRead, ids[1])
+	}
+	if run := byName[spanRun][0]; run.Status().Code != codes.Error {
+		t.Errorf("run span status = %v, want an error", run.Status())
+	}
+}
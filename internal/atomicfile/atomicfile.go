@@ -0,0 +1,80 @@
+// Package atomicfile writes files so that readers, and the files left behind
+// by a crash, never hold a partially written file.
+package atomicfile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is written under a temporary name next to its final path and
+// renamed into place by Commit once complete and synced to disk, so the
+// final path never holds a partially written file, even after a crash.
+type File struct {
+	*os.File
+	path string
+}
+
+// Create creates the temporary file that Commit renames to path.
+func Create(path string, perm os.FileMode) (*File, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &File{File: f, path: path}, nil
+}
+
+// Reset empties the file, to write it again from the start.
+func (f *File) Reset() error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// Commit syncs the file and renames it into place. The directory is synced
+// too where the platform allows, so the rename survives a crash.
+func (f *File) Commit() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(f.path)); err == nil {
+		dir.Sync() // not supported on every platform
+		dir.Close()
+	}
+	return nil
+}
+
+// Abort removes the temporary file unless Commit renamed it. It is meant to
+// be deferred.
+func (f *File) Abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// WriteFile writes data to a temporary file next to path and renames it
+// into place, so readers never observe a partially written file.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := Create(path, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,65 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "statement.pdf")
+	if err := os.WriteFile(path, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Create(path, 0600)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	f.Write([]byte("partial"))
+	if err := f.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	f.Write([]byte("complete"))
+	if got, _ := os.ReadFile(path); string(got) != "previous" {
+		t.Errorf("file before Commit = %q, want the previous content", got)
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	f.Abort()
+
+	if got, _ := os.ReadFile(path); string(got) != "complete" {
+		t.Errorf("file = %q, want the committed content", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, %v, want 0600", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory has %d entries, want no temporary file left", len(entries))
+	}
+}
+
+func TestFile_Abort(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Create(filepath.Join(dir, "statement.pdf"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("half"))
+	f.Abort()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("directory has %d entries after Abort, want none", len(entries))
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := WriteFile(path, []byte("{}"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "{}" {
+		t.Errorf("file = %q, want the data written", got)
+	}
+}
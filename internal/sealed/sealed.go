@@ -0,0 +1,150 @@
+// Package sealed encrypts small files, such as the OAuth token and the
+// secrets file, with AES-256-GCM using a key derived from a passphrase with
+// scrypt.
+package sealed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Parameters for deriving the encryption key from the passphrase.
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+
+	// Limits on the parameters Open accepts from an envelope, so that a
+	// tampered file cannot make key derivation take all memory or time.
+	maxScryptN   = 1 << 20
+	maxScryptRP  = 1 << 30
+	maxScryptMem = 1 << 30 // bytes, 128·N·r
+
+	version = 1
+)
+
+// envelope is the on-disk form of sealed data.
+type envelope struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Seal encrypts plain with a key derived from passphrase and returns the
+// JSON envelope to write to disk. aad binds the envelope to its purpose, so
+// that it cannot be passed off as sealed data of another kind.
+func Seal(plain, passphrase, aad []byte) ([]byte, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(envelope{
+		Version:    version,
+		KDF:        "scrypt",
+		N:          scryptN,
+		R:          scryptR,
+		P:          scryptP,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plain, aad),
+	}, "", "  ")
+}
+
+// Open decrypts an envelope written by Seal with the same aad.
+func Open(data, passphrase, aad []byte) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("not an encrypted file: %w", err)
+	}
+	if env.Version != version || env.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported encrypted file version %d (kdf %q)", env.Version, env.KDF)
+	}
+	if err := checkParams(env.N, env.R, env.P); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce length")
+	}
+	plain, err := gcm.Open(nil, env.Nonce, env.Ciphertext, aad)
+	if err != nil {
+		return nil, errors.New("decryption failed: wrong passphrase or corrupted file")
+	}
+	return plain, nil
+}
+
+// checkParams reports scrypt parameters that are invalid or more costly than
+// an envelope written by Seal could need.
+func checkParams(n, r, p int) error {
+	switch {
+	case n <= 1 || n&(n-1) != 0:
+		return fmt.Errorf("invalid scrypt parameter n=%d: not a power of two greater than 1", n)
+	case n > maxScryptN:
+		return fmt.Errorf("invalid scrypt parameter n=%d: more than %d", n, maxScryptN)
+	case r <= 0 || p <= 0:
+		return fmt.Errorf("invalid scrypt parameters r=%d, p=%d: not positive", r, p)
+	case r >= maxScryptRP/p:
+		return fmt.Errorf("invalid scrypt parameters r=%d, p=%d: r·p not below %d", r, p, maxScryptRP)
+	case r > maxScryptMem/128/n:
+		return fmt.Errorf("invalid scrypt parameters n=%d, r=%d: need more than %d bytes", n, r, maxScryptMem)
+	}
+	return nil
+}
+
+func newGCM(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EnvPassphrase reads a passphrase from the environment variable name, or
+// from the file named by name+"_FILE". It returns nil if neither is set.
+func EnvPassphrase(name string) ([]byte, error) {
+	if p := os.Getenv(name); p != "" {
+		return []byte(p), nil
+	}
+	if file := os.Getenv(name + "_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase file: %w", err)
+		}
+		p := strings.TrimRight(string(data), "\r\n")
+		if p == "" {
+			return nil, fmt.Errorf("passphrase file %s is empty", file)
+		}
+		return []byte(p), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,90 @@
+package sealed
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	sealed, err := Seal([]byte("refresh-token"), []byte("pass"), []byte("token"))
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if bytes.Contains(sealed, []byte("refresh-token")) {
+		t.Error("sealed data contains the plaintext")
+	}
+
+	plain, err := Open(sealed, []byte("pass"), []byte("token"))
+	if err != nil || string(plain) != "refresh-token" {
+		t.Errorf("Open() = %q, %v, want the plaintext", plain, err)
+	}
+	if _, err := Open(sealed, []byte("wrong"), []byte("token")); err == nil {
+		t.Error("Open() with a wrong passphrase error = nil, want error")
+	}
+	if _, err := Open(sealed, []byte("pass"), []byte("secrets")); err == nil {
+		t.Error("Open() with another purpose error = nil, want error")
+	}
+	if _, err := Open([]byte(`{"access_token": "x"}`), []byte("pass"), []byte("token")); err == nil {
+		t.Error("Open() of plaintext JSON error = nil, want error")
+	}
+}
+
+func TestOpen_ScryptParams(t *testing.T) {
+	sealed, err := Seal([]byte("refresh-token"), []byte("pass"), []byte("token"))
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		n, r, p int
+		want    string
+	}{
+		{"oversized n", 1 << 30, scryptR, scryptP, "n=1073741824"},
+		{"n not a power of two", 3 << 10, scryptR, scryptP, "power of two"},
+		{"n of 1", 1, scryptR, scryptP, "power of two"},
+		{"zero r", scryptN, 0, scryptP, "not positive"},
+		{"oversized r·p", scryptN, 1 << 15, 1 << 15, "r·p"},
+		{"oversized memory", maxScryptN, 1 << 10, scryptP, "bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env envelope
+			if err := json.Unmarshal(sealed, &env); err != nil {
+				t.Fatal(err)
+			}
+			env.N, env.R, env.P = tt.n, tt.r, tt.p
+			data, err := json.Marshal(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Open(data, []byte("pass"), []byte("token"))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Open() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvPassphrase(t *testing.T) {
+	t.Setenv("TEST_PASSPHRASE", "")
+	t.Setenv("TEST_PASSPHRASE_FILE", "")
+	if p, err := EnvPassphrase("TEST_PASSPHRASE"); p != nil || err != nil {
+		t.Errorf("EnvPassphrase() unset = %q, %v, want nil", p, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "passphrase")
+	os.WriteFile(file, []byte("from file\n"), 0600)
+	t.Setenv("TEST_PASSPHRASE_FILE", file)
+	if p, err := EnvPassphrase("TEST_PASSPHRASE"); string(p) != "from file" || err != nil {
+		t.Errorf("EnvPassphrase() from file = %q, %v", p, err)
+	}
+
+	t.Setenv("TEST_PASSPHRASE", "from env")
+	if p, err := EnvPassphrase("TEST_PASSPHRASE"); string(p) != "from env" || err != nil {
+		t.Errorf("EnvPassphrase() = %q, %v, want the variable to win", p, err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+)
+
+// What a run does when another run holds its lock.
+const (
+	lockFail = "fail" // give up with exitLocked
+	lockSkip = "skip" // exit successfully without doing anything
+	lockWait = "wait" // wait for the other run to finish
+	lockNone = "none" // do not lock at all
+)
+
+// lockPollInterval is how often a waiting run checks the lock again.
+const lockPollInterval = time.Second
+
+// lockInfo is the content of a lock file, identifying the run holding it.
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	User    string    `json:"user"`
+	Config  string    `json:"config"`
+	Started time.Time `json:"started"`
+}
+
+func (l lockInfo) String() string {
+	if l.PID == 0 {
+		// The holder has not written its details yet.
+		return "another process"
+	}
+	return fmt.Sprintf("process %d on %s, started %s", l.PID, l.Host, l.Started.Local().Format(time.RFC1123))
+}
+
+// errLocked is returned, wrapped, when another run holds the lock.
+var errLocked = errors.New("another run is in progress")
+
+// errLockBusy is returned by lockFile when another open file holds the lock.
+var errLockBusy = errors.New("lock is held")
+
+// runLock is an advisory lock held by a run for one account and config, so
+// that runs started by cron cannot overlap. It is an exclusive lock (flock,
+// LockFileEx on Windows) on a file the run keeps open, which the operating
+// system releases however the run ends, so a run that crashed leaves no
+// lock behind. The file holds the PID and host name of the holder, to tell
+// who holds the lock; it plays no part in the locking.
+type runLock struct {
+	path string
+	info lockInfo
+	f    *os.File
+}
+
+// defaultLockPath returns the lock file for user and the config at
+// configPath, in the cache directory of the user, or next to the config
+// when there is none. Other users cannot create the file first there.
+func defaultLockPath(user, configPath string) string {
+	if abs, err := filepath.Abs(configPath); err == nil {
+		configPath = abs
+	}
+	sum := sha256.Sum256([]byte(user + "\x00" + configPath))
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = filepath.Dir(configPath)
+	} else {
+		dir = filepath.Join(dir, "gmail-download")
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x.lock", sum[:8]))
+}
+
+// acquireLock takes the lock at path for user and configPath. When another
+// run holds it, acquireLock returns an error wrapping errLocked, unless wait
+// is set: then it waits for the lock until ctx is done.
+func acquireLock(ctx context.Context, path, user, configPath string, wait bool) (*runLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	l := &runLock{path: path, info: lockInfo{
+		PID: os.Getpid(), Host: host, User: user, Config: configPath, Started: time.Now(),
+	}}
+	logged := false
+	for {
+		holder, err := l.tryLock()
+		if err != nil {
+			return nil, err
+		}
+		if holder == nil {
+			return l, nil
+		}
+		if !wait {
+			return nil, fmt.Errorf("%w: %s holds %s", errLocked, holder, path)
+		}
+		if !logged {
+			slog.Info("waiting for the other run to finish", "holder", holder.String(), download.AttrPath, path)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryLock locks the lock file, creating it if need be, and writes the
+// details of the run to it. It returns the holder of the lock when another
+// run has it.
+func (l *runLock) tryLock() (*lockInfo, error) {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLockBusy) {
+			return readLock(l.path), nil
+		}
+		return nil, fmt.Errorf("unable to lock %s: %w", l.path, err)
+	}
+	// Release empties the file, so details left in it are those of a run
+	// that ended without releasing the lock, such as one that crashed.
+	if prev := readLock(l.path); prev.PID != 0 {
+		slog.Warn("taking over the lock of a run that did not release it", download.AttrPath, l.path, "holder", prev.String())
+	}
+	if err := l.write(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f = f
+	return nil, nil
+}
+
+// write replaces the content of the lock file f with the details of the
+// run.
+func (l *runLock) write(f *os.File) error {
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readLock returns the details of the run holding, or last holding, the
+// lock at path; a zero lockInfo when they cannot be read.
+func readLock(path string) *lockInfo {
+	holder := &lockInfo{}
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, holder) != nil {
+		return &lockInfo{}
+	}
+	return holder
+}
+
+// Release empties the lock file and releases the lock. The file is left
+// in place: removing it could let a run lock a file that is no longer
+// there while another creates and locks a new one.
+func (l *runLock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := l.f.Truncate(0)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
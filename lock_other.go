@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// lockFile cannot lock files on this platform.
+func lockFile(f *os.File) error {
+	return fmt.Errorf("%w: file locks are not supported on this platform, use -lock none", errors.ErrUnsupported)
+}
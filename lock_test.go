@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	ctx := context.Background()
+
+	lock, err := acquireLock(ctx, path, "me", "config.yaml", false)
+	if err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+	if holder := readLock(path); holder.PID != os.Getpid() || holder.User != "me" {
+		t.Errorf("lock file = %+v, want held by this process", holder)
+	}
+	if fi, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0600) {
+		t.Errorf("lock file mode = %v, %v, want 0600", fi.Mode(), err)
+	}
+
+	_, err = acquireLock(ctx, path, "me", "config.yaml", false)
+	if !errors.Is(err, errLocked) || !strings.Contains(err.Error(), "process") {
+		t.Errorf("second acquireLock() error = %v, want the lock held with its holder", err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if holder := readLock(path); holder.PID != 0 {
+		t.Errorf("lock file = %+v after Release(), want it emptied", holder)
+	}
+	lock, err = acquireLock(ctx, path, "me", "config.yaml", false)
+	if err != nil {
+		t.Fatalf("acquireLock() after Release() error = %v", err)
+	}
+	lock.Release()
+}
+
+// writeLock writes a lock file held by pid on host.
+func writeLock(t *testing.T, path string, pid int, host string) {
+	t.Helper()
+	data, _ := json.Marshal(lockInfo{PID: pid, Host: host, Started: time.Now()})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireLock_Stale(t *testing.T) {
+	host, _ := os.Hostname()
+	dir := t.TempDir()
+	logs := captureLog(t)
+
+	// The details of a run that died are left in the file, but it holds no
+	// lock any more, whichever host it ran on.
+	for _, h := range []string{host, host + ".elsewhere"} {
+		path := filepath.Join(dir, h+".lock")
+		writeLock(t, path, 1<<30, h)
+		lock, err := acquireLock(context.Background(), path, "me", "config.yaml", false)
+		if err != nil {
+			t.Fatalf("acquireLock() over a dead process on %s error = %v", h, err)
+		}
+		if holder := readLock(path); holder.PID != os.Getpid() {
+			t.Errorf("lock file = %+v, want held by this process", holder)
+		}
+		lock.Release()
+	}
+	if !strings.Contains(logs.String(), `level=WARN msg="taking over the lock of a run that did not release it"`) {
+		t.Errorf("log does not mention the stale lock:\n%s", logs)
+	}
+
+	garbled := filepath.Join(dir, "garbled.lock")
+	os.WriteFile(garbled, []byte("{"), 0600)
+	lock, err := acquireLock(context.Background(), garbled, "me", "config.yaml", false)
+	if err != nil {
+		t.Fatalf("acquireLock() over a garbled lock error = %v", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireLock_StaleRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	host, _ := os.Hostname()
+	writeLock(t, path, 1<<30, host)
+	captureLog(t)
+
+	const runs = 8
+	var (
+		start = make(chan struct{})
+		wg    sync.WaitGroup
+		locks = make([]*runLock, runs)
+		errs  = make([]error, runs)
+	)
+	for i := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			locks[i], errs[i] = acquireLock(context.Background(), path, "me", "config.yaml", false)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	held := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			held++
+			defer locks[i].Release()
+		case !errors.Is(err, errLocked):
+			t.Errorf("acquireLock() error = %v, want it held", err)
+		}
+	}
+	if held != 1 {
+		t.Errorf("%d runs took over the stale lock, want 1", held)
+	}
+}
+
+func TestAcquireLock_Wait(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	captureLog(t)
+	first, err := acquireLock(context.Background(), path, "me", "config.yaml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := acquireLock(ctx, path, "me", "config.yaml", true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting acquireLock() error = %v, want it to give up at the deadline", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { first.Release() })
+	second, err := acquireLock(context.Background(), path, "me", "config.yaml", true)
+	if err != nil {
+		t.Fatalf("waiting acquireLock() error = %v, want the lock once released", err)
+	}
+	second.Release()
+}
+
+func TestDefaultLockPath(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	t.Setenv("LocalAppData", cache)
+	a := defaultLockPath("me", "a.yaml")
+	if !strings.HasPrefix(a, cache+string(filepath.Separator)) {
+		t.Errorf("defaultLockPath() = %s, want it in the cache directory %s", a, cache)
+	}
+	if a != defaultLockPath("me", "./a.yaml") {
+		t.Errorf("the same config gives different locks")
+	}
+	if a == defaultLockPath("me", "b.yaml") || a == defaultLockPath("other@example.com", "a.yaml") {
+		t.Errorf("different accounts or configs share the lock %s", a)
+	}
+}
+
+func TestCmdRun_Locked(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.json")
+	os.WriteFile(config, []byte(`{"label_actions": [{"label": "INBOX", "actions": [{"mark_as_read": true}]}]}`), 0644)
+	path := filepath.Join(dir, "run.lock")
+	captureLog(t)
+	lock, err := acquireLock(context.Background(), path, "me", config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	args := []string{"run", "-config", config, "-lock-file", path, "-checkpoint", ""}
+	if got := runCLI(append(args, "-lock", "fail")); got != exitLocked {
+		t.Errorf("run -lock fail = %d, want %d", got, exitLocked)
+	}
+	if got := runCLI(append(args, "-lock", "skip")); got != exitOK {
+		t.Errorf("run -lock skip = %d, want %d", got, exitOK)
+	}
+	if got := runCLI(append(args, "-lock", "wait", "-lock-timeout", "50ms")); got != exitLocked {
+		t.Errorf("run -lock wait = %d, want %d", got, exitLocked)
+	}
+	if got := runCLI(append(args, "-lock", "sometimes")); got != exitUsage {
+		t.Errorf("run -lock sometimes = %d, want %d", got, exitUsage)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive lock on f with LockFileEx without blocking,
+// returning errLockBusy when another handle holds it. Closing f releases
+// it. The byte locked lies far beyond the content, which other runs must
+// still be able to read to report the holder.
+func lockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: 1 << 30}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return errLockBusy
+	}
+	return err
+}
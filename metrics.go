@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/googleapi"
+)
+
+const metricsNamespace = "gmail_download"
+
+// runMetrics are the Prometheus metrics of the runs of a daemon, served on
+// /metrics of the status address. Runs are counted from their results;
+// Gmail API calls as they are made, as the CallHook of the processor.
+type runMetrics struct {
+	registry *prometheus.Registry
+
+	scanned         *prometheus.CounterVec
+	matched         *prometheus.CounterVec
+	attachments     *prometheus.CounterVec
+	attachmentBytes *prometheus.CounterVec
+	emails          *prometheus.CounterVec
+	decryptFailures *prometheus.CounterVec
+	deletes         *prometheus.CounterVec
+	failures        *prometheus.CounterVec
+	runDuration     *prometheus.HistogramVec
+	lastSuccess     *prometheus.GaugeVec
+
+	apiCalls        *prometheus.CounterVec
+	apiCallDuration *prometheus.HistogramVec
+	retries         *prometheus.CounterVec
+}
+
+func newRunMetrics() *runMetrics {
+	action := []string{"label", "action"}
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: metricsNamespace, Name: name, Help: help}, labels)
+	}
+	m := &runMetrics{
+		registry:        prometheus.NewRegistry(),
+		scanned:         counter("messages_scanned_total", "Messages listed by the searches of the actions.", action...),
+		matched:         counter("messages_matched_total", "Messages the actions were run on.", action...),
+		attachments:     counter("attachments_downloaded_total", "Attachments saved.", action...),
+		attachmentBytes: counter("attachment_bytes_downloaded_total", "Bytes of the attachments saved.", action...),
+		emails:          counter("emails_saved_total", "Emails saved as PDFs.", action...),
+		decryptFailures: counter("decrypt_failures_total", "Saved PDFs none of the passwords opened.", action...),
+		deletes:         counter("messages_deleted_total", "Messages deleted.", action...),
+		failures:        counter("failures_total", "Failed steps, by step and whether the failure was transient.", "label", "action", "step", "category"),
+		runDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_duration_seconds",
+			Help:      "How long the runs of the actions took.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		}, action),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_success_timestamp_seconds",
+			Help:      "When a run of the action last completed without failures, as a Unix time.",
+		}, action),
+		apiCalls: counter("api_calls_total", "Gmail API requests, by method and HTTP status; batch requests count once.", "method", "status"),
+		apiCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_call_duration_seconds",
+			Help:      "How long Gmail API requests took.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		retries: counter("api_retries_total", "Gmail API requests retried after transient errors.", "method"),
+	}
+	m.registry.MustRegister(
+		m.scanned, m.matched, m.attachments, m.attachmentBytes, m.emails, m.decryptFailures, m.deletes, m.failures,
+		m.runDuration, m.lastSuccess, m.apiCalls, m.apiCallDuration, m.retries,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observe counts what a run did. Actions of an interrupted run count, but do
+// not succeed.
+func (m *runMetrics) observe(result *download.Result) {
+	for _, l := range result.Labels {
+		for _, a := range l.Actions {
+			labels := prometheus.Labels{"label": l.Label, "action": strconv.Itoa(a.Index)}
+			m.scanned.With(labels).Add(float64(a.Scanned))
+			m.matched.With(labels).Add(float64(a.Matched))
+			m.runDuration.With(labels).Observe(time.Duration(a.Duration).Seconds())
+			failed := len(a.Errors) > 0
+			for _, e := range a.Errors {
+				m.failures.WithLabelValues(l.Label, labels["action"], e.Step, e.Category).Inc()
+			}
+			for _, msg := range a.Messages {
+				if msg.Deleted {
+					m.deletes.With(labels).Inc()
+				}
+				for _, e := range msg.Errors {
+					failed = true
+					m.failures.WithLabelValues(l.Label, labels["action"], e.Step, e.Category).Inc()
+				}
+				for _, f := range msg.Files {
+					switch f.Kind {
+					case download.FileAttachment:
+						m.attachments.With(labels).Inc()
+						m.attachmentBytes.With(labels).Add(float64(f.Size))
+					case download.FileEmail:
+						m.emails.With(labels).Inc()
+					}
+					if f.Decrypt == download.DecryptFailed {
+						m.decryptFailures.With(labels).Inc()
+					}
+				}
+			}
+			if !failed && !result.Interrupted {
+				m.lastSuccess.With(labels).SetToCurrentTime()
+			}
+		}
+	}
+}
+
+// OnCall counts a Gmail API request, as the CallHook of the processor.
+func (m *runMetrics) OnCall(ctx context.Context, e download.CallEvent) {
+	m.apiCalls.WithLabelValues(e.Method, callStatus(e.Err)).Inc()
+	m.apiCallDuration.WithLabelValues(e.Method).Observe(e.Duration.Seconds())
+	if e.Retry {
+		m.retries.WithLabelValues(e.Method).Inc()
+	}
+}
+
+// callStatus returns the HTTP status of a Gmail API request that returned
+// err: "200" on success, "canceled" when the run was, and "error" when
+// there was no response, as on network errors.
+func callStatus(err error) string {
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+		return strconv.Itoa(http.StatusOK)
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.Code)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return "error"
+}
+
+func (m *runMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+	"google.golang.org/api/googleapi"
+)
+
+// scrape returns the metrics as Prometheus scrapes them.
+func scrape(t *testing.T, m *runMetrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestRunMetrics(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	fake := download.NewFakeMail("me@example.com")
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, fake.AddMessage(download.FakeMessage{
+			Subject: "statement",
+			Date:    time.Date(2024, 3, 1+i, 9, 0, 0, 0, time.UTC),
+			Labels:  []string{"Bank"},
+			Attachments: []download.FakeAttachment{
+				{Filename: fmt.Sprintf("statement%d.txt", i), Data: []byte("12345")},
+			},
+		}))
+	}
+	fake.AddMessage(download.FakeMessage{Subject: "newsletter", Labels: []string{"Bank"}})
+	fake.Fail("messages.delete", ids[2], &googleapi.Error{Code: http.StatusForbidden, Message: "Forbidden"}, 1)
+
+	config := &download.Config{LabelActions: []download.LabelAction{{Label: "Bank", Actions: []download.Action{{
+		SubjectFilter:   "statement",
+		Download:        true,
+		SaveTo:          dir,
+		FilenamePattern: "{original}",
+		Delete:          true,
+	}}}}}
+	m := newRunMetrics()
+	p, err := download.NewProcessor(config, fake, download.LocalStorage{}, download.Options{User: "me", Workers: 1, BatchSize: 1, CallHook: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	m.observe(result)
+	m.OnCall(context.Background(), download.CallEvent{Method: "messages.get", Calls: 1, Attempt: 1,
+		Err: &googleapi.Error{Code: http.StatusServiceUnavailable}, Retry: true})
+
+	metrics := scrape(t, m)
+	for _, want := range []string{
+		`gmail_download_messages_scanned_total{action="0",label="Bank"} 3`,
+		`gmail_download_messages_matched_total{action="0",label="Bank"} 3`,
+		`gmail_download_attachments_downloaded_total{action="0",label="Bank"} 3`,
+		`gmail_download_attachment_bytes_downloaded_total{action="0",label="Bank"} 15`,
+		`gmail_download_messages_deleted_total{action="0",label="Bank"} 2`,
+		`gmail_download_failures_total{action="0",category="permanent",label="Bank",step="delete"} 1`,
+		`gmail_download_run_duration_seconds_count{action="0",label="Bank"} 1`,
+		`gmail_download_api_calls_total{method="messages.get",status="200"} 3`,
+		`gmail_download_api_calls_total{method="messages.get",status="503"} 1`,
+		`gmail_download_api_calls_total{method="messages.delete",status="403"} 1`,
+		`gmail_download_api_retries_total{method="messages.get"} 1`,
+		`gmail_download_api_call_duration_seconds_count{method="messages.list"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics do not have %s:\n%s", want, metrics)
+		}
+	}
+	// The failed delete keeps the action from succeeding.
+	if strings.Contains(metrics, "gmail_download_last_success_timestamp_seconds{") {
+		t.Errorf("metrics have a last success despite the failure:\n%s", metrics)
+	}
+
+	result, err = p.Run(context.Background())
+	if err != nil || result.Err() != nil {
+		t.Fatalf("second Run() = %v, %v", err, result.Err())
+	}
+	m.observe(result)
+	if metrics := scrape(t, m); !strings.Contains(metrics, `gmail_download_last_success_timestamp_seconds{action="0",label="Bank"}`) {
+		t.Errorf("metrics do not have the last success:\n%s", metrics)
+	}
+}
+
+func TestCallStatus(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "200"},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, "429"},
+		{fmt.Errorf("getting message: %w", &googleapi.Error{Code: http.StatusNotFound}), "404"},
+		{context.Canceled, "canceled"},
+		{errors.New("connection reset by peer"), "error"},
+	} {
+		if got := callStatus(tt.err); got != tt.want {
+			t.Errorf("callStatus(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
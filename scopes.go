@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bhargavakumark/gmail-download/download"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+var (
+	// Google's OAuth endpoints, variables so tests can point them elsewhere.
+	revokeURL    = "https://oauth2.googleapis.com/revoke"
+	tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+)
+
+// scopeRank orders the Gmail scopes this tool uses by how much they allow.
+// Each scope includes everything a lower-ranked one does.
+var scopeRank = map[string]int{
+	gmail.GmailReadonlyScope: 1,
+	gmail.GmailModifyScope:   2,
+	gmail.MailGoogleComScope: 3,
+}
+
+// scopeNames maps the short names accepted on the command line to scopes.
+var scopeNames = map[string]string{
+	"readonly": gmail.GmailReadonlyScope,
+	"modify":   gmail.GmailModifyScope,
+	"full":     gmail.MailGoogleComScope,
+}
+
+// requiredScope returns the narrowest scope that allows every action in the
+// config: full access for deletes, modify for marking as read, read-only
+// otherwise.
+func requiredScope(config *download.Config) string {
+	scope := gmail.GmailReadonlyScope
+	for _, labelAction := range config.LabelActions {
+		for _, action := range labelAction.Actions {
+			if action.Delete {
+				return gmail.MailGoogleComScope
+			}
+			if action.MarkAsRead {
+				scope = gmail.GmailModifyScope
+			}
+		}
+	}
+	return scope
+}
+
+// parseScopeName converts a short scope name ("readonly", "modify", "full")
+// to the Gmail scope URL.
+func parseScopeName(name string) (string, error) {
+	scope, ok := scopeNames[name]
+	if !ok {
+		return "", fmt.Errorf("unknown scope %q (want readonly, modify or full)", name)
+	}
+	return scope, nil
+}
+
+// scopeSatisfies reports whether the granted scopes allow everything the
+// required scope does.
+func scopeSatisfies(granted []string, required string) bool {
+	for _, scope := range granted {
+		if scopeRank[scope] >= scopeRank[required] {
+			return true
+		}
+	}
+	return false
+}
+
+// broadestScope returns the highest-ranked Gmail scope in scopes, or "" if
+// none of them is a Gmail scope.
+func broadestScope(scopes []string) string {
+	best := ""
+	for _, scope := range scopes {
+		if scopeRank[scope] > scopeRank[best] {
+			best = scope
+		}
+	}
+	return best
+}
+
+// grantedScopes returns the scopes Google reported in the token response,
+// falling back to the requested ones when the response did not include them.
+func grantedScopes(tok *oauth2.Token, requested []string) []string {
+	if s, ok := tok.Extra("scope").(string); ok && s != "" {
+		return strings.Fields(s)
+	}
+	return requested
+}
+
+// lookupScopes asks Google's tokeninfo endpoint which scopes an access token
+// carries. It is used for tokens saved before scopes were recorded.
+func lookupScopes(ctx context.Context, client *http.Client, accessToken string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenInfoURL+"?access_token="+url.QueryEscape(accessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo returned %s", resp.Status)
+	}
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// revokeToken revokes the grant behind tok at Google. Revoking the refresh
+// token also invalidates every access token issued from it.
+func revokeToken(ctx context.Context, client *http.Client, tok *oauth2.Token) error {
+	value := tok.RefreshToken
+	if value == "" {
+		value = tok.AccessToken
+	}
+	if value == "" {
+		return fmt.Errorf("token has nothing to revoke")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(url.Values{"token": {value}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body.Error != "" {
+			return fmt.Errorf("revoke failed: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+		}
+		return fmt.Errorf("revoke failed: %s", resp.Status)
+	}
+	return nil
+}
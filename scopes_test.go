@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bhargavakumark/gmail-download/download"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []download.Action
+		want    string
+	}{
+		{
+			name:    "download only",
+			actions: []download.Action{{Download: true}},
+			want:    gmail.GmailReadonlyScope,
+		},
+		{
+			name:    "mark as read",
+			actions: []download.Action{{Download: true}, {MarkAsRead: true}},
+			want:    gmail.GmailModifyScope,
+		},
+		{
+			name:    "delete after mark as read",
+			actions: []download.Action{{MarkAsRead: true}, {Delete: true}},
+			want:    gmail.MailGoogleComScope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &download.Config{LabelActions: []download.LabelAction{{Label: "INBOX", Actions: tt.actions}}}
+			if got := requiredScope(config); got != tt.want {
+				t.Errorf("requiredScope() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScopeSatisfies(t *testing.T) {
+	tests := []struct {
+		name     string
+		granted  []string
+		required string
+		want     bool
+	}{
+		{"same scope", []string{gmail.GmailModifyScope}, gmail.GmailModifyScope, true},
+		{"broader scope", []string{gmail.MailGoogleComScope}, gmail.GmailReadonlyScope, true},
+		{"narrower scope", []string{gmail.GmailReadonlyScope}, gmail.MailGoogleComScope, false},
+		{"unrelated scope", []string{"openid"}, gmail.GmailReadonlyScope, false},
+		{"no scopes", nil, gmail.GmailReadonlyScope, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scopeSatisfies(tt.granted, tt.required); got != tt.want {
+				t.Errorf("scopeSatisfies(%v, %v) = %v, want %v", tt.granted, tt.required, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScopeName(t *testing.T) {
+	if got, err := parseScopeName("full"); err != nil || got != gmail.MailGoogleComScope {
+		t.Errorf("parseScopeName(full) = %v, %v, want %v", got, err, gmail.MailGoogleComScope)
+	}
+	if _, err := parseScopeName("admin"); err == nil {
+		t.Error("parseScopeName(admin) error = nil, want error")
+	}
+}
+
+func TestGrantedScopes(t *testing.T) {
+	tok := (&oauth2.Token{AccessToken: "a"}).WithExtra(map[string]interface{}{
+		"scope": gmail.GmailReadonlyScope + " " + gmail.GmailModifyScope,
+	})
+	want := []string{gmail.GmailReadonlyScope, gmail.GmailModifyScope}
+	if got := grantedScopes(tok, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("grantedScopes() = %v, want %v", got, want)
+	}
+
+	requested := []string{gmail.GmailReadonlyScope}
+	if got := grantedScopes(&oauth2.Token{}, requested); !reflect.DeepEqual(got, requested) {
+		t.Errorf("grantedScopes() without extra = %v, want %v", got, requested)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	var gotToken string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("revoke method = %s, want POST", r.Method)
+		}
+		gotToken = r.FormValue("token")
+		if gotToken == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_token","error_description":"Token expired or revoked"}`))
+		}
+	}))
+	defer server.Close()
+
+	oldURL := revokeURL
+	revokeURL = server.URL
+	defer func() { revokeURL = oldURL }()
+
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+	if err := revokeToken(context.Background(), server.Client(), tok); err != nil {
+		t.Fatalf("revokeToken() error = %v", err)
+	}
+	if gotToken != "refresh" {
+		t.Errorf("revokeToken() sent token %q, want the refresh token", gotToken)
+	}
+
+	if err := revokeToken(context.Background(), server.Client(), &oauth2.Token{AccessToken: "bad"}); err == nil {
+		t.Error("revokeToken() error = nil, want error for rejected token")
+	}
+}
+
+func TestLookupScopes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "access" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"scope": "` + gmail.GmailModifyScope + `", "expires_in": "3599"}`))
+	}))
+	defer server.Close()
+
+	oldURL := tokenInfoURL
+	tokenInfoURL = server.URL
+	defer func() { tokenInfoURL = oldURL }()
+
+	got, err := lookupScopes(context.Background(), server.Client(), "access")
+	if err != nil {
+		t.Fatalf("lookupScopes() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{gmail.GmailModifyScope}) {
+		t.Errorf("lookupScopes() = %v, want [%v]", got, gmail.GmailModifyScope)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bhargavakumark/gmail-download/internal/atomicfile"
+	"github.com/bhargavakumark/gmail-download/internal/sealed"
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenStoreFile      = "file"
+	tokenStoreEncrypted = "encrypted"
+
+	defaultTokenFile          = "token.json"
+	defaultEncryptedTokenFile = "token.json.enc"
+)
+
+// tokenAAD binds the ciphertext to its purpose so an encrypted blob from
+// another tool cannot be swapped in.
+var tokenAAD = []byte("gmail-download token v1")
+
+// StoredToken is what a TokenStore persists: the OAuth token plus the scopes
+// that were granted with it. The token fields are flattened into the same
+// JSON object, so token.json files written before scopes were recorded still
+// load (with no scopes).
+type StoredToken struct {
+	*oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// TokenStore persists the OAuth token between runs.
+type TokenStore interface {
+	// Load returns the stored token, or an error wrapping os.ErrNotExist
+	// when nothing has been stored yet.
+	Load() (*StoredToken, error)
+	// Save replaces the stored token.
+	Save(tok *StoredToken) error
+	// Delete removes the stored token.
+	Delete() error
+	// Location describes where the token lives, for log messages.
+	Location() string
+}
+
+// fileTokenStore keeps the token as plaintext JSON, compatible with the
+// token.json files written by earlier versions.
+type fileTokenStore struct {
+	path string
+}
+
+func newFileTokenStore(path string) *fileTokenStore {
+	return &fileTokenStore{path: path}
+}
+
+func (s *fileTokenStore) Load() (*StoredToken, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStoredToken(data)
+}
+
+func (s *fileTokenStore) Save(tok *StoredToken) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, data, 0o600)
+}
+
+func (s *fileTokenStore) Delete() error {
+	return os.Remove(s.path)
+}
+
+func (s *fileTokenStore) Location() string {
+	return s.path
+}
+
+// encryptedTokenStore keeps the token encrypted with AES-256-GCM using a key
+// derived from a passphrase with scrypt.
+type encryptedTokenStore struct {
+	path       string
+	passphrase []byte
+}
+
+func newEncryptedTokenStore(path string, passphrase []byte) (*encryptedTokenStore, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("encrypted token store requires a non-empty passphrase")
+	}
+	return &encryptedTokenStore{path: path, passphrase: passphrase}, nil
+}
+
+func (s *encryptedTokenStore) Load() (*StoredToken, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := sealed.Open(data, s.passphrase, tokenAAD)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	tok, err := decodeStoredToken(plain)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decrypted token is not valid JSON: %w", s.path, err)
+	}
+	return tok, nil
+}
+
+func (s *encryptedTokenStore) Save(tok *StoredToken) error {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	data, err := sealed.Seal(plain, s.passphrase, tokenAAD)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, data, 0o600)
+}
+
+func (s *encryptedTokenStore) Delete() error {
+	return os.Remove(s.path)
+}
+
+func (s *encryptedTokenStore) Location() string {
+	return s.path + " (encrypted)"
+}
+
+func decodeStoredToken(data []byte) (*StoredToken, error) {
+	tok := &StoredToken{Token: &oauth2.Token{}}
+	if err := json.Unmarshal(data, tok); err != nil {
+		return nil, err
+	}
+	return tok, nil
+}
+
+// tokenPassphrase returns the token encryption passphrase from
+// GMAIL_TOKEN_PASSPHRASE, or from the file named by
+// GMAIL_TOKEN_PASSPHRASE_FILE. It returns nil if neither is set.
+func tokenPassphrase() ([]byte, error) {
+	return sealed.EnvPassphrase("GMAIL_TOKEN_PASSPHRASE")
+}
+
+// newTokenStore builds the token store selected by GMAIL_TOKEN_STORE
+// ("file" or "encrypted"). When unset, the encrypted store is used if a
+// passphrase is configured and the plain file store otherwise. A non-empty
+// path overrides the default token path of the chosen backend.
+func newTokenStore(path string) (TokenStore, error) {
+	passphrase, err := tokenPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	kind := os.Getenv("GMAIL_TOKEN_STORE")
+	if kind == "" {
+		kind = tokenStoreFile
+		if passphrase != nil {
+			kind = tokenStoreEncrypted
+		}
+	}
+
+	switch kind {
+	case tokenStoreFile:
+		if path == "" {
+			path = defaultTokenFile
+		}
+		return newFileTokenStore(path), nil
+	case tokenStoreEncrypted:
+		if passphrase == nil {
+			return nil, errors.New("encrypted token store requires GMAIL_TOKEN_PASSPHRASE or GMAIL_TOKEN_PASSPHRASE_FILE")
+		}
+		if path == "" {
+			path = defaultEncryptedTokenFile
+		}
+		return newEncryptedTokenStore(path, passphrase)
+	default:
+		return nil, fmt.Errorf("unknown token store %q (want %q or %q)", kind, tokenStoreFile, tokenStoreEncrypted)
+	}
+}
+
+// migrateToken copies the token held by src into dst. When removeSource is
+// set, the source copy is deleted afterwards.
+func migrateToken(src, dst TokenStore, removeSource bool) error {
+	tok, err := src.Load()
+	if err != nil {
+		return fmt.Errorf("reading token from %s: %w", src.Location(), err)
+	}
+	if err := dst.Save(tok); err != nil {
+		return fmt.Errorf("writing token to %s: %w", dst.Location(), err)
+	}
+	// Make sure what we wrote can be read back before touching the source.
+	if _, err := dst.Load(); err != nil {
+		return fmt.Errorf("verifying token in %s: %w", dst.Location(), err)
+	}
+	if removeSource {
+		if err := src.Delete(); err != nil {
+			return fmt.Errorf("removing %s: %w", src.Location(), err)
+		}
+	}
+	return nil
+}
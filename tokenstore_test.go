@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/bhargavakumark/gmail-download/internal/sealed"
+)
+
+func testToken() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  "test-access-token",
+		TokenType:    "Bearer",
+		RefreshToken: "test-refresh-token",
+		Expiry:       time.Now().Add(1 * time.Hour).Round(time.Second),
+	}
+}
+
+func TestFileTokenStore_Load(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	data, err := json.Marshal(testToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokenFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := newFileTokenStore(tokenFile).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if tok.AccessToken != "test-access-token" || tok.RefreshToken != "test-refresh-token" {
+		t.Errorf("Load() = %+v, want the token written", tok.Token)
+	}
+}
+
+func TestFileTokenStore_LoadInvalidJSON(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "invalid.json")
+	if err := os.WriteFile(tokenFile, []byte("invalid json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := newFileTokenStore(tokenFile).Load(); err == nil {
+		t.Errorf("Load() = %+v, want an error for invalid JSON", tok)
+	}
+}
+
+func TestFileTokenStore_Save(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "saved_token.json")
+	store := newFileTokenStore(tokenFile)
+	if err := store.Save(&StoredToken{Token: &oauth2.Token{AccessToken: "old-token"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(&StoredToken{Token: testToken()}); err != nil {
+		t.Fatalf("Save() over an existing token error = %v", err)
+	}
+
+	if fi, err := os.Stat(tokenFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("saved token mode = %v, %v, want 0600", fi.Mode(), err)
+	}
+	tok, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() of the saved token error = %v", err)
+	}
+	if tok.AccessToken != "test-access-token" || tok.RefreshToken != "test-refresh-token" {
+		t.Errorf("Load() = %+v, want the token saved last", tok.Token)
+	}
+}
+
+func TestFileTokenStore_SaveUnwritable(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "missing", "token.json")
+	if err := newFileTokenStore(tokenFile).Save(&StoredToken{Token: testToken()}); err == nil {
+		t.Error("Save() into a missing directory error = nil, want error")
+	}
+}
+
+func TestEncryptedTokenStore_RoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "token.json.enc")
+
+	store, err := newEncryptedTokenStore(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("newEncryptedTokenStore() error = %v", err)
+	}
+	if err := store.Save(&StoredToken{Token: testToken()}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// The refresh token must not appear in the file in clear text
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read token file: %v", err)
+	}
+	if bytes.Contains(data, []byte("test-refresh-token")) {
+		t.Error("encrypted token file contains the refresh token in plaintext")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat token file: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("token file permissions = %o, want 600", perm)
+	}
+
+	tok, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if tok.RefreshToken != "test-refresh-token" {
+		t.Errorf("Load() RefreshToken = %v, want test-refresh-token", tok.RefreshToken)
+	}
+}
+
+func TestEncryptedTokenStore_WrongPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json.enc")
+
+	store, _ := newEncryptedTokenStore(path, []byte("right"))
+	if err := store.Save(&StoredToken{Token: testToken()}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	other, _ := newEncryptedTokenStore(path, []byte("wrong"))
+	if _, err := other.Load(); err == nil {
+		t.Error("Load() with wrong passphrase error = nil, want error")
+	}
+}
+
+func TestEncryptedTokenStore_Tampered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json.enc")
+
+	store, _ := newEncryptedTokenStore(path, []byte("secret"))
+	if err := store.Save(&StoredToken{Token: testToken()}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	plain, err := sealed.Open(mustReadFile(t, path), []byte("secret"), tokenAAD)
+	if err != nil {
+		t.Fatalf("sealed.Open() error = %v", err)
+	}
+	// Re-seal with a different purpose binding; the store must reject it.
+	blob, err := sealed.Seal(plain, []byte("secret"), []byte("something else"))
+	if err != nil {
+		t.Fatalf("sealed.Seal() error = %v", err)
+	}
+	if err := os.WriteFile(path, blob, 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	if _, err := store.Load(); err == nil {
+		t.Error("Load() of tampered file error = nil, want error")
+	}
+}
+
+func TestEncryptedTokenStore_EmptyPassphrase(t *testing.T) {
+	if _, err := newEncryptedTokenStore("token.json.enc", nil); err == nil {
+		t.Error("newEncryptedTokenStore() with empty passphrase error = nil, want error")
+	}
+}
+
+func TestTokenStore_NotExist(t *testing.T) {
+	tmpDir := t.TempDir()
+	enc, _ := newEncryptedTokenStore(filepath.Join(tmpDir, "missing.enc"), []byte("x"))
+	stores := []TokenStore{
+		newFileTokenStore(filepath.Join(tmpDir, "missing.json")),
+		enc,
+	}
+	for _, store := range stores {
+		if _, err := store.Load(); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s Load() error = %v, want os.ErrNotExist", store.Location(), err)
+		}
+	}
+}
+
+func TestMigrateToken(t *testing.T) {
+	tmpDir := t.TempDir()
+	plainPath := filepath.Join(tmpDir, "token.json")
+	if err := newFileTokenStore(plainPath).Save(&StoredToken{Token: testToken()}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, _ := newEncryptedTokenStore(filepath.Join(tmpDir, "token.json.enc"), []byte("secret"))
+	if err := migrateToken(newFileTokenStore(plainPath), dst, true); err != nil {
+		t.Fatalf("migrateToken() error = %v", err)
+	}
+
+	if _, err := os.Stat(plainPath); !os.IsNotExist(err) {
+		t.Errorf("plaintext token still exists after migration with remove")
+	}
+	tok, err := dst.Load()
+	if err != nil {
+		t.Fatalf("Load() after migration error = %v", err)
+	}
+	if tok.AccessToken != "test-access-token" {
+		t.Errorf("migrated AccessToken = %v, want test-access-token", tok.AccessToken)
+	}
+}
+
+func TestNewTokenStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      string
+		passphrase string
+		wantType   string
+		wantErr    bool
+	}{
+		{name: "default without passphrase", wantType: "file"},
+		{name: "default with passphrase", passphrase: "p", wantType: "encrypted"},
+		{name: "explicit file", store: "file", passphrase: "p", wantType: "file"},
+		{name: "encrypted without passphrase", store: "encrypted", wantErr: true},
+		{name: "unknown backend", store: "keyring", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GMAIL_TOKEN_STORE", tt.store)
+			t.Setenv("GMAIL_TOKEN_PASSPHRASE", tt.passphrase)
+			t.Setenv("GMAIL_TOKEN_PASSPHRASE_FILE", "")
+
+			store, err := newTokenStore("")
+			if tt.wantErr {
+				if err == nil {
+					t.Error("newTokenStore() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newTokenStore() error = %v", err)
+			}
+			switch store.(type) {
+			case *fileTokenStore:
+				if tt.wantType != "file" {
+					t.Errorf("newTokenStore() = file store, want %s", tt.wantType)
+				}
+			case *encryptedTokenStore:
+				if tt.wantType != "encrypted" {
+					t.Errorf("newTokenStore() = encrypted store, want %s", tt.wantType)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenPassphrase_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write passphrase file: %v", err)
+	}
+	t.Setenv("GMAIL_TOKEN_PASSPHRASE", "")
+	t.Setenv("GMAIL_TOKEN_PASSPHRASE_FILE", path)
+
+	p, err := tokenPassphrase()
+	if err != nil {
+		t.Fatalf("tokenPassphrase() error = %v", err)
+	}
+	if string(p) != "from-file" {
+		t.Errorf("tokenPassphrase() = %q, want %q", p, "from-file")
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return data
+}
+
+func TestFileTokenStore_Scopes(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// token.json written before scopes were recorded
+	legacy := filepath.Join(tmpDir, "legacy.json")
+	data, _ := json.Marshal(testToken())
+	if err := os.WriteFile(legacy, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := newFileTokenStore(legacy).Load()
+	if err != nil {
+		t.Fatalf("Load() of legacy token error = %v", err)
+	}
+	if tok.RefreshToken != "test-refresh-token" || len(tok.Scopes) != 0 {
+		t.Errorf("Load() of legacy token = %+v, want refresh token and no scopes", tok)
+	}
+
+	store := newFileTokenStore(filepath.Join(tmpDir, "token.json"))
+	if err := store.Save(&StoredToken{Token: testToken(), Scopes: []string{"s1", "s2"}}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	tok, err = store.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(tok.Scopes) != 2 || tok.Scopes[1] != "s2" {
+		t.Errorf("Load() Scopes = %v, want [s1 s2]", tok.Scopes)
+	}
+
+	// Older versions reading the new file still see a valid token
+	plain := &oauth2.Token{}
+	if err := json.Unmarshal(mustReadFile(t, store.path), plain); err != nil || plain.AccessToken != "test-access-token" {
+		t.Errorf("saved token as an oauth2.Token = %+v, %v, want the saved token", plain, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Where -trace sends the spans of the runs.
+const (
+	traceOff    = ""
+	traceOTLP   = "otlp"
+	traceStdout = "stdout"
+)
+
+// serviceName names the tool in the resource of its spans, unless
+// OTEL_SERVICE_NAME says otherwise.
+const serviceName = "gmail-download"
+
+// traceShutdownTimeout bounds how long exporting the last spans may delay
+// exiting.
+const traceShutdownTimeout = 5 * time.Second
+
+// startTracing sets up the global tracer provider the Processor traces its
+// runs with, exporting to where -trace asks, and returns the function that
+// flushes the spans left and stops it. The OTLP exporter honours the usual
+// OTEL_EXPORTER_OTLP_* variables; without an endpoint it sends to a
+// collector on localhost:4318 over plain HTTP.
+func (o *options) startTracing(ctx context.Context) (stop func(), err error) {
+	var exporter sdktrace.SpanExporter
+	switch strings.ToLower(o.trace) {
+	case traceOff:
+		return func() {}, nil
+	case traceOTLP:
+		var opts []otlptracehttp.Option
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case traceStdout:
+		// Named after the exporter; the spans go to standard error, to
+		// keep them out of the output of commands such as plan.
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	default:
+		return nil, usageError(fmt.Errorf("-trace must be otlp or stdout, got %q", o.trace))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to export traces: %v", err)
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceName(serviceName)}
+	if o.user != "" {
+		attrs = append(attrs, attribute.String(download.AttrAccount, o.user))
+	}
+	res, err := resource.New(ctx, resource.WithAttributes(attrs...), resource.WithFromEnv(), resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe the traces: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return func() {
+		// The run's context may be cancelled by now; the spans of an
+		// interrupted run are worth exporting all the same.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), traceShutdownTimeout)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Warn("unable to export the last spans", download.AttrError, err)
+		}
+	}, nil
+}
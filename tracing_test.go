@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestStartTracing_Invalid(t *testing.T) {
+	if got := runCLI([]string{"plan", "-trace", "jaeger"}); got != exitUsage {
+		t.Errorf("plan -trace jaeger = %d, want %d", got, exitUsage)
+	}
+}
+
+func TestStartTracing_Off(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	var o options
+	stop, err := o.startTracing(context.Background())
+	if err != nil {
+		t.Fatalf("startTracing() error = %v", err)
+	}
+	stop()
+	if otel.GetTracerProvider() != prev {
+		t.Error("startTracing() without -trace replaced the tracer provider")
+	}
+}
+
+func TestStartTracing_Stdout(t *testing.T) {
+	prevProvider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prevProvider) })
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevStderr := os.Stderr
+	os.Stderr = w
+	t.Cleanup(func() { os.Stderr = prevStderr })
+
+	o := options{trace: "stdout", user: "me@example.com"}
+	stop, err := o.startTracing(context.Background())
+	if err != nil {
+		t.Fatalf("startTracing() error = %v", err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "download.run")
+	span.End()
+	stop()
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"Name":"download.run"`, `"Value":"gmail-download"`, `"Value":"me@example.com"`} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("exported spans do not have %s:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+)
+
+const (
+	// watchRenewal is how often the Gmail watch is renewed. A watch expires
+	// after seven days; Gmail recommends renewing it every day.
+	watchRenewal = 24 * time.Hour
+	// watchRetry is how long to wait before trying again to renew a watch
+	// that could not be.
+	watchRetry = 5 * time.Minute
+	// historySlack widens the search for new messages back in time: a
+	// message is dated when Gmail received it, which may be a little before
+	// the previous history sync.
+	historySlack = time.Hour
+)
+
+// mailboxWatch keeps a Gmail watch on the labels of the daemon, receives the
+// push notifications Gmail then publishes through Pub/Sub, and keeps track of
+// the mailbox history processed so far.
+type mailboxWatch struct {
+	topic string
+	// token, if set, must be passed by the push subscription as the token
+	// query parameter, so that nobody else can trigger runs.
+	token    string
+	notified chan struct{}
+
+	mu         sync.Mutex
+	labelIDs   map[string]string // IDs of the watched labels, by name
+	historyID  uint64            // the history processed so far
+	synced     time.Time         // when it was processed
+	notifiedID uint64            // the latest history notified
+	expiration time.Time
+	renewAt    time.Time
+	lastPush   time.Time
+	pushes     int
+	err        string
+}
+
+func newMailboxWatch(topic, token string) *mailboxWatch {
+	return &mailboxWatch{topic: topic, token: token, notified: make(chan struct{}, 1)}
+}
+
+// pushEnvelope is the body of a Pub/Sub push request.
+type pushEnvelope struct {
+	Message struct {
+		Data      []byte `json:"data"` // base64 in the JSON
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// gmailNotification is the data of a Pub/Sub message published by Gmail.
+type gmailNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// handlePush accepts the Pub/Sub push notifications for user. A
+// notification only records that there is history to process; the daemon
+// processes it between runs. Notifications are acknowledged once recorded,
+// and those that cannot be parsed are rejected, so that Pub/Sub retries
+// them.
+func (w *mailboxWatch) handlePush(user string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if w.token != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(w.token)) != 1 {
+			http.Error(rw, "invalid token", http.StatusForbidden)
+			return
+		}
+		var envelope pushEnvelope
+		if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 1<<20)).Decode(&envelope); err != nil {
+			http.Error(rw, "invalid push message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var n gmailNotification
+		if err := json.Unmarshal(envelope.Message.Data, &n); err != nil || n.HistoryID == 0 {
+			http.Error(rw, "invalid Gmail notification", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(user, "@") && !strings.EqualFold(n.EmailAddress, user) {
+			// Acknowledged all the same: it would only come back.
+			slog.Warn("ignoring a push notification for another account", "email", n.EmailAddress)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.mu.Lock()
+		w.lastPush = time.Now()
+		w.pushes++
+		w.notifiedID = max(w.notifiedID, n.HistoryID)
+		news := n.HistoryID > w.historyID
+		w.mu.Unlock()
+		slog.Debug("push notification", "pubsub_message_id", envelope.Message.MessageID, "history_id", n.HistoryID)
+		if news {
+			select {
+			case w.notified <- struct{}{}:
+			default: // a sync is pending already
+			}
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// renewTime returns when the watch should be renewed.
+func (w *mailboxWatch) renewTime() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.renewAt
+}
+
+// watchStatus is the state of the Gmail watch in the daemon status.
+type watchStatus struct {
+	Topic      string    `json:"topic"`
+	Labels     []string  `json:"labels"`
+	HistoryID  uint64    `json:"history_id"`
+	Synced     time.Time `json:"synced"`
+	Expiration time.Time `json:"expiration"`
+	LastPush   time.Time `json:"last_push,omitempty"`
+	Pushes     int       `json:"pushes"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (w *mailboxWatch) status() *watchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := &watchStatus{
+		Topic:      w.topic,
+		Labels:     []string{},
+		HistoryID:  w.historyID,
+		Synced:     w.synced,
+		Expiration: w.expiration,
+		LastPush:   w.lastPush,
+		Pushes:     w.pushes,
+		Error:      w.err,
+	}
+	for name := range w.labelIDs {
+		s.Labels = append(s.Labels, name)
+	}
+	sort.Strings(s.Labels)
+	return s
+}
+
+// startWatch watches the labels of the config for new messages. The history
+// processed so far is kept, so renewing the watch loses nothing; the first
+// watch starts from the current history.
+func (d *daemon) startWatch(ctx context.Context) error {
+	w := d.gmailWatch
+	all, err := d.proc.LabelIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list labels: %w", err)
+	}
+	watched := make(map[string]string)
+	d.mu.Lock()
+	for _, j := range d.jobs {
+		name := j.labelAction.Label
+		if id, ok := all[name]; ok {
+			watched[name] = id
+		} else if _, ok := watched[name]; !ok {
+			slog.Warn("label does not exist, it is not watched", download.AttrLabel, name)
+		}
+	}
+	d.mu.Unlock()
+	ids := make([]string, 0, len(watched))
+	for _, id := range watched {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		return errors.New("none of the labels of the config exist")
+	}
+
+	resp, err := d.proc.Watch(ctx, w.topic, ids)
+	if err != nil {
+		return fmt.Errorf("unable to watch the mailbox: %w", err)
+	}
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.labelIDs = watched
+	if w.historyID == 0 {
+		w.historyID, w.synced = resp.HistoryId, now
+	}
+	w.expiration = time.UnixMilli(resp.Expiration)
+	w.renewAt = now.Add(watchRenewal)
+	if renew := w.expiration.Add(-time.Hour); renew.Before(w.renewAt) {
+		w.renewAt = renew
+	}
+	w.err = ""
+	slog.Info("watching labels for new messages", "labels", len(ids), "topic", w.topic, "until", w.expiration)
+	return nil
+}
+
+// renewWatch renews the watch, trying again a little later if that fails.
+func (d *daemon) renewWatch(ctx context.Context) {
+	err := d.startWatch(ctx)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	w := d.gmailWatch
+	slog.Error("unable to watch the mailbox", "retry_in", watchRetry, download.AttrError, err)
+	w.mu.Lock()
+	w.err = err.Error()
+	w.renewAt = time.Now().Add(watchRetry)
+	w.mu.Unlock()
+}
+
+// syncHistory processes the messages added to the watched labels since the
+// history processed so far. When that history is no longer available,
+// every label runs in full instead.
+func (d *daemon) syncHistory(ctx context.Context) {
+	w := d.gmailWatch
+	w.mu.Lock()
+	start, since := w.historyID, w.synced
+	names := make(map[string]string, len(w.labelIDs))
+	for name, id := range w.labelIDs {
+		names[id] = name
+	}
+	w.mu.Unlock()
+	syncStart := time.Now()
+
+	skipped := false
+	run := func(j *job, added *download.NewMessages) {
+		if d.runJob(ctx, j, added, triggerPush).Skipped != "" {
+			skipped = true
+		}
+	}
+	added, latest, err := d.proc.AddedSince(ctx, start)
+	if errors.Is(err, download.ErrHistoryGone) {
+		slog.Warn("running every label in full", download.AttrError, err)
+		if latest, err = d.proc.HistoryID(ctx); err == nil {
+			for _, j := range d.jobList() {
+				run(j, nil)
+			}
+		}
+	} else if err == nil {
+		for _, j := range d.jobList() {
+			for id, name := range names {
+				if name == j.labelAction.Label && len(added[id]) > 0 {
+					run(j, &download.NewMessages{IDs: added[id], Since: since.Add(-historySlack)})
+				}
+			}
+		}
+	}
+	if ctx.Err() != nil || skipped {
+		// The same history is processed again on the next notification,
+		// or after a restart.
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		slog.Error("unable to process the mailbox history", download.AttrError, err)
+		w.err = err.Error()
+		return
+	}
+	w.historyID, w.synced, w.err = latest, syncStart, ""
+	if w.notifiedID > latest {
+		// Notified of history that was not listed yet: look again.
+		select {
+		case w.notified <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhargavakumark/gmail-download/download"
+)
+
+// watchConfig has three labels that only run when Gmail notifies of new
+// messages in them.
+const watchConfig = `
+label_actions:
+  - label: Bank
+    schedule: {cron: "@yearly"}
+    actions: [{mark_as_read: true}]
+  - label: Bills
+    schedule: {cron: "@yearly"}
+    actions: [{mark_as_read: true}]
+  - label: Quiet
+    schedule: {cron: "@yearly"}
+    actions: [{mark_as_read: true}]
+`
+
+// newWatchedMailbox returns a fake mailbox with a message in INBOX and the
+// labels of watchConfig, as Label_1 to Label_3, and a daemon watching it,
+// with its push endpoint.
+func newWatchedMailbox(t *testing.T) (*download.FakeMail, *daemon, *httptest.Server) {
+	t.Helper()
+	fake := newTestMail(1, "INBOX", "Bank", "Bills", "Quiet")
+	d, _ := newTestDaemon(t, fake, watchConfig)
+	d.user = "me@example.com"
+	d.gmailWatch = newMailboxWatch("projects/p/topics/gmail", "s3cret")
+	if err := d.startWatch(context.Background()); err != nil {
+		t.Fatalf("startWatch() error = %v", err)
+	}
+	srv := httptest.NewServer(d.gmailWatch.handlePush(d.user))
+	t.Cleanup(srv.Close)
+	return fake, d, srv
+}
+
+// push posts a Pub/Sub push message for Gmail history historyID to srv.
+func push(t *testing.T, srv *httptest.Server, token, email string, historyID uint64) int {
+	t.Helper()
+	data := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"emailAddress": %q, "historyId": %d}`, email, historyID)))
+	body := fmt.Sprintf(`{"message": {"data": %q, "messageId": "1", "publishTime": "2024-03-01T10:00:00Z"}, "subscription": "projects/p/subscriptions/gmail-push"}`, data)
+	resp, err := srv.Client().Post(srv.URL+pushPath+"?token="+token, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// historyID returns the latest history record of fake.
+func historyID(t *testing.T, fake *download.FakeMail) uint64 {
+	t.Helper()
+	profile, err := fake.GetProfile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile.HistoryId
+}
+
+// opsOf returns the calls fake had for the message id, without the
+// "messages." prefix of their methods.
+func opsOf(fake *download.FakeMail, id string) string {
+	var ops []string
+	for _, call := range fake.Calls() {
+		if method, ok := strings.CutSuffix(call, " "+id); ok {
+			ops = append(ops, strings.TrimPrefix(method, "messages."))
+		}
+	}
+	return strings.Join(ops, ",")
+}
+
+func TestDaemon_StartWatch(t *testing.T) {
+	captureLog(t)
+	fake, d, _ := newWatchedMailbox(t)
+
+	watches := fake.Watches()
+	if len(watches) != 1 {
+		t.Fatalf("watch requests = %d, want 1", len(watches))
+	}
+	req := watches[0]
+	if req.TopicName != "projects/p/topics/gmail" || strings.Join(req.LabelIds, ",") != "Label_1,Label_2,Label_3" || req.LabelFilterBehavior != "include" {
+		t.Errorf("watch request = %+v", req)
+	}
+	st := d.status().Watch
+	if st.HistoryID != historyID(t, fake) || len(st.Labels) != 3 || st.Expiration.Before(time.Now().Add(6*24*time.Hour)) {
+		t.Errorf("watch status = %+v", st)
+	}
+	if renew := d.gmailWatch.renewTime(); renew.After(time.Now().Add(watchRenewal)) {
+		t.Errorf("renewal at %v, want within a day", renew)
+	}
+}
+
+func TestDaemon_PushProcessesNewMessages(t *testing.T) {
+	captureLog(t)
+	fake, d, srv := newWatchedMailbox(t)
+	old := fake.AddMessage(download.FakeMessage{Subject: "old", Labels: []string{"INBOX", "UNREAD"}})
+	added := fake.AddMessage(download.FakeMessage{Subject: "statement", Labels: []string{"INBOX", "UNREAD", "Bank"}})
+	labelled := fake.AddMessage(download.FakeMessage{Subject: "bill", Labels: []string{"INBOX", "UNREAD"}})
+	if err := fake.AddLabels(labelled, "Bills"); err != nil {
+		t.Fatal(err)
+	}
+	latest := historyID(t, fake)
+	startDaemon(t, d)
+
+	if code := push(t, srv, "s3cret", "me@example.com", latest); code != http.StatusNoContent {
+		t.Fatalf("push = %d, want 204", code)
+	}
+	waitFor(t, "the history to be processed", func() bool { return d.status().Watch.HistoryID == latest })
+
+	for id, want := range map[string]string{old: "", added: "get,modify", labelled: "get,modify"} {
+		if got := opsOf(fake, id); got != want {
+			t.Errorf("calls for %s = %q, want %q", id, got, want)
+		}
+	}
+	if n := searchesOf(fake, "Quiet"); n != 0 {
+		t.Errorf("Quiet was searched %d time(s), want none without new messages", n)
+	}
+	for _, q := range fake.Searches() {
+		if !strings.Contains(q, " after:") {
+			t.Errorf("search %q is not narrowed to recent messages", q)
+		}
+	}
+	bank, _ := labelStatusOf(d, "Bank")
+	if bank.LastRun == nil || bank.LastRun.Trigger != triggerPush || bank.NextRun.Before(time.Now().AddDate(0, 0, 1)) {
+		t.Errorf("Bank status = %+v, want a push run and the schedule untouched", bank)
+	}
+
+	// The same history again is nothing new.
+	push(t, srv, "s3cret", "me@example.com", latest)
+	time.Sleep(50 * time.Millisecond)
+	if got := opsOf(fake, added); got != "get,modify" {
+		t.Errorf("calls for %s after a repeated push = %q", added, got)
+	}
+}
+
+func TestDaemon_PushRejected(t *testing.T) {
+	logs := captureLog(t)
+	_, d, srv := newWatchedMailbox(t)
+
+	if code := push(t, srv, "guess", "me@example.com", 200); code != http.StatusForbidden {
+		t.Errorf("push with a wrong token = %d, want 403", code)
+	}
+	if code := push(t, srv, "s3cret", "someone@example.com", 200); code != http.StatusNoContent {
+		t.Errorf("push for another account = %d, want it acknowledged", code)
+	}
+	if !strings.Contains(logs.String(), `msg="ignoring a push notification for another account" email=someone@example.com`) {
+		t.Errorf("log does not mention the ignored push:\n%s", logs)
+	}
+	resp, err := srv.Client().Post(srv.URL+pushPath+"?token=s3cret", "application/json", strings.NewReader(`{"message": {"data": "bm90IGpzb24="}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("push of garbage = %d, want 400", resp.StatusCode)
+	}
+	select {
+	case <-d.gmailWatch.notified:
+		t.Error("a rejected push asked for a sync")
+	default:
+	}
+}
+
+func TestDaemon_HistoryGone(t *testing.T) {
+	captureLog(t)
+	fake, d, _ := newWatchedMailbox(t)
+	fake.AddMessage(download.FakeMessage{Subject: "statement", Labels: []string{"Bank"}})
+	fake.ExpireHistory()
+	current := historyID(t, fake)
+
+	d.syncHistory(context.Background())
+	for _, label := range []string{"Bank", "Bills", "Quiet"} {
+		if n := searchesOf(fake, label); n != 1 {
+			t.Errorf("label %s searched %d time(s), want a full run", label, n)
+		}
+	}
+	if got := d.status().Watch.HistoryID; got != current {
+		t.Errorf("history = %d, want the current one %d", got, current)
+	}
+}
+
+func TestDaemon_ReloadRenewsWatch(t *testing.T) {
+	captureLog(t)
+	fake, d, _ := newWatchedMailbox(t)
+	start := historyID(t, fake)
+	startDaemon(t, d)
+
+	d.requestReload()
+	waitFor(t, "the watch to be renewed", func() bool { return len(fake.Watches()) == 2 })
+	if got := d.status().Watch.HistoryID; got != start {
+		t.Errorf("history after renewal = %d, want the processed one kept", got)
+	}
+}